@@ -1,19 +1,22 @@
 package ast
 
 import (
-	"container/list"
 	"fmt"
+	"io"
 	"regexp"
+	"strings"
 )
 
 type Ast struct {
-	Root          *AstNode
-	Query         string
+	Root  *AstNode
+	Query string
+	// SourceFile is the file Query was read from, if known. It's only used to
+	// describe the statement in errors.
+	SourceFile    string
 	ParentAsts    []*Ast
 	DependentAsts []*Ast
 }
 
-// TODO: return err instead of panicking
 type ExecQueryFunc func(query string) ([]map[string]interface{}, error)
 
 var sqlCommentRegex = regexp.MustCompile(`(?m)^\s*\-\-.*$`)
@@ -35,13 +38,25 @@ func NewFromQuery(query string, execQueryFunc ExecQueryFunc) (*Ast, error) {
 		return &Ast{}, error
 	}
 
-	linesStr := make([]string, len(lines))
+	p := newParser(query, ParseOptions{})
 
 	for i, line := range lines {
-		linesStr[i] = line["explain"].(string)
+		explainLine, ok := line["explain"].(string)
+		if !ok {
+			return &Ast{}, fmt.Errorf("explain row %d has no explain string column in query: %s", i+1, query)
+		}
+
+		if err := p.parseLine(explainLine); err != nil {
+			return &Ast{}, err
+		}
+	}
+
+	rootNode, err := p.finish()
+	if err != nil {
+		return &Ast{}, err
 	}
 
-	return NewFromExplainLines(query, linesStr)
+	return &Ast{Root: rootNode, Query: query}, nil
 }
 
 func NewFromExplainLines(query string, lines []string) (*Ast, error) {
@@ -53,15 +68,15 @@ func NewFromExplainLines(query string, lines []string) (*Ast, error) {
 	return &Ast{Root: rootNode, Query: query}, nil
 }
 
-func matchesAny[T, B any](a []T, b []B, matcher func(a T, b B) bool) bool {
-	for _, valA := range a {
-		for _, valB := range b {
-			if matcher(valA, valB) {
-				return true
-			}
-		}
+// NewFromExplainReader builds an Ast from explain ast output streamed from r,
+// such as a saved text dump.
+func NewFromExplainReader(query string, r io.Reader) (*Ast, error) {
+	rootNode, err := ParseReader(query, r)
+	if err != nil {
+		return &Ast{}, err
 	}
-	return false
+
+	return &Ast{Root: rootNode, Query: query}, nil
 }
 
 func QueriesInTopologicalOrder(queries []string, execQueryFunc ExecQueryFunc) ([]string, error) {
@@ -108,129 +123,50 @@ func RunQueriesInTopologicalOrder(queries []string, execQueryFunc ExecQueryFunc)
 	return nil
 }
 
+// PopulateAndSort fills in each ast's ParentAsts and DependentAsts from their
+// dependency Graph and returns them in topological order.
 func PopulateAndSort(asts ...*Ast) ([]*Ast, error) {
-	populateDependencyGraph(asts...)
+	graph := NewGraph(asts...)
+	graph.populate()
 
-	queue := list.New()
-	output := make([]*Ast, 0)
-	nodeDegrees := make(map[*Ast]int)
+	return graph.TopoSort()
+}
 
-	for _, ast := range asts {
-		nodeDegrees[ast] = len(ast.ParentAsts)
+func (a *Ast) NodesForMatch(matcher func(node *AstNode) bool) []*AstNode {
+	var nodes []*AstNode
 
-		if len(ast.ParentAsts) == 0 {
-			queue.PushBack(ast)
+	a.Root.Walk(func(node *AstNode) {
+		if matcher(node) {
+			nodes = append(nodes, node)
 		}
-	}
-
-	for queue.Len() > 0 {
-		element := queue.Front()
-		queue.Remove(element)
-		ast := element.Value.(*Ast)
+	})
 
-		output = append(output, ast)
+	return nodes
+}
 
-		for _, dependentAst := range ast.DependentAsts {
-			nodeDegrees[dependentAst]--
+// IdenticalSubtrees groups nodes of nodeType across asts whose subtrees hash the same,
+// e.g. the same subquery used by several views. Only groups of two or more are returned.
+func IdenticalSubtrees(nodeType string, asts ...*Ast) [][]*AstNode {
+	var hashes []uint64
+	groups := make(map[uint64][]*AstNode)
 
-			if nodeDegrees[dependentAst] <= 0 {
-				queue.PushBack(dependentAst)
+	for _, a := range asts {
+		for _, node := range a.NodesForMatch(func(node *AstNode) bool { return node.Type == nodeType }) {
+			if _, ok := groups[node.Hash]; !ok {
+				hashes = append(hashes, node.Hash)
 			}
+			groups[node.Hash] = append(groups[node.Hash], node)
 		}
 	}
 
-	if len(output) != len(asts) {
-		return []*Ast{}, fmt.Errorf("circular dependency detected")
-	}
-
-	return output, nil
-}
-
-func populateDependencyGraph(asts ...*Ast) {
-	for _, ast := range asts {
-		createTableAndViewStatements := ast.CreateTableAndViewStatements()
-		createFunctionStatements := ast.CreateFunctionStatements()
-		dropTableOrViewStatements := ast.DropTableOrViewStatements()
-		renameIdentifiers := ast.RenameIdentifiers()
-
-		selectColumnIdentifiers := ast.SelectColumnIdentifiers()
-
-		createTableColumnDeclarations := ast.CreateTableColumnDeclarations()
-		addColumnDeclarations := ast.AddColumnDeclarations()
-		modifyColumnDeclarations := ast.ModifyColumnDeclarations()
-		commentColumnIdentifiers := ast.CommentColumnIdentifiers()
-		materializeColumnIdentifiers := ast.MaterializeColumnIdentifiers()
-		renameColumnFromIdentifiers := ast.RenameColumnFromIdentifiers()
-		renameColumnToIdentifiers := ast.RenameColumnToIdentifiers()
-		createAndAddColumnDeclarations := append(createTableColumnDeclarations, addColumnDeclarations...)
-		allOriginatingColumnIdentifiers := append(
-			createAndAddColumnDeclarations,
-			renameColumnToIdentifiers...)
-
-		for _, candidate := range asts {
-			if candidate != ast {
-				ast.addDependentIfContainsAny(candidate, createTableAndViewStatements, candidate.TableAndViewIdentifiers())
-				// TODO: select column identifiers need to have any aliases resolved to the table name.
-				// Also, all select column identifiers should add table name as value qualifier
-				// All of these need to change to use ast nodes instead of value strings so it's more flexible.
-
-				ast.addDependentIfContainsAny(candidate, createTableAndViewStatements, candidate.AlterQueryStatements())
-				ast.addDependentIfContainsAny(candidate, createFunctionStatements, candidate.FunctionCalls())
-				ast.addDependentIfContainsAny(candidate, createTableAndViewStatements, candidate.RenameIdentifiers())
-				ast.addDependentIfContainsAny(candidate, dropTableOrViewStatements, candidate.TableAndViewIdentifiers())
-				ast.addDependentIfContainsAny(candidate, renameIdentifiers, candidate.DropTableOrViewStatements())
-
-				// wayyy slower now with all of this - TODO: optimize
-
-				// Column relationships
-				// TODO: these don't work right when multiple tables share column name. Get smarter about this.
-				// ast.addDependentIfContainsAny(candidate, allOriginatingColumnIdentifiers, candidate.SelectColumnTableQualifiers())
-				ast.addDependentIfContainsAny(candidate, allOriginatingColumnIdentifiers, candidate.SelectColumnIdentifiers())
-				ast.addDependentIfContainsAny(candidate, allOriginatingColumnIdentifiers, candidate.ModifyColumnDeclarations())
-				ast.addDependentIfContainsAny(candidate, allOriginatingColumnIdentifiers, candidate.CommentColumnIdentifiers())
-				ast.addDependentIfContainsAny(candidate, allOriginatingColumnIdentifiers, candidate.MaterializeColumnIdentifiers())
-				ast.addDependentIfContainsAny(candidate, allOriginatingColumnIdentifiers, candidate.RenameColumnFromIdentifiers())
-				ast.addDependentIfContainsAny(candidate, createAndAddColumnDeclarations, candidate.RenameColumnToIdentifiers())
-
-				// drop comes after add, modify, comment, materialize, rename
-				dropColumnIdentifiers := candidate.DropOrClearColumnIdentifiers()
-				ast.addDependentIfContainsAny(candidate, selectColumnIdentifiers, dropColumnIdentifiers)
-				ast.addDependentIfContainsAny(candidate, addColumnDeclarations, dropColumnIdentifiers)
-				ast.addDependentIfContainsAny(candidate, modifyColumnDeclarations, dropColumnIdentifiers)
-				ast.addDependentIfContainsAny(candidate, commentColumnIdentifiers, dropColumnIdentifiers)
-				ast.addDependentIfContainsAny(candidate, materializeColumnIdentifiers, dropColumnIdentifiers)
-				ast.addDependentIfContainsAny(candidate, renameColumnFromIdentifiers, dropColumnIdentifiers)
-				ast.addDependentIfContainsAny(candidate, renameColumnToIdentifiers, dropColumnIdentifiers)
-			}
+	var identical [][]*AstNode
+	for _, hash := range hashes {
+		if len(groups[hash]) > 1 {
+			identical = append(identical, groups[hash])
 		}
 	}
-}
-
-func (ast *Ast) addDependentIfMatchesAny(dependentAst *Ast, a []string, b []string, matcher func(string, b string) bool) {
-	if matchesAny(a, b, matcher) {
-		ast.addDependent(dependentAst)
-	}
-}
-
-func (ast *Ast) addDependentIfContainsAny(dependentAst *Ast, a []string, b []string) {
-	ast.addDependentIfMatchesAny(dependentAst, a, b, func(a string, b string) bool { return a == b })
-}
-
-func (ast *Ast) addDependent(dependentAst *Ast) {
-	ast.DependentAsts = append(ast.DependentAsts, dependentAst)
-	dependentAst.ParentAsts = append(dependentAst.ParentAsts, ast)
-}
-
-func (a *Ast) NodesForMatch(matcher func(node *AstNode) bool) []*AstNode {
-	var nodes []*AstNode
 
-	a.Root.Walk(func(node *AstNode) {
-		if matcher(node) {
-			nodes = append(nodes, node)
-		}
-	})
-
-	return nodes
+	return identical
 }
 
 func (a *Ast) ValuesForMatch(matcher func(node *AstNode) bool) []string {
@@ -259,12 +195,17 @@ func (a *Ast) alterColumnIdentifiers(modificationType string, columnType string)
 
 // TODO: document node types of interest
 func (a *Ast) CreateTableColumnDeclarations() []string {
-	return a.ValuesForMatch(func(node *AstNode) bool {
-		return node.Type == "ColumnDeclaration" &&
-			node.parentIsType("ExpressionList") &&
-			node.Parent.parentIsType("Columns") &&
-			node.Parent.Parent.parentIsType("CreateQuery")
-	})
+	var values []string
+
+	for _, node := range a.NodesForMatch(func(node *AstNode) bool { return node.Type == "CreateQuery" }) {
+		createQuery, _ := AsCreateQuery(node)
+
+		for _, column := range createQuery.Columns() {
+			values = append(values, column.Name())
+		}
+	}
+
+	return values
 }
 
 func (a *Ast) AddColumnDeclarations() []string {
@@ -288,20 +229,37 @@ func (a *Ast) MaterializeColumnIdentifiers() []string {
 	return a.alterColumnIdentifiers("MATERIALIZE_COLUMN", "Identifier")
 }
 
+func (a *Ast) renameColumnCommands() []AlterCommand {
+	var commands []AlterCommand
+
+	for _, node := range a.NodesForMatch(func(node *AstNode) bool { return node.Type == "AlterCommand" }) {
+		command, _ := AsAlterCommand(node)
+		if command.Kind() == "RENAME_COLUMN" && len(command.Identifiers()) == 2 {
+			commands = append(commands, command)
+		}
+	}
+
+	return commands
+}
+
 func (a *Ast) RenameColumnFromIdentifiers() []string {
-	return a.ValuesForMatch(func(node *AstNode) bool {
-		return node.parentIsAlterColumn("RENAME_COLUMN") &&
-			node.Type == "Identifier" &&
-			node.Parent.Children[0] == node
-	})
+	var values []string
+
+	for _, command := range a.renameColumnCommands() {
+		values = append(values, command.ColumnName())
+	}
+
+	return values
 }
 
 func (a *Ast) RenameColumnToIdentifiers() []string {
-	return a.ValuesForMatch(func(node *AstNode) bool {
-		return node.parentIsAlterColumn("RENAME_COLUMN") &&
-			node.Type == "Identifier" &&
-			node.Parent.Children[1] == node
-	})
+	var values []string
+
+	for _, command := range a.renameColumnCommands() {
+		values = append(values, command.RenameTo())
+	}
+
+	return values
 }
 
 func (a *Ast) SelectColumnIdentifiers() []string {
@@ -353,16 +311,28 @@ func (a *Ast) SelectColumnNodes() []*AstNode {
 	})
 }
 
-var createTableAsTableRegexp = regexp.MustCompile(`(?is)create(?:\s+or\s+replace)?\s+table\s+(?:[^\s]+).*as\s+(?:\w+\.)?(\w+).*`)
+// createTableAsTableRegexp matches the header of CREATE TABLE t AS [db.]other, capturing
+// the database and name of the table whose structure is copied.
+var createTableAsTableRegexp = regexp.MustCompile(`(?is)^\s*create(?:\s+or\s+replace)?\s+table\s+(?:if\s+not\s+exists\s+)?[^\s(]+(?:\s+on\s+cluster\s+[^\s(]+)?\s+as\s+(?:(\w+)\.)?(\w+)\b`)
+
+// createTableAsTable returns the table a CREATE TABLE ... AS statement copies its
+// structure from, if it has one. AS SELECT and AS WITH start a query, not a table.
+func createTableAsTable(query string) (database string, table string, ok bool) {
+	matches := createTableAsTableRegexp.FindStringSubmatch(query)
+	if len(matches) == 0 || strings.EqualFold(matches[2], "select") || strings.EqualFold(matches[2], "with") {
+		return "", "", false
+	}
+
+	return matches[1], matches[2], true
+}
 
 func (a *Ast) TableAndViewIdentifiers() []string {
 	var values []string
 
 	switch a.Root.Type {
 	case "CreateQuery":
-		matches := createTableAsTableRegexp.FindStringSubmatch(a.Query)
-		if len(matches) > 0 {
-			values = append(values, matches[1])
+		if _, table, ok := createTableAsTable(a.Query); ok {
+			values = append(values, table)
 		}
 	case "TruncateQuery":
 		values = append(values, a.Root.Children[0].Value)
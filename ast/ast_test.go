@@ -14,7 +14,7 @@ func TestPopulateDependencyGraph(t *testing.T) {
 	ast3, _ := NewFromExplainLines("create table/view/materialized view", createQueryAstLines())
 	// TODO: expand to all types of creation and references. views, materialized views, tables.
 
-	populateDependencyGraph(ast1, ast2, ast3)
+	NewGraph(ast1, ast2, ast3).populate()
 
 	// TODO: relationship is many to many. so multiple parents are possible.
 	assert.Equal(t, ast1.ParentAsts, []*Ast{ast2, ast3})
@@ -0,0 +1,410 @@
+package ast
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+type ChangeKind string
+
+const (
+	ChangeInsert ChangeKind = "insert"
+	ChangeDelete ChangeKind = "delete"
+	ChangeMove   ChangeKind = "move"
+	ChangeUpdate ChangeKind = "update"
+)
+
+// Change is a single edit turning one tree into another.
+//
+// Paths locate a node by the type and child index of each node on the way down from
+// the root, e.g. "SelectWithUnionQuery/ExpressionList[0]/SelectQuery[0]".
+type Change struct {
+	Kind ChangeKind `json:"kind"`
+	// OldPath is where the node was in the old tree. Inserts don't have one.
+	OldPath string `json:"old_path,omitempty"`
+	// NewPath is where the node is in the new tree. Deletes don't have one.
+	NewPath string `json:"new_path,omitempty"`
+	// Old and New describe the node before and after the change by its type, value
+	// and alias.
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+
+	OldNode *AstNode `json:"-"`
+	NewNode *AstNode `json:"-"`
+}
+
+// Diff returns the changes that turn the tree rooted at a into the one rooted at b.
+//
+// Children are matched first by hash, so identical subtrees are paired wherever they
+// went, then by type and value, then by type and alias, and finally by type alone in
+// order. Matched nodes whose value, qualifier or alias differ are updates, and
+// matched nodes that changed position among their siblings are moves. Unmatched
+// nodes are deletes and inserts, except that an identical subtree deleted in one
+// place and inserted in another is a move. Both trees' hashes must be up to date.
+func Diff(a, b *AstNode) []Change {
+	d := differ{oldHashes: subtreeHashes(a), newHashes: subtreeHashes(b)}
+
+	if a.Type != b.Type {
+		d.add(ChangeDelete, a, nil)
+		d.add(ChangeInsert, nil, b)
+	} else {
+		d.diffNodes(a, b)
+	}
+
+	return d.pairMoves()
+}
+
+type differ struct {
+	changes []Change
+	// The hashes of every subtree in each tree, to tell when a subtree went elsewhere.
+	oldHashes map[uint64]bool
+	newHashes map[uint64]bool
+	subtrees  map[*AstNode]map[uint64]bool
+}
+
+func subtreeHashes(root *AstNode) map[uint64]bool {
+	hashes := map[uint64]bool{}
+	root.Walk(func(node *AstNode) { hashes[node.Hash] = true })
+
+	return hashes
+}
+
+func (d *differ) add(kind ChangeKind, from *AstNode, to *AstNode) {
+	change := Change{Kind: kind, OldNode: from, NewNode: to}
+
+	if from != nil {
+		change.OldPath = NodePath(from)
+		change.Old = diffLabel(from)
+	}
+
+	if to != nil {
+		change.NewPath = NodePath(to)
+		change.New = diffLabel(to)
+	}
+
+	d.changes = append(d.changes, change)
+}
+
+// samePath reports whether two identifier paths have the same database and subcolumn parts,
+// the ones Value and ValueQualifier don't cover. Quoting is ignored as it is when hashing.
+func samePath(a, b IdentifierPath) bool {
+	if a.Database != b.Database || len(a.Subcolumns) != len(b.Subcolumns) {
+		return false
+	}
+
+	for i := range a.Subcolumns {
+		if a.Subcolumns[i] != b.Subcolumns[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// diffNodes records the changes between two matched nodes and their subtrees.
+func (d *differ) diffNodes(a, b *AstNode) {
+	if a.Hash == b.Hash {
+		return
+	}
+
+	if a.Value != b.Value || a.ValueQualifier != b.ValueQualifier || a.Alias != b.Alias || !samePath(a.Path, b.Path) {
+		d.add(ChangeUpdate, a, b)
+	}
+
+	pairs, matchedA, matchedB := d.matchChildren(a.Children, b.Children)
+
+	for _, i := range movedPairs(pairs) {
+		d.add(ChangeMove, a.Children[pairs[i][0]], b.Children[pairs[i][1]])
+	}
+
+	for i, child := range a.Children {
+		if matchedA[i] < 0 {
+			d.add(ChangeDelete, child, nil)
+		} else {
+			d.diffNodes(child, b.Children[matchedA[i]])
+		}
+	}
+
+	for j, child := range b.Children {
+		if matchedB[j] < 0 {
+			d.add(ChangeInsert, nil, child)
+		}
+	}
+}
+
+// pairMoves turns deleted subtrees that are identical to inserted ones into moves.
+// A deleted subtree can reappear as part of an inserted one, such as an expression
+// that gets wrapped in a function call, and the other way around, in which case the
+// enclosing insert or delete is kept.
+func (d *differ) pairMoves() []Change {
+	claimed := map[*AstNode]bool{}
+	removed := map[int]bool{}
+
+	// findIn looks for an unclaimed copy of node among the subtrees of one kind of change.
+	findIn := func(kind ChangeKind, node *AstNode) (int, *AstNode) {
+		for i, change := range d.changes {
+			root := change.NewNode
+			if kind == ChangeDelete {
+				root = change.OldNode
+			}
+
+			if change.Kind != kind || removed[i] || !d.hashesIn(root)[node.Hash] {
+				continue
+			}
+
+			var found *AstNode
+			root.Walk(func(candidate *AstNode) {
+				if found == nil && !claimed[candidate] && candidate.Hash == node.Hash {
+					found = candidate
+				}
+			})
+
+			if found != nil {
+				return i, found
+			}
+		}
+
+		return -1, nil
+	}
+
+	for i := range d.changes {
+		change := &d.changes[i]
+		if removed[i] {
+			continue
+		}
+
+		switch change.Kind {
+		case ChangeDelete:
+			j, found := findIn(ChangeInsert, change.OldNode)
+			if found == nil {
+				continue
+			}
+			claimed[found] = true
+			if found == d.changes[j].NewNode {
+				removed[j] = true
+			}
+			change.Kind, change.NewNode, change.NewPath, change.New = ChangeMove, found, NodePath(found), diffLabel(found)
+		case ChangeInsert:
+			j, found := findIn(ChangeDelete, change.NewNode)
+			if found == nil {
+				continue
+			}
+			claimed[found] = true
+			if found == d.changes[j].OldNode {
+				removed[j] = true
+			}
+			change.Kind, change.OldNode, change.OldPath, change.Old = ChangeMove, found, NodePath(found), diffLabel(found)
+		}
+	}
+
+	var changes []Change
+	for i, change := range d.changes {
+		if !removed[i] {
+			changes = append(changes, change)
+		}
+	}
+
+	return changes
+}
+
+// hashesIn returns the hashes of root's subtree, remembering them for next time.
+func (d *differ) hashesIn(root *AstNode) map[uint64]bool {
+	if d.subtrees == nil {
+		d.subtrees = map[*AstNode]map[uint64]bool{}
+	}
+
+	if d.subtrees[root] == nil {
+		d.subtrees[root] = subtreeHashes(root)
+	}
+
+	return d.subtrees[root]
+}
+
+// matchChildren pairs up a and b, returning the pairs in a's order along with the
+// index each node was matched to, or -1.
+func (d *differ) matchChildren(a []*AstNode, b []*AstNode) ([][2]int, []int, []int) {
+	matchedA := make([]int, len(a))
+	matchedB := make([]int, len(b))
+
+	for i := range matchedA {
+		matchedA[i] = -1
+	}
+	for j := range matchedB {
+		matchedB[j] = -1
+	}
+
+	passes := []func(x, y *AstNode) bool{
+		func(x, y *AstNode) bool { return x.Hash == y.Hash },
+		func(x, y *AstNode) bool {
+			return x.Type == y.Type && x.Value == y.Value && x.ValueQualifier == y.ValueQualifier
+		},
+		func(x, y *AstNode) bool { return x.Type == y.Type && x.Alias != "" && x.Alias == y.Alias },
+		// Nodes matched by type alone are the least alike, so they're left for
+		// pairMoves when an identical copy of either is elsewhere in the other tree.
+		func(x, y *AstNode) bool {
+			return x.Type == y.Type && !d.newHashes[x.Hash] && !d.oldHashes[y.Hash]
+		},
+	}
+
+	for _, matches := range passes {
+		for i, x := range a {
+			if matchedA[i] >= 0 {
+				continue
+			}
+
+			// Prefer the node in the same position so duplicates stay in place.
+			candidate := -1
+			if i < len(b) && matchedB[i] < 0 && matches(x, b[i]) {
+				candidate = i
+			}
+
+			for j := 0; candidate < 0 && j < len(b); j++ {
+				if matchedB[j] < 0 && matches(x, b[j]) {
+					candidate = j
+				}
+			}
+
+			if candidate >= 0 {
+				matchedA[i] = candidate
+				matchedB[candidate] = i
+			}
+		}
+	}
+
+	var pairs [][2]int
+	for i, j := range matchedA {
+		if j >= 0 {
+			pairs = append(pairs, [2]int{i, j})
+		}
+	}
+
+	return pairs, matchedA, matchedB
+}
+
+// movedPairs returns the indexes of the pairs that changed order, which are the
+// ones outside the longest run of pairs whose order is the same in both lists.
+func movedPairs(pairs [][2]int) []int {
+	if len(pairs) < 2 {
+		return nil
+	}
+
+	lengths := make([]int, len(pairs))
+	previous := make([]int, len(pairs))
+	best := 0
+
+	for i := range pairs {
+		lengths[i], previous[i] = 1, -1
+
+		for k := 0; k < i; k++ {
+			if pairs[k][1] < pairs[i][1] && lengths[k]+1 > lengths[i] {
+				lengths[i], previous[i] = lengths[k]+1, k
+			}
+		}
+
+		if lengths[i] > lengths[best] {
+			best = i
+		}
+	}
+
+	inOrder := make([]bool, len(pairs))
+	for i := best; i >= 0; i = previous[i] {
+		inOrder[i] = true
+	}
+
+	var moved []int
+	for i := range pairs {
+		if !inOrder[i] {
+			moved = append(moved, i)
+		}
+	}
+
+	return moved
+}
+
+// NodePath returns the path of node from its root, e.g.
+// "SelectWithUnionQuery/ExpressionList[0]/SelectQuery[0]".
+func NodePath(node *AstNode) string {
+	var segments []string
+
+	for ; node != nil; node = node.Parent {
+		segment := node.Type
+		if node.Parent != nil {
+			segment += "[" + strconv.Itoa(siblingIndex(node)) + "]"
+		}
+		segments = append(segments, segment)
+	}
+
+	for i, j := 0, len(segments)-1; i < j; i, j = i+1, j-1 {
+		segments[i], segments[j] = segments[j], segments[i]
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// diffLabel describes a node by its type, value and alias, leaving out its children.
+func diffLabel(node *AstNode) string {
+	label := node.Type
+
+	if value := node.explainValue(); strings.TrimSpace(value) != "" {
+		label += " " + value
+	}
+
+	if node.Alias != "" {
+		label += " (alias " + node.Alias + ")"
+	}
+
+	return label
+}
+
+// FormatDiff renders changes as unified-style text. Each change has an "@@ kind
+// path @@" header followed by the lines it removes, prefixed with -, and adds,
+// prefixed with +. Inserted and deleted subtrees are written out in full as explain
+// ast lines.
+func FormatDiff(changes []Change) string {
+	var sb strings.Builder
+
+	writeSubtree := func(prefix string, root *AstNode) {
+		var walk func(node *AstNode, depth int)
+		walk = func(node *AstNode, depth int) {
+			sb.WriteString(prefix + node.explainLine(depth) + "\n")
+			for _, child := range node.Children {
+				walk(child, depth+1)
+			}
+		}
+		walk(root, 0)
+	}
+
+	for _, change := range changes {
+		switch change.Kind {
+		case ChangeInsert:
+			sb.WriteString("@@ insert " + change.NewPath + " @@\n")
+			writeSubtree("+", change.NewNode)
+		case ChangeDelete:
+			sb.WriteString("@@ delete " + change.OldPath + " @@\n")
+			writeSubtree("-", change.OldNode)
+		case ChangeMove:
+			sb.WriteString("@@ move " + change.OldPath + " -> " + change.NewPath + " @@\n")
+			sb.WriteString(" " + change.New + "\n")
+		case ChangeUpdate:
+			path := change.OldPath
+			if change.NewPath != path {
+				path += " -> " + change.NewPath
+			}
+			sb.WriteString("@@ update " + path + " @@\n")
+			sb.WriteString("-" + change.Old + "\n")
+			sb.WriteString("+" + change.New + "\n")
+		}
+	}
+
+	return sb.String()
+}
+
+// DiffJSON renders changes as an indented JSON array.
+func DiffJSON(changes []Change) ([]byte, error) {
+	if changes == nil {
+		changes = []Change{}
+	}
+
+	return json.MarshalIndent(changes, "", "  ")
+}
@@ -0,0 +1,147 @@
+package ast
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func diffSelectLines(columns ...string) []string {
+	lines := []string{
+		"SelectWithUnionQuery (children 1)",
+		" ExpressionList (children 1)",
+		"  SelectQuery (children 2)",
+	}
+
+	count := 0
+	for _, column := range columns {
+		if !strings.HasPrefix(column, "     ") {
+			count++
+		}
+	}
+
+	lines = append(lines, "   ExpressionList (children "+strconv.Itoa(count)+")")
+	lines = append(lines, columns...)
+
+	return append(lines,
+		"   TablesInSelectQuery (children 1)",
+		"    TablesInSelectQueryElement (children 1)",
+		"     TableExpression (children 1)",
+		"      TableIdentifier t",
+	)
+}
+
+func TestDiff(t *testing.T) {
+	a, err := Parse("", diffSelectLines(
+		"    Identifier a",
+		"    Identifier b (alias x)",
+		"    Function count (children 1)",
+		"     ExpressionList",
+	))
+	assert.NoError(t, err)
+
+	b, err := Parse("", diffSelectLines(
+		"    Identifier b (alias y)",
+		"    Identifier a",
+		"    Function count (children 1)",
+		"     ExpressionList",
+		"    Identifier c",
+	))
+	assert.NoError(t, err)
+
+	changes := Diff(a, b)
+	assert.Equal(t, []ChangeKind{ChangeMove, ChangeUpdate, ChangeInsert}, changeKinds(changes))
+
+	columns := "SelectWithUnionQuery/ExpressionList[0]/SelectQuery[0]/ExpressionList[0]"
+	assert.Equal(t, columns+"/Identifier[1]", changes[0].OldPath)
+	assert.Equal(t, columns+"/Identifier[0]", changes[0].NewPath)
+	assert.Equal(t, "Identifier b (alias x)", changes[1].Old)
+	assert.Equal(t, "Identifier b (alias y)", changes[1].New)
+
+	assert.Equal(t, `@@ move `+columns+`/Identifier[1] -> `+columns+`/Identifier[0] @@
+ Identifier b (alias y)
+@@ update `+columns+`/Identifier[1] -> `+columns+`/Identifier[0] @@
+-Identifier b (alias x)
++Identifier b (alias y)
+@@ insert `+columns+`/Identifier[3] @@
++Identifier c
+`, FormatDiff(changes))
+
+	text, err := DiffJSON(changes)
+	assert.NoError(t, err)
+
+	var decoded []map[string]string
+	assert.NoError(t, json.Unmarshal(text, &decoded))
+	assert.Equal(t, map[string]string{"kind": "insert", "new_path": columns + "/Identifier[3]", "new": "Identifier c"}, decoded[2])
+
+	assert.Empty(t, Diff(a, a.Clone()))
+
+	text, err = DiffJSON(Diff(a, a.Clone()))
+	assert.NoError(t, err)
+	assert.Equal(t, "[]", string(text))
+}
+
+func TestDiffSubtrees(t *testing.T) {
+	a, err := Parse("", diffSelectLines(
+		"    Function plus (children 1)",
+		"     ExpressionList (children 2)",
+		"      Identifier a",
+		"      Literal UInt64_1",
+		"    Identifier d",
+	))
+	assert.NoError(t, err)
+
+	// The sum moves under a new function, d becomes e and the sum's literal changes.
+	b, err := Parse("", diffSelectLines(
+		"    Function toString (children 1)",
+		"     ExpressionList (children 1)",
+		"      Function plus (children 1)",
+		"       ExpressionList (children 2)",
+		"        Identifier a",
+		"        Literal UInt64_1",
+		"    Identifier e",
+	))
+	assert.NoError(t, err)
+
+	changes := Diff(a, b)
+	assert.Equal(t, []ChangeKind{ChangeMove, ChangeUpdate, ChangeInsert}, changeKinds(changes))
+	assert.Equal(t, "Function plus", changes[0].New)
+	assert.Contains(t, changes[0].NewPath, "Function[0]/ExpressionList[0]/Function[0]")
+	assert.Equal(t, "Identifier d", changes[1].Old)
+	assert.Equal(t, "Identifier e", changes[1].New)
+	assert.Equal(t, "Function toString", changes[2].New)
+
+	// Different statement types are replaced outright.
+	create, err := Parse("", createTableLines())
+	assert.NoError(t, err)
+	assert.Equal(t, []ChangeKind{ChangeDelete, ChangeInsert}, changeKinds(Diff(a, create)))
+}
+
+func TestDiffIdentifierPaths(t *testing.T) {
+	diff := func(a, b string) []Change {
+		x, err := Parse("", []string{a})
+		assert.NoError(t, err)
+		y, err := Parse("", []string{b})
+		assert.NoError(t, err)
+		return Diff(x, y)
+	}
+
+	changes := diff("Identifier db1.t.z", "Identifier db2.t.z")
+	assert.Equal(t, []ChangeKind{ChangeUpdate}, changeKinds(changes))
+	assert.Equal(t, "Identifier db1.t.z", changes[0].Old)
+	assert.Equal(t, "Identifier db2.t.z", changes[0].New)
+
+	assert.Equal(t, []ChangeKind{ChangeUpdate}, changeKinds(diff("Identifier tup.1", "Identifier tup.2")))
+	assert.Empty(t, diff("Identifier `t`.z", "Identifier t.z"))
+}
+
+func changeKinds(changes []Change) []ChangeKind {
+	kinds := make([]ChangeKind, len(changes))
+	for i, change := range changes {
+		kinds[i] = change.Kind
+	}
+	return kinds
+}
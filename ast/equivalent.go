@@ -0,0 +1,167 @@
+package ast
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// EquivalenceOptions turns on the differences Equivalent ignores beyond the cosmetic
+// ones it always does.
+type EquivalenceOptions struct {
+	// UnorderedSettings ignores the order of SETTINGS.
+	UnorderedSettings bool
+	// UnorderedColumns ignores the order of SELECT lists and of the columns declared
+	// by CREATE statements.
+	UnorderedColumns bool
+}
+
+// Hints that come from comments rather than the statement itself.
+var commentHints = map[string]bool{hintAllowLossy: true}
+
+// Equivalent reports whether two statements mean the same thing. explain ast
+// already leaves out whitespace, comments, keyword case and redundant parentheses,
+// and Equivalent also ignores aliases that repeat the aliased identifier, such as
+// "a AS a". The options can make it ignore the order of SETTINGS and column lists
+// too. Hints recovered from the source queries, such as join kinds and ORDER BY
+// directions, are compared along with the trees, so it's an error to compare asts
+// without a source query or whose hints couldn't all be matched. Neither ast is changed.
+func Equivalent(a, b *Ast, opts EquivalenceOptions) (bool, error) {
+	if a.Root == nil || b.Root == nil {
+		return false, fmt.Errorf("cannot compare an empty ast")
+	}
+
+	for _, ast := range []*Ast{a, b} {
+		if err := requireHints(ast); err != nil {
+			return false, err
+		}
+	}
+
+	first, second := canonicalTree(a.Root, opts), canonicalTree(b.Root, opts)
+	if first.Hash != second.Hash {
+		return false, nil
+	}
+
+	return sameHints(first, second), nil
+}
+
+// requireHints returns an error if a has no source query hints or some couldn't be
+// matched. Without them, queries differing only in what explain ast
+// leaves out, such as LEFT and INNER joins, would look the same.
+func requireHints(a *Ast) error {
+	var hints *treeHints
+	if strings.TrimSpace(a.Query) != "" {
+		hints = a.Root.sourceHints()
+	}
+
+	if hints == nil {
+		return fmt.Errorf("cannot compare %s without its source query, parse it with the query", StatementLabel(a))
+	}
+
+	if len(hints.mismatches) > 0 {
+		return fmt.Errorf("cannot compare %s with incomplete source hints: %w", StatementLabel(a), hints.mismatches[0])
+	}
+
+	return nil
+}
+
+// canonicalTree returns a copy of root with redundant aliases removed and, as opts
+// allow, its settings and column lists sorted.
+func canonicalTree(root *AstNode, opts EquivalenceOptions) *AstNode {
+	root = root.Clone()
+	unordered := map[*AstNode]bool{}
+
+	root.Walk(func(node *AstNode) {
+		if node.Type == "Identifier" && node.Alias != "" && node.Alias == identifierName(node) {
+			node.Alias = ""
+		}
+
+		if settings := node.Hints[hintSettings]; opts.UnorderedSettings && settings != "" {
+			node.Hints[hintSettings] = sortedSettings(settings)
+		}
+
+		if !opts.UnorderedColumns {
+			return
+		}
+
+		if query, ok := AsSelectQuery(node); ok && query.clauses.columns != nil {
+			unordered[query.clauses.columns] = true
+		}
+
+		if node.Type == "Columns" {
+			for _, list := range node.Children {
+				if list.isListOf("ColumnDeclaration") {
+					unordered[list] = true
+				}
+			}
+		}
+	})
+
+	sortChildren(root, unordered)
+
+	return root
+}
+
+// identifierName returns the unquoted name of an Identifier as written, parts and all.
+func identifierName(node *AstNode) string {
+	if len(node.Path.Parts) == 0 {
+		return node.Value
+	}
+
+	names := make([]string, len(node.Path.Parts))
+	for i, part := range node.Path.Parts {
+		names[i] = part.Name
+	}
+
+	return strings.Join(names, ".")
+}
+
+// sortedSettings sorts the changes in a SETTINGS hint by name.
+func sortedSettings(settings string) string {
+	changes := settingChanges(settings)
+	sort.Slice(changes, func(i, j int) bool { return changes[i].name < changes[j].name })
+
+	return settingsHint(changes)
+}
+
+// sortChildren rehashes the subtree under node, sorting the children of the unordered
+// nodes by hash on the way.
+func sortChildren(node *AstNode, unordered map[*AstNode]bool) {
+	for _, child := range node.Children {
+		sortChildren(child, unordered)
+	}
+
+	if unordered[node] {
+		sort.SliceStable(node.Children, func(i, j int) bool { return node.Children[i].Hash < node.Children[j].Hash })
+	}
+
+	node.Hash = node.localHash()
+}
+
+// sameHints reports whether two trees with the same shape have the same hints, other
+// than those from comments.
+func sameHints(a, b *AstNode) bool {
+	if len(a.Children) != len(b.Children) {
+		return false
+	}
+
+	for key, value := range a.Hints {
+		if !commentHints[key] && b.Hints[key] != value {
+			return false
+		}
+	}
+
+	for key, value := range b.Hints {
+		if !commentHints[key] && a.Hints[key] != value {
+			return false
+		}
+	}
+
+	for i := range a.Children {
+		if !sameHints(a.Children[i], b.Children[i]) {
+			return false
+		}
+	}
+
+	return true
+}
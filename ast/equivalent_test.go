@@ -0,0 +1,95 @@
+package ast
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func equivalentLines(columns ...string) []string {
+	lines := []string{
+		"SelectWithUnionQuery (children 1)",
+		" ExpressionList (children 1)",
+		"  SelectQuery (children 4)",
+		"   ExpressionList (children 2)",
+	}
+	for _, column := range columns {
+		lines = append(lines, "    "+column)
+	}
+
+	return append(lines,
+		"   TablesInSelectQuery (children 1)",
+		"    TablesInSelectQueryElement (children 1)",
+		"     TableExpression (children 1)",
+		"      TableIdentifier t",
+		"   Function greater (children 1)",
+		"    ExpressionList (children 2)",
+		"     Identifier a",
+		"     Literal UInt64_1",
+		"   Set",
+	)
+}
+
+func TestEquivalent(t *testing.T) {
+	parse := func(query string, columns ...string) *Ast {
+		a, err := NewFromExplainLines(query, equivalentLines(columns...))
+		assert.NoError(t, err)
+		return a
+	}
+
+	original := parse("SELECT a, b FROM t WHERE a > 1 SETTINGS max_threads = 2, max_block_size = 10",
+		"Identifier a", "Identifier b")
+	reformatted := parse("-- treehouse:allow-lossy\nselect `a` as a,\n  b\nfrom t\nwhere ((a > 1))\nsettings max_threads=2, max_block_size=10",
+		"Identifier a (alias a)", "Identifier b")
+	reordered := parse("select b, a from t where a > 1 settings max_block_size = 10, max_threads = 2",
+		"Identifier b", "Identifier a")
+	aliased := parse("select a as b, b from t where a > 1 settings max_threads = 2, max_block_size = 10",
+		"Identifier a (alias b)", "Identifier b")
+	otherSettings := parse("select a, b from t where a > 1 settings max_threads = 4, max_block_size = 10",
+		"Identifier a", "Identifier b")
+	firstElement := parse("select tup.1, b from t where a > 1 settings max_threads = 2, max_block_size = 10",
+		"Identifier tup.1", "Identifier b")
+	secondElement := parse("select tup.2, b from t where a > 1 settings max_threads = 2, max_block_size = 10",
+		"Identifier tup.2", "Identifier b")
+
+	tests := []struct {
+		name       string
+		a, b       *Ast
+		opts       EquivalenceOptions
+		equivalent bool
+	}{
+		{"formatting, comments and redundant aliases", original, reformatted, EquivalenceOptions{}, true},
+		{"reordered columns and settings", original, reordered, EquivalenceOptions{}, false},
+		{"reordered settings only", original, reordered, EquivalenceOptions{UnorderedSettings: true}, false},
+		{"unordered", original, reordered, EquivalenceOptions{UnorderedSettings: true, UnorderedColumns: true}, true},
+		{"different alias", original, aliased, EquivalenceOptions{}, false},
+		{"different settings", original, otherSettings, EquivalenceOptions{UnorderedSettings: true}, false},
+		{"different tuple elements", firstElement, secondElement, EquivalenceOptions{}, false},
+	}
+
+	for _, test := range tests {
+		equivalent, err := Equivalent(test.a, test.b, test.opts)
+		assert.NoError(t, err, test.name)
+		assert.Equal(t, test.equivalent, equivalent, test.name)
+	}
+
+	columns, _ := reformatted.Select("SelectQuery > ExpressionList > Identifier")
+	assert.Equal(t, "a", columns[0].Alias, "the asts aren't changed")
+
+	_, err := Equivalent(original, &Ast{}, EquivalenceOptions{})
+	assert.ErrorContains(t, err, "cannot compare an empty ast")
+
+	// Join kinds and ORDER BY directions aren't in explain ast, so the source queries are needed.
+	withoutQuery, err := NewFromExplainLines("", equivalentLines("Identifier a", "Identifier b"))
+	assert.NoError(t, err)
+
+	_, err = Equivalent(original, withoutQuery, EquivalenceOptions{})
+	assert.ErrorContains(t, err, "without its source query")
+
+	mismatched, err := NewFromExplainLines("SELECT a, b FROM t WHERE a > 1 UNION ALL SELECT a, b FROM t", equivalentLines("Identifier a", "Identifier b"))
+	assert.NoError(t, err)
+
+	_, err = Equivalent(mismatched, original, EquivalenceOptions{})
+	var mismatch *HintMismatchError
+	assert.ErrorAs(t, err, &mismatch)
+}
@@ -0,0 +1,142 @@
+package ast
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// Placeholder is the Literal value Fingerprint puts in place of constants.
+const Placeholder = "?"
+
+// Fingerprint identifies the shape of a query independently of its constants, so
+// queries that only differ in literal values can be grouped together.
+type Fingerprint struct {
+	// Hash is a hash of Query. It's the same across processes and runs.
+	Hash uint64
+	// Query is the formatted query with every constant replaced by ?. Queries that
+	// can't be formatted get the explain ast text of the normalized tree instead.
+	Query string
+	// Root is a normalized copy of the ast the Query was formatted from.
+	Root *AstNode
+}
+
+// The IN operators, whose constant lists are collapsed to a single placeholder.
+var inFunctions = map[string]bool{"in": true, "notIn": true, "globalIn": true, "globalNotIn": true}
+
+// Fingerprint replaces every Literal in a copy of the ast with a ? placeholder,
+// folding negated constants into theirs and collapsing IN lists of any length into
+// one, then formats the result. The constants kept in hints rather than the tree,
+// SETTINGS values, index granularities and TTL disks and volumes, are replaced too.
+// When the result can't be formatted, such as for commands Format doesn't know, it's
+// serialized instead so the query can still be grouped. The ast itself isn't changed.
+func (a *Ast) Fingerprint() (Fingerprint, error) {
+	if a.Root == nil {
+		return Fingerprint{}, fmt.Errorf("cannot fingerprint an empty ast")
+	}
+
+	root := a.Root.Clone()
+
+	var constants []*AstNode
+	collectConstants(root, &constants)
+
+	for _, node := range constants {
+		placeholder := &AstNode{
+			Type:       "Literal",
+			Value:      Placeholder,
+			Alias:      node.Alias,
+			Indent:     node.Indent,
+			LineNumber: node.LineNumber,
+		}
+		placeholder.refreshLine()
+
+		if node.Parent == nil {
+			root = placeholder
+			break
+		}
+
+		if err := node.ReplaceWith(placeholder); err != nil {
+			return Fingerprint{}, err
+		}
+	}
+
+	root.Walk(func(node *AstNode) {
+		if settings, ok := node.Hints[hintSettings]; ok {
+			node.Hints[hintSettings] = placeholderSettings(settings)
+		}
+
+		for _, key := range []string{hintGranularity, hintTTLDestination} {
+			if _, ok := node.Hints[key]; ok {
+				node.Hints[key] = Placeholder
+			}
+		}
+	})
+
+	query, err := Format(root)
+	if err != nil {
+		query = root.Serialize()
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(query))
+
+	return Fingerprint{Hash: h.Sum64(), Query: query, Root: root}, nil
+}
+
+// collectConstants appends the outermost nodes under node that become placeholders.
+func collectConstants(node *AstNode, constants *[]*AstNode) {
+	if isConstant(node) || isConstantInList(node) {
+		*constants = append(*constants, node)
+		return
+	}
+
+	for _, child := range node.Children {
+		collectConstants(child, constants)
+	}
+}
+
+// isConstant reports whether node is a literal, or a negated one.
+func isConstant(node *AstNode) bool {
+	if node.Type == "Literal" {
+		return true
+	}
+
+	if node.Type != "Function" || node.Value != "negate" {
+		return false
+	}
+
+	arguments := childrenOf(node.firstChildOfType("ExpressionList"))
+
+	return len(arguments) == 1 && arguments[0].Alias == "" && isConstant(arguments[0])
+}
+
+// isConstantInList reports whether node is a tuple or array of constants on the
+// right of an IN operator.
+func isConstantInList(node *AstNode) bool {
+	if node.Type != "Function" || node.Value != "tuple" && node.Value != "array" || node.Parent == nil {
+		return false
+	}
+
+	operator := node.Parent.Parent
+	if operator == nil || operator.Type != "Function" || !inFunctions[operator.Value] || siblingIndex(node) != 1 {
+		return false
+	}
+
+	for _, element := range childrenOf(node.firstChildOfType("ExpressionList")) {
+		if element.Alias != "" || !isConstant(element) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// placeholderSettings replaces the values in a SETTINGS hint, such as
+// "max_threads = 2, log_comment = 'x'", with placeholders.
+func placeholderSettings(settings string) string {
+	changes := settingChanges(settings)
+	for i := range changes {
+		changes[i].value = Placeholder
+	}
+
+	return settingsHint(changes)
+}
@@ -0,0 +1,185 @@
+package ast
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fingerprintLines(inList []string, comment string, bound []string, limit string) []string {
+	lines := []string{
+		"SelectWithUnionQuery (children 1)",
+		" ExpressionList (children 1)",
+		"  SelectQuery (children 6)",
+		"   ExpressionList (children 2)",
+		"    Identifier a",
+		"    Function count (children 1)",
+		"     ExpressionList",
+		"   TablesInSelectQuery (children 1)",
+		"    TablesInSelectQueryElement (children 1)",
+		"     TableExpression (children 1)",
+		"      TableIdentifier t",
+		"   Function and (children 1)",
+		"    ExpressionList (children 3)",
+		"     Function in (children 1)",
+		"      ExpressionList (children 2)",
+		"       Identifier b",
+	}
+	lines = append(lines, inList...)
+	lines = append(lines,
+		"     Function equals (children 1)",
+		"      ExpressionList (children 2)",
+		"       Identifier c",
+		"       Literal "+comment,
+		"     Function greater (children 1)",
+		"      ExpressionList (children 2)",
+		"       Identifier d",
+	)
+	lines = append(lines, bound...)
+
+	return append(lines,
+		"   ExpressionList (children 1)",
+		"    Identifier a",
+		"   Literal "+limit,
+		"   Set",
+	)
+}
+
+func TestFingerprint(t *testing.T) {
+	first, err := NewFromExplainLines(
+		"select a, count() from t where b in (1, 2, 3) and c = 'x' and d > -5 group by a limit 10 settings max_threads = 2",
+		fingerprintLines([]string{"       Literal Tuple_(UInt64_1, UInt64_2, UInt64_3)"}, "'x'", []string{"       Literal Int64_-5"}, "UInt64_10"),
+	)
+	assert.NoError(t, err)
+
+	second, err := NewFromExplainLines(
+		"select a, count() from t where b in (4, 2 + 2) and c = 'yy' and d > -(7) group by a limit 20 settings max_threads = 8",
+		fingerprintLines([]string{
+			"       Function tuple (children 1)",
+			"        ExpressionList (children 2)",
+			"         Literal UInt64_4",
+			"         Function negate (children 1)",
+			"          ExpressionList (children 1)",
+			"           Literal UInt64_4",
+		}, "'yy'", []string{
+			"       Function negate (children 1)",
+			"        ExpressionList (children 1)",
+			"         Literal UInt64_7",
+		}, "UInt64_20"),
+	)
+	assert.NoError(t, err)
+
+	expected := `SELECT
+    a,
+    count()
+FROM t
+WHERE b IN (?) AND c = ? AND d > ?
+GROUP BY a
+LIMIT ?
+SETTINGS max_threads = ?`
+
+	firstFingerprint, err := first.Fingerprint()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, firstFingerprint.Query)
+
+	secondFingerprint, err := second.Fingerprint()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, secondFingerprint.Query)
+	assert.Equal(t, firstFingerprint.Hash, secondFingerprint.Hash)
+	assert.Equal(t, firstFingerprint.Root.Hash, secondFingerprint.Root.Hash)
+
+	// The ast itself is left alone.
+	assert.Contains(t, first.Root.Serialize(), "Literal UInt64_10")
+	settings, err := first.Select("Set")
+	assert.NoError(t, err)
+	assert.Equal(t, "max_threads = 2", settings[0].Hints[hintSettings])
+
+	// IN lists with other expressions in them keep their shape.
+	third, err := NewFromExplainLines(
+		"select a, count() from t where b in (1, a) and c = 'x' and d > 1 group by a limit 10 settings max_threads = 2",
+		fingerprintLines([]string{
+			"       Function tuple (children 1)",
+			"        ExpressionList (children 2)",
+			"         Literal UInt64_1",
+			"         Identifier a",
+		}, "'x'", []string{"       Literal UInt64_1"}, "UInt64_10"),
+	)
+	assert.NoError(t, err)
+
+	thirdFingerprint, err := third.Fingerprint()
+	assert.NoError(t, err)
+	assert.Contains(t, thirdFingerprint.Query, "WHERE b IN tuple(?, a) AND")
+	assert.NotEqual(t, firstFingerprint.Hash, thirdFingerprint.Hash)
+
+	_, err = (&Ast{}).Fingerprint()
+	assert.Error(t, err)
+}
+
+func TestFingerprintUnformattable(t *testing.T) {
+	freeze := func(partition string) *Ast {
+		a, err := NewFromExplainLines("alter table t freeze partition "+partition, []string{
+			"AlterQuery  t (children 2)",
+			" ExpressionList (children 1)",
+			"  AlterCommand FREEZE_PARTITION (children 1)",
+			"   Partition (children 1)",
+			"    Literal UInt64_" + partition,
+			" Identifier t",
+		})
+		assert.NoError(t, err)
+		return a
+	}
+
+	_, err := Format(freeze("2020").Root)
+	assert.Error(t, err)
+
+	// Queries Format can't handle are fingerprinted by their serialized tree.
+	first, err := freeze("2020").Fingerprint()
+	assert.NoError(t, err)
+	assert.Contains(t, first.Query, "Literal ?")
+
+	second, err := freeze("2021").Fingerprint()
+	assert.NoError(t, err)
+	assert.Equal(t, first.Hash, second.Hash)
+}
+
+func TestFingerprintHintConstants(t *testing.T) {
+	fill := func(from string, step string) Fingerprint {
+		a, err := NewFromExplainLines("select d order by d with fill from "+from+" step "+step, []string{
+			"SelectWithUnionQuery (children 1)",
+			" ExpressionList (children 1)",
+			"  SelectQuery (children 2)",
+			"   ExpressionList (children 1)",
+			"    Identifier d",
+			"   ExpressionList (children 1)",
+			"    OrderByElement (children 3)",
+			"     Identifier d",
+			"     Literal UInt64_" + from,
+			"     Literal UInt64_" + step,
+		})
+		assert.NoError(t, err)
+
+		fingerprint, err := a.Fingerprint()
+		assert.NoError(t, err)
+		return fingerprint
+	}
+
+	first, second := fill("1", "2"), fill("5", "10")
+	assert.Contains(t, first.Query, "ORDER BY d WITH FILL FROM ? STEP ?")
+	assert.Equal(t, first.Hash, second.Hash)
+
+	table := func(query string) Fingerprint {
+		a, err := NewFromExplainLines(query, createTableWithKeysLines())
+		assert.NoError(t, err)
+
+		fingerprint, err := a.Fingerprint()
+		assert.NoError(t, err)
+		return fingerprint
+	}
+
+	cold := table(createTableWithKeysQuery())
+	hot := table(strings.NewReplacer("granularity 4", "granularity 8", "'cold'", "'hot'").Replace(createTableWithKeysQuery()))
+	assert.Contains(t, cold.Query, "GRANULARITY ?")
+	assert.Contains(t, cold.Query, "TO DISK ?")
+	assert.Equal(t, cold.Hash, hot.Hash)
+}
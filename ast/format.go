@@ -0,0 +1,858 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Format renders a SelectWithUnionQuery, CreateQuery, CreateFunctionQuery or AlterQuery
+// tree back into ClickHouse SQL with uppercase keywords and one selected expression,
+// column or alter command per line. FormatWithOptions changes the layout.
+//
+// explain ast leaves out join kinds, ORDER BY directions, DISTINCT, UNION modes,
+// SETTINGS values and more. Those are taken from the node Hints recorded from the source
+// query at parse time, so it's an error to format a tree parsed without one, or one
+// whose hints couldn't all be matched to it.
+func Format(root *AstNode) (string, error) {
+	return FormatWithOptions(root, DefaultFormatOptions())
+}
+
+// FormatWithOptions is Format with the keyword case, indentation, list layout, line
+// width and identifier quoting set by options.
+func FormatWithOptions(root *AstNode, options FormatOptions) (string, error) {
+	if err := options.Validate(); err != nil {
+		return "", err
+	}
+
+	if hints := root.sourceHints(); hints != nil && len(hints.mismatches) > 0 {
+		return "", hints.mismatches[0]
+	}
+
+	return newFormatter(options).statement(root)
+}
+
+type formatter struct {
+	options FormatOptions
+	indent  string
+	// level is how many indentation levels deep the text being rendered will be.
+	level int
+}
+
+// Operator precedences, from loosest to tightest binding.
+const (
+	precedenceLambda = iota
+	precedenceOr
+	precedenceAnd
+	precedenceNot
+	precedenceComparison
+	precedenceAdditive
+	precedenceMultiplicative
+	precedenceUnary
+	precedencePostfix
+	precedenceAtom
+)
+
+type binaryOperator struct {
+	symbol     string
+	precedence int
+}
+
+var binaryOperators = map[string]binaryOperator{
+	"plus":            {"+", precedenceAdditive},
+	"minus":           {"-", precedenceAdditive},
+	"multiply":        {"*", precedenceMultiplicative},
+	"divide":          {"/", precedenceMultiplicative},
+	"modulo":          {"%", precedenceMultiplicative},
+	"equals":          {"=", precedenceComparison},
+	"notEquals":       {"!=", precedenceComparison},
+	"less":            {"<", precedenceComparison},
+	"greater":         {">", precedenceComparison},
+	"lessOrEquals":    {"<=", precedenceComparison},
+	"greaterOrEquals": {">=", precedenceComparison},
+	"like":            {"LIKE", precedenceComparison},
+	"notLike":         {"NOT LIKE", precedenceComparison},
+	"ilike":           {"ILIKE", precedenceComparison},
+	"notILike":        {"NOT ILIKE", precedenceComparison},
+	"in":              {"IN", precedenceComparison},
+	"notIn":           {"NOT IN", precedenceComparison},
+	"globalIn":        {"GLOBAL IN", precedenceComparison},
+	"globalNotIn":     {"GLOBAL NOT IN", precedenceComparison},
+	"and":             {"AND", precedenceAnd},
+	"or":              {"OR", precedenceOr},
+}
+
+// Keywords that can't be used as bare identifiers in expressions.
+var reservedKeywords = map[string]bool{
+	"ALL": true, "AND": true, "ARRAY": true, "AS": true, "ASC": true, "BETWEEN": true, "BY": true,
+	"CASE": true, "DESC": true, "DISTINCT": true, "ELSE": true, "END": true, "EXCEPT": true,
+	"FALSE": true, "FINAL": true, "FORMAT": true, "FROM": true, "GLOBAL": true, "GROUP": true,
+	"HAVING": true, "ILIKE": true, "IN": true, "INTERSECT": true, "INTERVAL": true, "IS": true,
+	"JOIN": true, "LIKE": true, "LIMIT": true, "NOT": true, "NULL": true, "OFFSET": true, "ON": true,
+	"OR": true, "ORDER": true, "PREWHERE": true, "SAMPLE": true, "SELECT": true, "SETTINGS": true,
+	"THEN": true, "TRUE": true, "UNION": true, "USING": true, "WHEN": true, "WHERE": true,
+	"WINDOW": true, "WITH": true,
+}
+
+func (f *formatter) indentText(text string) string {
+	lines := strings.Split(text, "\n")
+
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = f.indent + line
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (f *formatter) query(node *AstNode) (string, error) {
+	switch node.Type {
+	case "SelectWithUnionQuery":
+		list := node.firstChildOfType("ExpressionList")
+		if list == nil || len(list.Children) == 0 {
+			return "", fmt.Errorf("SelectWithUnionQuery on line %d has no queries", node.LineNumber)
+		}
+
+		return f.setOperation(list.Children, "UNION ALL")
+	case "SelectIntersectExceptQuery":
+		return f.setOperation(node.explainChildren(), "EXCEPT")
+	case "SelectQuery":
+		return f.selectQuery(node)
+	}
+
+	return "", fmt.Errorf("cannot format %s node on line %d as a query", node.Type, node.LineNumber)
+}
+
+// firstSelectQuery returns the SelectQuery a query node starts with.
+func firstSelectQuery(node *AstNode) *AstNode {
+	for node != nil && node.Type != "SelectQuery" {
+		if len(node.Children) == 0 {
+			return nil
+		}
+		node = node.Children[0]
+	}
+
+	return node
+}
+
+func (f *formatter) setOperation(queries []*AstNode, defaultOperator string) (string, error) {
+	var sb strings.Builder
+
+	for i, query := range queries {
+		text, err := f.query(query)
+		if err != nil {
+			return "", err
+		}
+
+		if query.Type != "SelectQuery" && len(queries) > 1 {
+			text = "(\n" + f.indentText(text) + "\n)"
+		}
+
+		if i > 0 {
+			operator := defaultOperator
+			if previous := firstSelectQuery(queries[i-1]); previous != nil && previous.Hints[hintSetOperator] != "" {
+				operator = previous.Hints[hintSetOperator]
+			}
+
+			sb.WriteString("\n" + f.kw(operator) + "\n")
+		}
+
+		sb.WriteString(text)
+	}
+
+	return sb.String(), nil
+}
+
+// requireNodeHints returns an error unless node's hints were recovered from the source
+// query, for nodes whose output depends on what explain ast leaves out.
+func requireNodeHints(node *AstNode) error {
+	if node.Hints != nil {
+		return nil
+	}
+
+	return fmt.Errorf("cannot format %s node on line %d: explain ast leaves out parts of it, parse the tree with its source query", node.Type, node.LineNumber)
+}
+
+func (f *formatter) selectQuery(node *AstNode) (string, error) {
+	if err := requireNodeHints(node); err != nil {
+		return "", err
+	}
+
+	q, _ := AsSelectQuery(node)
+	var clauses []string
+
+	addList := func(keyword string, nodes []*AstNode) error {
+		items := make([]string, len(nodes))
+		for i, item := range nodes {
+			text, err := f.nestedExpression(item)
+			if err != nil {
+				return err
+			}
+			items[i] = text
+		}
+
+		if f.options.PackColumns {
+			packed := keyword + " " + strings.Join(items, ", ")
+			if !strings.Contains(packed, "\n") && f.fits(packed) {
+				clauses = append(clauses, packed)
+				return nil
+			}
+		}
+
+		clauses = append(clauses, keyword+"\n"+f.verticalList(items))
+		return nil
+	}
+
+	addInline := func(keyword string, nodes []*AstNode, suffix string) error {
+		if len(nodes) == 0 {
+			return nil
+		}
+
+		text, err := f.expressionList(nodes)
+		if err != nil {
+			return err
+		}
+
+		clauses = append(clauses, keyword+" "+text+suffix)
+		return nil
+	}
+
+	addExpression := func(keyword string, expression *AstNode) error {
+		if expression == nil {
+			return nil
+		}
+
+		text, err := f.expression(expression)
+		if err != nil {
+			return err
+		}
+
+		clauses = append(clauses, keyword+" "+text)
+		return nil
+	}
+
+	if with := q.With(); len(with) > 0 {
+		if err := addList(f.kw("WITH"), with); err != nil {
+			return "", err
+		}
+	}
+
+	keyword := "SELECT"
+	if node.Hints[hintDistinct] != "" {
+		keyword += " " + node.Hints[hintDistinct]
+	}
+	keyword = f.kw(keyword)
+
+	if err := addList(keyword, q.Columns()); err != nil {
+		return "", err
+	}
+
+	if len(q.Tables()) > 0 {
+		tables, err := f.tables(q)
+		if err != nil {
+			return "", err
+		}
+		clauses = append(clauses, tables)
+	}
+
+	if err := addExpression(f.kw("PREWHERE"), q.Prewhere()); err != nil {
+		return "", err
+	}
+
+	if err := addExpression(f.kw("WHERE"), q.Where()); err != nil {
+		return "", err
+	}
+
+	groupByModifier := ""
+	if modifier := node.Hints[hintGroupByModifier]; modifier != "" {
+		groupByModifier = " " + f.kw(modifier)
+	}
+
+	if err := addInline(f.kw("GROUP BY"), q.GroupBy(), groupByModifier); err != nil {
+		return "", err
+	}
+
+	if err := addExpression(f.kw("HAVING"), q.Having()); err != nil {
+		return "", err
+	}
+
+	if len(q.Window()) > 0 {
+		return "", fmt.Errorf("cannot format WINDOW clause on line %d: window names aren't included in explain ast output", node.LineNumber)
+	}
+
+	if err := addInline(f.kw("ORDER BY"), q.OrderBy(), ""); err != nil {
+		return "", err
+	}
+
+	limitByOffset, limitByLength, limitBy := q.LimitBy()
+	if len(limitBy) > 0 {
+		limit, err := f.limit(limitByOffset, limitByLength)
+		if err != nil {
+			return "", err
+		}
+
+		if err := addInline(f.kw("LIMIT")+" "+limit+" "+f.kw("BY"), limitBy, ""); err != nil {
+			return "", err
+		}
+	}
+
+	if offset, length := q.Limit(); length != nil {
+		limit, err := f.limit(offset, length)
+		if err != nil {
+			return "", err
+		}
+
+		if modifier := node.Hints[hintLimitModifier]; modifier != "" {
+			limit += " " + f.kw(modifier)
+		}
+
+		clauses = append(clauses, f.kw("LIMIT")+" "+limit)
+	}
+
+	if settings := q.Settings(); settings != nil {
+		text, err := f.settings(settings)
+		if err != nil {
+			return "", err
+		}
+		clauses = append(clauses, f.kw("SETTINGS")+" "+text)
+	}
+
+	return strings.Join(clauses, "\n"), nil
+}
+
+func (f *formatter) limit(offset *AstNode, length *AstNode) (string, error) {
+	nodes := []*AstNode{length}
+	if offset != nil {
+		nodes = []*AstNode{offset, length}
+	}
+
+	return f.expressionList(nodes)
+}
+
+func (f *formatter) settings(node *AstNode) (string, error) {
+	settings := node.Hints[hintSettings]
+	if settings == "" {
+		return "", fmt.Errorf("cannot format Set node on line %d: SETTINGS values aren't included in explain ast output, parse the tree with its source query", node.LineNumber)
+	}
+
+	return settings, nil
+}
+
+func (f *formatter) tables(q SelectQuery) (string, error) {
+	var sb strings.Builder
+
+	for i, element := range q.Tables() {
+		if arrayJoin := element.firstChildOfType("ArrayJoin"); arrayJoin != nil {
+			if err := requireNodeHints(arrayJoin); err != nil {
+				return "", err
+			}
+			kind := arrayJoin.Hints[hintJoin]
+
+			list := arrayJoin.firstChildOfType("ExpressionList")
+			if list == nil {
+				return "", fmt.Errorf("ArrayJoin on line %d has no expressions", arrayJoin.LineNumber)
+			}
+
+			expressions, err := f.expressionList(list.Children)
+			if err != nil {
+				return "", err
+			}
+
+			sb.WriteString("\n" + f.kw(kind) + " " + expressions)
+			continue
+		}
+
+		table, err := f.tableExpression(element.firstChildOfType("TableExpression"))
+		if err != nil {
+			return "", err
+		}
+
+		if i == 0 {
+			sb.WriteString(f.kw("FROM") + " " + table)
+			continue
+		}
+
+		join := Join{TableJoin: element.firstChildOfType("TableJoin")}
+		if join.TableJoin == nil {
+			return "", fmt.Errorf("TablesInSelectQueryElement on line %d has no join", element.LineNumber)
+		}
+
+		if err := requireNodeHints(join.TableJoin); err != nil {
+			return "", err
+		}
+
+		kind := join.TableJoin.Hints[hintJoin]
+		if kind == "," {
+			sb.WriteString(", " + table)
+			continue
+		}
+
+		sb.WriteString("\n" + f.kw(kind) + " " + table)
+
+		if using := join.Using(); len(using) > 0 {
+			columns, err := f.expressionList(using)
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(" " + f.kw("USING") + " (" + columns + ")")
+		} else if on := join.On(); on != nil {
+			condition, err := f.expression(on)
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(" " + f.kw("ON") + " " + condition)
+		}
+	}
+
+	return sb.String(), nil
+}
+
+func (f *formatter) tableExpression(node *AstNode) (string, error) {
+	t, ok := AsTableExpression(node)
+	if !ok || t.Source() == nil {
+		return "", fmt.Errorf("expected a TableExpression")
+	}
+
+	if len(node.explainChildren()) > 1 {
+		return "", fmt.Errorf("cannot format TableExpression on line %d: SAMPLE clauses aren't supported", node.LineNumber)
+	}
+
+	source := t.Source()
+	text, _, err := f.bareExpression(source)
+	if err != nil {
+		return "", err
+	}
+
+	if source.Alias != "" {
+		text += " " + f.kw("AS") + " " + f.identifierName(source.Alias)
+	}
+
+	if final := source.Hints[hintFinal]; final != "" {
+		text += " " + f.kw(final)
+	}
+
+	return text, nil
+}
+
+func (f *formatter) expressionList(nodes []*AstNode) (string, error) {
+	items := make([]string, len(nodes))
+
+	for i, node := range nodes {
+		text, err := f.aliasedExpression(node)
+		if err != nil {
+			return "", err
+		}
+		items[i] = text
+	}
+
+	return strings.Join(items, ", "), nil
+}
+
+// aliasedExpression renders an expression that's an item of a list, where an alias
+// can follow it without parentheses.
+func (f *formatter) aliasedExpression(node *AstNode) (string, error) {
+	text, _, err := f.bareExpression(node)
+	if err != nil {
+		return "", err
+	}
+
+	if node.Alias != "" {
+		text += " " + f.kw("AS") + " " + f.identifierName(node.Alias)
+	}
+
+	return text, nil
+}
+
+// nestedExpression renders a list item that goes on its own line, one level deeper.
+func (f *formatter) nestedExpression(node *AstNode) (string, error) {
+	f.level++
+	defer func() { f.level-- }()
+
+	return f.aliasedExpression(node)
+}
+
+// expression renders an expression, parenthesising it if it has an alias.
+func (f *formatter) expression(node *AstNode) (string, error) {
+	text, _, err := f.operand(node)
+	return text, err
+}
+
+// operand renders an expression along with its precedence.
+func (f *formatter) operand(node *AstNode) (string, int, error) {
+	if node.Alias != "" {
+		text, err := f.aliasedExpression(node)
+		return "(" + text + ")", precedenceAtom, err
+	}
+
+	return f.bareExpression(node)
+}
+
+// operandAbove renders node, parenthesising it unless it binds tighter than precedence.
+func (f *formatter) operandAbove(node *AstNode, precedence int) (string, error) {
+	text, operandPrecedence, err := f.operand(node)
+	if err != nil {
+		return "", err
+	}
+
+	if operandPrecedence <= precedence {
+		return "(" + text + ")", nil
+	}
+
+	return text, nil
+}
+
+func (f *formatter) bareExpression(node *AstNode) (string, int, error) {
+	switch node.Type {
+	case "Identifier", "TableIdentifier":
+		return f.identifier(node), precedenceAtom, nil
+	case "Literal":
+		if node.Value == Placeholder {
+			return Placeholder, precedenceAtom, nil
+		}
+
+		text, err := f.literal(node.Value)
+		if err != nil {
+			return "", 0, fmt.Errorf("cannot format Literal on line %d: %w", node.LineNumber, err)
+		}
+
+		if strings.HasPrefix(text, "-") {
+			return text, precedenceUnary, nil
+		}
+
+		return text, precedenceAtom, nil
+	case "Asterisk":
+		return "*", precedenceAtom, nil
+	case "QualifiedAsterisk":
+		if len(node.Children) == 0 {
+			return "", 0, fmt.Errorf("QualifiedAsterisk on line %d has no qualifier", node.LineNumber)
+		}
+
+		return f.identifier(node.Children[0]) + ".*", precedenceAtom, nil
+	case "QueryParameter":
+		return "{" + node.Value + "}", precedenceAtom, nil
+	case "Subquery":
+		if len(node.Children) == 0 {
+			return "", 0, fmt.Errorf("Subquery on line %d is empty", node.LineNumber)
+		}
+
+		f.level++
+		text, err := f.query(node.Children[0])
+		f.level--
+		if err != nil {
+			return "", 0, err
+		}
+
+		return "(\n" + f.indentText(text) + "\n)", precedenceAtom, nil
+	case "OrderByElement":
+		text, err := f.orderByElement(node)
+		return text, precedenceLambda, err
+	case "Function":
+		return f.function(node)
+	case "DataType":
+		text, err := f.dataType(node)
+		return text, precedenceAtom, err
+	}
+
+	return "", 0, fmt.Errorf("cannot format %s node on line %d", node.Type, node.LineNumber)
+}
+
+func (f *formatter) orderByElement(node *AstNode) (string, error) {
+	children := node.explainChildren()
+	if len(children) == 0 {
+		return "", fmt.Errorf("OrderByElement on line %d is empty", node.LineNumber)
+	}
+
+	if err := requireNodeHints(node); err != nil {
+		return "", err
+	}
+
+	text, err := f.aliasedExpression(children[0])
+	if err != nil {
+		return "", err
+	}
+
+	modifiers, err := f.kwOperands(node, node.Hints[hintOrderByModifiers], orderByOperands, children[1:], nil)
+	if err != nil {
+		return "", err
+	}
+
+	if modifiers != "" {
+		text += " " + modifiers
+	}
+
+	return text, nil
+}
+
+func (f *formatter) identifierName(name string) string {
+	if f.options.IdentifierQuoting == QuoteAlways || reservedKeywords[strings.ToUpper(name)] {
+		return quoteWith(name, '`')
+	}
+
+	return QuoteIdentifier(name)
+}
+
+func (f *formatter) identifier(node *AstNode) string {
+	if len(node.Path.Parts) == 0 || !node.pathMatchesValue() {
+		if node.ValueQualifier != "" {
+			return f.identifierName(node.ValueQualifier) + "." + f.identifierName(node.Value)
+		}
+
+		return f.identifierName(node.Value)
+	}
+
+	parts := make([]string, len(node.Path.Parts))
+
+	for i, part := range node.Path.Parts {
+		switch {
+		case part.Quote != 0 && f.options.IdentifierQuoting == QuoteAsWritten:
+			parts[i] = quoteWith(part.Name, part.Quote)
+		case i > 0 && numericPartRegex.MatchString(part.Name):
+			parts[i] = part.Name
+		default:
+			parts[i] = f.identifierName(part.Name)
+		}
+	}
+
+	return strings.Join(parts, ".")
+}
+
+func (f *formatter) function(node *AstNode) (string, int, error) {
+	var arguments, parameters []*AstNode
+	var window *AstNode
+	lists := 0
+
+	for _, child := range node.explainChildren() {
+		switch {
+		case child.Type == "ExpressionList" && lists == 0:
+			arguments = child.Children
+			lists++
+		case child.Type == "ExpressionList":
+			parameters = child.Children
+			lists++
+		case child.Type == "WindowDefinition":
+			window = child
+		default:
+			return "", 0, fmt.Errorf("cannot format %s child of Function on line %d", child.Type, node.LineNumber)
+		}
+	}
+
+	if window == nil && len(parameters) == 0 {
+		if text, precedence, ok, err := f.operator(node, arguments); ok || err != nil {
+			return text, precedence, err
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(node.Value)
+
+	if lists > 1 {
+		text, err := f.expressionList(parameters)
+		if err != nil {
+			return "", 0, err
+		}
+		sb.WriteString("(" + text + ")")
+	}
+
+	if lists > 0 {
+		text, err := f.expressionList(arguments)
+		if err != nil {
+			return "", 0, err
+		}
+
+		if len(arguments) > 1 && !f.fits(sb.String()+"("+text+")") {
+			if text, err = f.wrappedArguments(arguments); err != nil {
+				return "", 0, err
+			}
+		}
+		sb.WriteString("(" + text + ")")
+	}
+
+	if window != nil {
+		text, err := f.windowDefinition(window)
+		if err != nil {
+			return "", 0, err
+		}
+		sb.WriteString(" " + f.kw("OVER") + " (" + text + ")")
+	}
+
+	return sb.String(), precedenceAtom, nil
+}
+
+// wrappedArguments renders function arguments one per line for a call that's too wide.
+func (f *formatter) wrappedArguments(arguments []*AstNode) (string, error) {
+	items := make([]string, len(arguments))
+
+	for i, argument := range arguments {
+		text, err := f.nestedExpression(argument)
+		if err != nil {
+			return "", err
+		}
+		items[i] = text
+	}
+
+	return "\n" + f.verticalList(items) + "\n", nil
+}
+
+// operator renders functions that have operator syntax. ok is false for anything else.
+func (f *formatter) operator(node *AstNode, arguments []*AstNode) (text string, precedence int, ok bool, err error) {
+	name := node.Value
+
+	if operator, isBinary := binaryOperators[name]; isBinary && len(arguments) >= 2 {
+		if len(arguments) > 2 && name != "and" && name != "or" {
+			return "", 0, false, nil
+		}
+
+		operands := make([]string, len(arguments))
+		for i, argument := range arguments {
+			// Operators are left associative, except that and/or flatten chains so an
+			// explicitly nested and/or has to stay parenthesised.
+			threshold := operator.precedence
+			if i == 0 && operator.precedence >= precedenceAdditive {
+				threshold--
+			}
+
+			operands[i], err = f.operandAbove(argument, threshold)
+			if err != nil {
+				return "", 0, true, err
+			}
+
+			// A fingerprint's collapsed IN list.
+			if i == 1 && inFunctions[name] && argument.Type == "Literal" && argument.Value == Placeholder {
+				operands[i] = "(" + Placeholder + ")"
+			}
+		}
+
+		return strings.Join(operands, " "+f.kw(operator.symbol)+" "), operator.precedence, true, nil
+	}
+
+	if len(arguments) == 1 {
+		switch name {
+		case "not":
+			operand, err := f.operandAbove(arguments[0], precedenceNot-1)
+			return f.kw("NOT") + " " + operand, precedenceNot, true, err
+		case "negate":
+			operand, err := f.operandAbove(arguments[0], precedenceUnary)
+			if arguments[0].Type == "Literal" && !strings.HasPrefix(operand, "(") {
+				operand = "(" + operand + ")"
+			}
+			return "-" + operand, precedenceUnary, true, err
+		case "isNull", "isNotNull":
+			operand, err := f.operandAbove(arguments[0], precedenceComparison)
+			if name == "isNull" {
+				return operand + " " + f.kw("IS NULL"), precedenceComparison, true, err
+			}
+			return operand + " " + f.kw("IS NOT NULL"), precedenceComparison, true, err
+		}
+	}
+
+	if name == "arrayElement" && len(arguments) == 2 {
+		array, err := f.operandAbove(arguments[0], precedencePostfix-1)
+		if err != nil {
+			return "", 0, true, err
+		}
+
+		index, err := f.expression(arguments[1])
+		return array + "[" + index + "]", precedencePostfix, true, err
+	}
+
+	if name == "lambda" && len(arguments) == 2 {
+		parameters := arguments[0]
+		if parameters.Type != "Function" || parameters.Value != "tuple" {
+			return "", 0, true, fmt.Errorf("lambda on line %d has no parameter tuple", node.LineNumber)
+		}
+
+		list := parameters.firstChildOfType("ExpressionList")
+		names, err := f.expressionList(childrenOf(list))
+		if err != nil {
+			return "", 0, true, err
+		}
+
+		if len(childrenOf(list)) != 1 {
+			names = "(" + names + ")"
+		}
+
+		body, err := f.operandAbove(arguments[1], precedenceLambda)
+		return names + " -> " + body, precedenceLambda, true, err
+	}
+
+	return "", 0, false, nil
+}
+
+func (f *formatter) windowDefinition(node *AstNode) (string, error) {
+	var parts []string
+
+	for _, child := range node.explainChildren() {
+		text, err := f.expressionList(child.Children)
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case child.isListOf("OrderByElement"):
+			parts = append(parts, f.kw("ORDER BY")+" "+text)
+		case child.Type == "ExpressionList" && len(parts) == 0:
+			parts = append(parts, f.kw("PARTITION BY")+" "+text)
+		default:
+			return "", fmt.Errorf("cannot format WindowDefinition on line %d: window frames aren't supported", node.LineNumber)
+		}
+	}
+
+	return strings.Join(parts, " "), nil
+}
+
+// literal renders a Literal node value, e.g. Array_[UInt64_1, 'a'], as SQL.
+func (f *formatter) literal(value string) (string, error) {
+	lit, err := parseLiteral(value)
+	if err != nil {
+		return "", err
+	}
+
+	return lit.sql(f.kw("NULL")), nil
+}
+
+// sql renders the literal, writing nulls as null.
+func (l literal) sql(null string) string {
+	joinElements := func() string {
+		elements := make([]string, len(l.elements))
+		for i, element := range l.elements {
+			elements[i] = element.sql(null)
+		}
+		return strings.Join(elements, ", ")
+	}
+
+	switch l.kind {
+	case literalString:
+		return quoteWith(l.value, '\'')
+	case literalNull:
+		return null
+	case literalArray:
+		return "[" + joinElements() + "]"
+	case literalTuple:
+		return "(" + joinElements() + ")"
+	case literalMap:
+		var entries []string
+		for _, element := range l.elements {
+			for _, part := range element.elements {
+				entries = append(entries, part.sql(null))
+			}
+		}
+		return "map(" + strings.Join(entries, ", ") + ")"
+	}
+
+	switch {
+	case strings.HasPrefix(l.typeName, "UInt") || strings.HasPrefix(l.typeName, "Int") || strings.HasPrefix(l.typeName, "Decimal"):
+		return l.value
+	case strings.HasPrefix(l.typeName, "Float"):
+		if strings.ContainsAny(l.value, ".eEni") {
+			return l.value
+		}
+		return l.value + ".0"
+	case l.typeName == "Bool":
+		if l.value == "1" || l.value == "true" {
+			return "true"
+		}
+		return "false"
+	}
+
+	return quoteWith(l.value, '\'')
+}
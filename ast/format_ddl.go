@@ -0,0 +1,654 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DDL rendering for Format. As with SELECT, explain ast leaves out a lot of DDL:
+// what kind of object is being created, column default kinds, index names and
+// granularity, and TTL actions all come from node Hints when they're available.
+
+func (f *formatter) statement(node *AstNode) (string, error) {
+	switch node.Type {
+	case "CreateQuery":
+		return f.createQuery(node)
+	case "CreateFunctionQuery":
+		return f.createFunction(node)
+	case "AlterQuery":
+		return f.alterQuery(node)
+	}
+
+	return f.query(node)
+}
+
+func (f *formatter) qualifiedName(database string, name string) string {
+	switch {
+	case database == "":
+		return f.identifierName(name)
+	case name == "":
+		return f.identifierName(database)
+	}
+
+	return f.identifierName(database) + "." + f.identifierName(name)
+}
+
+func (f *formatter) createQuery(node *AstNode) (string, error) {
+	c, _ := AsCreateQuery(node)
+
+	keywords := node.Hints[hintCreate]
+	if keywords == "" {
+		return "", fmt.Errorf("cannot format CreateQuery on line %d: explain ast doesn't say what it creates, parse the tree with its source query", node.LineNumber)
+	}
+
+	header := f.kw(keywords) + " " + f.qualifiedName(c.Database(), c.Name())
+	if to := c.To(); to != "" {
+		header += " " + f.kw("TO") + " " + f.identifierName(to)
+	}
+
+	lines := []string{header}
+
+	if definition := node.firstChildOfType("Columns"); definition != nil {
+		columns, err := f.columnsDefinition(definition)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, "(\n"+columns+"\n)")
+	}
+
+	if storage := c.Storage(); storage != nil {
+		text, err := f.storage(storage)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, text)
+	}
+
+	if populate := node.Hints[hintPopulate]; populate != "" {
+		lines = append(lines, f.kw(populate))
+	}
+
+	if query := c.Select(); query != nil {
+		text, err := f.query(query)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, f.kw("AS")+" "+text)
+	}
+
+	if comment := node.firstChildOfType("Literal"); comment != nil {
+		text, err := f.expression(comment)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, f.kw("COMMENT")+" "+text)
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// columnsDefinition renders the columns, indices and constraints of a Columns node as
+// an indented list.
+func (f *formatter) columnsDefinition(node *AstNode) (string, error) {
+	var items []string
+
+	f.level++
+	defer func() { f.level-- }()
+
+	for _, list := range node.explainChildren() {
+		for _, element := range list.Children {
+			var text string
+			var err error
+
+			switch element.Type {
+			case "ColumnDeclaration":
+				text, err = f.columnDeclaration(element)
+			case "Index":
+				text, err = f.index(element)
+				text = f.kw("INDEX") + " " + text
+			case "Constraint":
+				text, err = f.constraint(element)
+				text = f.kw("CONSTRAINT") + " " + text
+			default:
+				err = fmt.Errorf("cannot format %s node on line %d in a column list", element.Type, element.LineNumber)
+			}
+
+			if err != nil {
+				return "", err
+			}
+			items = append(items, text)
+		}
+	}
+
+	return f.verticalList(items), nil
+}
+
+func (f *formatter) columnDeclaration(node *AstNode) (string, error) {
+	if err := requireNodeHints(node); err != nil {
+		return "", err
+	}
+
+	clauses := classifyColumnChildren(node)
+	parts := []string{f.identifierName(node.Value)}
+
+	add := func(prefix string, expression *AstNode) error {
+		if expression == nil {
+			return nil
+		}
+
+		text, err := f.expression(expression)
+		if err != nil {
+			return err
+		}
+
+		if prefix != "" {
+			text = prefix + " " + text
+		}
+		parts = append(parts, text)
+		return nil
+	}
+
+	if err := add("", clauses.dataType); err != nil {
+		return "", err
+	}
+
+	if modifier := node.Hints[hintNullModifier]; modifier != "" {
+		parts = append(parts, f.kw(modifier))
+	}
+
+	if err := add(f.kw(node.Hints[hintDefaultKind]), clauses.defaultValue); err != nil {
+		return "", err
+	}
+
+	if err := add(f.kw("COMMENT"), clauses.comment); err != nil {
+		return "", err
+	}
+
+	if err := add("", clauses.codec); err != nil {
+		return "", err
+	}
+
+	if err := add(f.kw("TTL"), clauses.ttl); err != nil {
+		return "", err
+	}
+
+	return strings.Join(parts, " "), nil
+}
+
+func (f *formatter) dataType(node *AstNode) (string, error) {
+	list := node.firstChildOfType("ExpressionList")
+	if list == nil {
+		return node.Value, nil
+	}
+
+	arguments := make([]string, len(list.Children))
+
+	for i, argument := range list.Children {
+		var text string
+		var err error
+
+		switch argument.Type {
+		case "NameTypePair":
+			if len(argument.Children) == 0 {
+				return "", fmt.Errorf("NameTypePair on line %d has no type", argument.LineNumber)
+			}
+			text, err = f.dataType(argument.Children[0])
+			text = f.identifierName(argument.Value) + " " + text
+		case "DataType":
+			text, err = f.dataType(argument)
+		default:
+			text, err = f.expression(argument)
+		}
+
+		if err != nil {
+			return "", err
+		}
+		arguments[i] = text
+	}
+
+	return node.Value + "(" + strings.Join(arguments, ", ") + ")", nil
+}
+
+// index renders an Index node without its leading INDEX keyword.
+func (f *formatter) index(node *AstNode) (string, error) {
+	name := node.Hints[hintName]
+	if name == "" {
+		return "", fmt.Errorf("cannot format Index on line %d: index names aren't included in explain ast output, parse the tree with its source query", node.LineNumber)
+	}
+
+	children := node.explainChildren()
+	if len(children) != 2 {
+		return "", fmt.Errorf("Index on line %d should have an expression and a type", node.LineNumber)
+	}
+
+	expression, err := f.expression(children[0])
+	if err != nil {
+		return "", err
+	}
+
+	indexType, err := f.expression(children[1])
+	if err != nil {
+		return "", err
+	}
+
+	text := f.identifierName(name) + " " + expression + " " + f.kw("TYPE") + " " + indexType
+	if granularity := node.Hints[hintGranularity]; granularity != "" {
+		text += " " + f.kw("GRANULARITY") + " " + granularity
+	}
+
+	return text, nil
+}
+
+// constraint renders a Constraint node without its leading CONSTRAINT keyword.
+func (f *formatter) constraint(node *AstNode) (string, error) {
+	name, kind := node.Hints[hintName], node.Hints[hintConstraintKind]
+	if name == "" || kind == "" || len(node.Children) == 0 {
+		return "", fmt.Errorf("cannot format Constraint on line %d: constraint names and kinds aren't included in explain ast output, parse the tree with its source query", node.LineNumber)
+	}
+
+	expression, err := f.expression(node.Children[0])
+	if err != nil {
+		return "", err
+	}
+
+	return f.identifierName(name) + " " + f.kw(kind) + " " + expression, nil
+}
+
+func (f *formatter) storage(node *AstNode) (string, error) {
+	clauses := classifyStorageChildren(node)
+	if err := clauses.check(node); err != nil {
+		return "", err
+	}
+
+	var lines []string
+
+	if clauses.engine != nil {
+		engine, err := f.expression(clauses.engine)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, f.kw("ENGINE")+" = "+engine)
+	}
+
+	keys := []struct {
+		keyword    string
+		expression *AstNode
+	}{
+		{"PARTITION BY", clauses.partitionBy},
+		{"PRIMARY KEY", clauses.primaryKey},
+		{"ORDER BY", clauses.orderBy},
+		{"SAMPLE BY", clauses.sampleBy},
+	}
+
+	for _, key := range keys {
+		if key.expression == nil {
+			continue
+		}
+
+		text, err := f.storageKey(key.expression)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, f.kw(key.keyword)+" "+text)
+	}
+
+	if clauses.ttl != nil {
+		ttl, err := f.ttl(clauses.ttl)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, f.kw("TTL")+" "+ttl)
+	}
+
+	if clauses.settings != nil {
+		settings, err := f.settings(clauses.settings)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, f.kw("SETTINGS")+" "+settings)
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// storageKey renders a sorting or partitioning key, writing tuple(a, b) as (a, b).
+func (f *formatter) storageKey(node *AstNode) (string, error) {
+	if node.Type == "Function" && node.Value == "tuple" && node.Alias == "" {
+		if list := node.firstChildOfType("ExpressionList"); list != nil && len(list.Children) > 1 {
+			text, err := f.expressionList(list.Children)
+			return "(" + text + ")", err
+		}
+	}
+
+	return f.expression(node)
+}
+
+// ttl renders an ExpressionList of TTLElement nodes.
+func (f *formatter) ttl(list *AstNode) (string, error) {
+	elements := make([]string, len(list.Children))
+
+	for i, element := range list.Children {
+		children := element.explainChildren()
+		if len(children) == 0 {
+			return "", fmt.Errorf("TTLElement on line %d is empty", element.LineNumber)
+		}
+
+		if err := requireNodeHints(element); err != nil {
+			return "", err
+		}
+
+		action := element.Hints[hintTTLAction]
+		if strings.Contains(action, "GROUP BY") {
+			return "", fmt.Errorf("cannot format TTLElement on line %d: GROUP BY actions aren't supported", element.LineNumber)
+		}
+
+		text, err := f.expression(children[0])
+		if err != nil {
+			return "", err
+		}
+
+		destination := element.Hints[hintTTLDestination]
+		rendered, err := f.kwOperands(element, action, ttlOperands, children[1:], map[string]string{"DISK": destination, "VOLUME": destination})
+		if err != nil {
+			return "", err
+		}
+
+		if rendered != "" {
+			text += " " + rendered
+		}
+		elements[i] = text
+	}
+
+	return strings.Join(elements, ", "), nil
+}
+
+func (f *formatter) createFunction(node *AstNode) (string, error) {
+	keywords := node.Hints[hintCreate]
+	if keywords == "" {
+		return "", fmt.Errorf("cannot format CreateFunctionQuery on line %d: explain ast leaves out its CREATE keywords, parse the tree with its source query", node.LineNumber)
+	}
+
+	lambda := node.firstChildOfType("Function")
+	if lambda == nil || node.Value == "" {
+		return "", fmt.Errorf("CreateFunctionQuery on line %d has no name or lambda", node.LineNumber)
+	}
+
+	body, err := f.expression(lambda)
+	if err != nil {
+		return "", err
+	}
+
+	return f.kw(keywords) + " " + f.identifierName(node.Value) + " " + f.kw("AS") + " " + body, nil
+}
+
+func (f *formatter) alterQuery(node *AstNode) (string, error) {
+	a, _ := AsAlterQuery(node)
+	commands := a.Commands()
+
+	if len(commands) == 0 {
+		return "", fmt.Errorf("AlterQuery on line %d has no commands", node.LineNumber)
+	}
+
+	items := make([]string, len(commands))
+	f.level++
+	for i, command := range commands {
+		text, err := f.alterCommand(command.Node)
+		if err != nil {
+			f.level--
+			return "", err
+		}
+		items[i] = text
+	}
+	f.level--
+
+	return f.kw("ALTER TABLE") + " " + f.qualifiedName(a.Database(), a.Table()) + "\n" + f.verticalList(items), nil
+}
+
+// alterCommandParts holds an AlterCommand's children by what they are.
+type alterCommandParts struct {
+	column      *AstNode
+	identifiers []*AstNode
+	index       *AstNode
+	constraint  *AstNode
+	partition   *AstNode
+	literal     *AstNode
+	settings    *AstNode
+	ttl         *AstNode
+	assignments *AstNode
+	names       *AstNode
+	expressions []*AstNode
+}
+
+func classifyAlterCommandChildren(node *AstNode) alterCommandParts {
+	var parts alterCommandParts
+
+	for _, child := range node.explainChildren() {
+		switch {
+		case child.Type == "ColumnDeclaration":
+			parts.column = child
+		case child.Type == "Identifier":
+			parts.identifiers = append(parts.identifiers, child)
+		case child.Type == "Index":
+			parts.index = child
+		case child.Type == "Constraint":
+			parts.constraint = child
+		case child.Type == "Partition":
+			parts.partition = child
+		case child.Type == "Set":
+			parts.settings = child
+		case child.isListOf("TTLElement"):
+			parts.ttl = child
+		case child.isListOf("Assignment"):
+			parts.assignments = child
+		case child.isListOf("Identifier"):
+			parts.names = child
+		case child.Type == "Literal" && parts.literal == nil && len(parts.expressions) == 0:
+			parts.literal = child
+		default:
+			parts.expressions = append(parts.expressions, child)
+		}
+	}
+
+	return parts
+}
+
+func (f *formatter) alterCommand(node *AstNode) (string, error) {
+	if err := requireNodeHints(node); err != nil {
+		return "", err
+	}
+
+	kind := node.Value
+	parts := classifyAlterCommandChildren(node)
+
+	keyword := strings.ReplaceAll(kind, "_", " ")
+	if strings.HasPrefix(kind, "DROP_") {
+		var err error
+		if keyword, err = dropCommandKeyword(node); err != nil {
+			return "", err
+		}
+	}
+	if ifExists := node.Hints[hintIfExists]; ifExists != "" {
+		keyword += " " + ifExists
+	}
+	keyword = f.kw(keyword)
+
+	var text string
+	var err error
+
+	identifier := func(i int) string {
+		if i >= len(parts.identifiers) {
+			err = fmt.Errorf("%s command on line %d is missing an identifier", kind, node.LineNumber)
+			return ""
+		}
+		return f.identifier(parts.identifiers[i])
+	}
+
+	position := func(afterIndex int) string {
+		if node.Hints[hintFirst] != "" {
+			return " " + f.kw("FIRST")
+		}
+		if afterIndex < len(parts.identifiers) {
+			return " " + f.kw("AFTER") + " " + f.identifier(parts.identifiers[afterIndex])
+		}
+		return ""
+	}
+
+	expression := func(child *AstNode) string {
+		if err != nil {
+			return ""
+		}
+		if child == nil {
+			err = fmt.Errorf("%s command on line %d is missing an expression", kind, node.LineNumber)
+			return ""
+		}
+		var rendered string
+		rendered, err = f.expression(child)
+		return rendered
+	}
+
+	switch kind {
+	case "ADD_COLUMN", "MODIFY_COLUMN":
+		if parts.column == nil {
+			return "", fmt.Errorf("%s command on line %d has no column declaration", kind, node.LineNumber)
+		}
+		text, err = f.columnDeclaration(parts.column)
+		text = keyword + " " + text + position(0)
+	case "DROP_COLUMN", "MATERIALIZE_COLUMN", "DROP_INDEX", "MATERIALIZE_INDEX", "DROP_CONSTRAINT",
+		"DROP_PROJECTION", "MATERIALIZE_PROJECTION", "DROP_STATISTICS":
+		text = keyword + " " + identifier(0)
+	case "RENAME_COLUMN":
+		text = keyword + " " + identifier(0) + " " + f.kw("TO") + " " + identifier(1)
+	case "COMMENT_COLUMN":
+		text = keyword + " " + identifier(0) + " " + expression(parts.literal)
+	case "ADD_INDEX":
+		if parts.index == nil {
+			return "", fmt.Errorf("ADD_INDEX command on line %d has no index", node.LineNumber)
+		}
+		text, err = f.index(parts.index)
+		text = keyword + " " + text + position(0)
+	case "ADD_CONSTRAINT":
+		if parts.constraint == nil {
+			return "", fmt.Errorf("ADD_CONSTRAINT command on line %d has no constraint", node.LineNumber)
+		}
+		text, err = f.constraint(parts.constraint)
+		text = keyword + " " + text
+	case "MODIFY_ORDER_BY", "MODIFY_SAMPLE_BY":
+		if len(parts.expressions) == 0 && len(parts.identifiers) > 0 {
+			parts.expressions = parts.identifiers
+		}
+		if len(parts.expressions) == 0 {
+			return "", fmt.Errorf("%s command on line %d has no key", kind, node.LineNumber)
+		}
+		text, err = f.storageKey(parts.expressions[0])
+		text = keyword + " " + text
+	case "MODIFY_TTL":
+		if parts.ttl == nil {
+			return "", fmt.Errorf("MODIFY_TTL command on line %d has no TTL", node.LineNumber)
+		}
+		text, err = f.ttl(parts.ttl)
+		text = keyword + " " + text
+	case "MODIFY_SETTING":
+		if parts.settings == nil {
+			return "", fmt.Errorf("MODIFY_SETTING command on line %d has no settings", node.LineNumber)
+		}
+		text, err = f.settings(parts.settings)
+		text = keyword + " " + text
+	case "RESET_SETTING":
+		if parts.names == nil {
+			return "", fmt.Errorf("RESET_SETTING command on line %d has no settings", node.LineNumber)
+		}
+		text, err = f.expressionList(parts.names.Children)
+		text = keyword + " " + text
+	case "MODIFY_COMMENT":
+		text = keyword + " " + expression(parts.literal)
+	case "REMOVE_TTL", "REMOVE_SAMPLE_BY", "MATERIALIZE_TTL":
+		text = keyword
+	case "DROP_PARTITION", "DROP_DETACHED_PARTITION", "ATTACH_PARTITION":
+		text = keyword + " " + f.partition(parts.partition, &err)
+		parts.partition = nil
+	case "DELETE":
+		text = keyword
+		if parts.partition != nil {
+			text += " " + f.kw("IN PARTITION") + " " + f.partition(parts.partition, &err)
+			parts.partition = nil
+		}
+		if len(parts.expressions) == 0 && parts.literal != nil {
+			parts.expressions = []*AstNode{parts.literal}
+		}
+		if len(parts.expressions) == 0 {
+			return "", fmt.Errorf("DELETE command on line %d has no predicate", node.LineNumber)
+		}
+		text += " " + f.kw("WHERE") + " " + expression(parts.expressions[0])
+	case "UPDATE":
+		if parts.assignments == nil || len(parts.expressions) == 0 && parts.literal == nil {
+			return "", fmt.Errorf("UPDATE command on line %d needs assignments and a predicate", node.LineNumber)
+		}
+		assignments := make([]string, len(parts.assignments.Children))
+		for i, assignment := range parts.assignments.Children {
+			if len(assignment.Children) == 0 {
+				return "", fmt.Errorf("Assignment on line %d has no value", assignment.LineNumber)
+			}
+			assignments[i] = f.identifierName(assignment.Value) + " = " + expression(assignment.Children[0])
+		}
+		text = keyword + " " + strings.Join(assignments, ", ")
+		if parts.partition != nil {
+			text += " " + f.kw("IN PARTITION") + " " + f.partition(parts.partition, &err)
+			parts.partition = nil
+		}
+		predicate := parts.literal
+		if len(parts.expressions) > 0 {
+			predicate = parts.expressions[0]
+		}
+		text += " " + f.kw("WHERE") + " " + expression(predicate)
+	default:
+		return "", fmt.Errorf("cannot format %s command on line %d", kind, node.LineNumber)
+	}
+
+	if parts.partition != nil {
+		text += " " + f.kw("IN PARTITION") + " " + f.partition(parts.partition, &err)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return text, nil
+}
+
+// dropCommandKeyword returns the keywords of a DROP_ command as written in the source
+// query. explain ast reports CLEAR COLUMN, INDEX and PROJECTION and DETACH PARTITION as
+// DROP_ commands too, so guessing DROP could turn them into destructive statements.
+func dropCommandKeyword(node *AstNode) (string, error) {
+	command := node.Hints[hintDropCommand]
+	if command == "" {
+		return "", fmt.Errorf("%s command on line %d could be a DROP, CLEAR or DETACH, parse the tree with its source query", node.Value, node.LineNumber)
+	}
+
+	words := strings.Fields(command)
+	object := words[len(words)-1]
+	kindWords := strings.Split(node.Value, "_")
+	if len(words) < 2 || !strings.HasPrefix(kindWords[len(kindWords)-1], object) {
+		return "", fmt.Errorf("%s command on line %d doesn't match %q in the source query", node.Value, node.LineNumber, command)
+	}
+
+	return command, nil
+}
+
+// partition renders the expression of a Partition node, recording any error in err.
+func (f *formatter) partition(node *AstNode, err *error) string {
+	if *err != nil {
+		return ""
+	}
+
+	if node == nil || len(node.Children) == 0 {
+		*err = fmt.Errorf("expected a Partition with an expression")
+		return ""
+	}
+
+	text, partitionErr := f.expression(node.Children[0])
+	if partitionErr != nil {
+		*err = partitionErr
+	}
+
+	return text
+}
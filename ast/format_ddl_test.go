@@ -0,0 +1,334 @@
+package ast
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createTableWithKeysQuery() string {
+	return `create table t2 (
+  id UInt64,
+  name Nullable(String),
+  tags Array(LowCardinality(String)) alias splitByChar(',', name),
+  d Date ttl d + interval 1 day,
+  index idx name type bloom_filter(0.01) granularity 4
+) engine = MergeTree order by (id, d) primary key id ttl d + interval 1 month to disk 'cold'`
+}
+
+func createTableWithKeysLines() []string {
+	return []string{
+		"CreateQuery  t2 (children 3)",
+		" Identifier t2",
+		" Columns definition (children 2)",
+		"  ExpressionList (children 4)",
+		"   ColumnDeclaration id (children 1)",
+		"    DataType UInt64",
+		"   ColumnDeclaration name (children 1)",
+		"    DataType Nullable (children 1)",
+		"     ExpressionList (children 1)",
+		"      DataType String",
+		"   ColumnDeclaration tags (children 2)",
+		"    DataType Array (children 1)",
+		"     ExpressionList (children 1)",
+		"      DataType LowCardinality (children 1)",
+		"       ExpressionList (children 1)",
+		"        DataType String",
+		"    Function splitByChar (children 1)",
+		"     ExpressionList (children 2)",
+		"      Literal ','",
+		"      Identifier name",
+		"   ColumnDeclaration d (children 2)",
+		"    DataType Date",
+		"    Function plus (children 1)",
+		"     ExpressionList (children 2)",
+		"      Identifier d",
+		"      Function toIntervalDay (children 1)",
+		"       ExpressionList (children 1)",
+		"        Literal UInt64_1",
+		"  ExpressionList (children 1)",
+		"   Index (children 2)",
+		"    Identifier name",
+		"    Function bloom_filter (children 1)",
+		"     ExpressionList (children 1)",
+		"      Literal Float64_0.01",
+		" Storage definition (children 4)",
+		"  Function MergeTree",
+		"  Identifier id",
+		"  Function tuple (children 1)",
+		"   ExpressionList (children 2)",
+		"    Identifier id",
+		"    Identifier d",
+		"  ExpressionList (children 1)",
+		"   TTLElement (children 1)",
+		"    Function plus (children 1)",
+		"     ExpressionList (children 2)",
+		"      Identifier d",
+		"      Function toIntervalMonth (children 1)",
+		"       ExpressionList (children 1)",
+		"        Literal UInt64_1",
+	}
+}
+
+func materializedViewQuery() string {
+	return "create materialized view mv to dest as select a from src"
+}
+
+func materializedViewLines() []string {
+	return []string{
+		"CreateQuery  mv (children 2)",
+		" Identifier mv",
+		" SelectWithUnionQuery (children 1)",
+		"  ExpressionList (children 1)",
+		"   SelectQuery (children 2)",
+		"    ExpressionList (children 1)",
+		"     Identifier a",
+		"    TablesInSelectQuery (children 1)",
+		"     TablesInSelectQueryElement (children 1)",
+		"      TableExpression (children 1)",
+		"       TableIdentifier src",
+	}
+}
+
+func alterCommandsQuery() string {
+	return `alter table db.t modify column x String default 'a' first, drop column y,
+comment column z 'c', modify ttl d + interval 1 day, modify setting max_parts = 10,
+delete where x = 1, update x = 'b' where y > 0, modify order by (a, b)`
+}
+
+func alterCommandsLines() []string {
+	return []string{
+		"AlterQuery db t (children 3)",
+		" ExpressionList (children 8)",
+		"  AlterCommand MODIFY_COLUMN (children 1)",
+		"   ColumnDeclaration x (children 2)",
+		"    DataType String",
+		"    Literal 'a'",
+		"  AlterCommand DROP_COLUMN (children 1)",
+		"   Identifier y",
+		"  AlterCommand COMMENT_COLUMN (children 2)",
+		"   Identifier z",
+		"   Literal 'c'",
+		"  AlterCommand MODIFY_TTL (children 1)",
+		"   ExpressionList (children 1)",
+		"    TTLElement (children 1)",
+		"     Function plus (children 1)",
+		"      ExpressionList (children 2)",
+		"       Identifier d",
+		"       Function toIntervalDay (children 1)",
+		"        ExpressionList (children 1)",
+		"         Literal UInt64_1",
+		"  AlterCommand MODIFY_SETTING (children 1)",
+		"   Set",
+		"  AlterCommand DELETE (children 1)",
+		"   Function equals (children 1)",
+		"    ExpressionList (children 2)",
+		"     Identifier x",
+		"     Literal UInt64_1",
+		"  AlterCommand UPDATE (children 2)",
+		"   Function greater (children 1)",
+		"    ExpressionList (children 2)",
+		"     Identifier y",
+		"     Literal UInt64_0",
+		"   ExpressionList (children 1)",
+		"    Assignment x (children 1)",
+		"     Literal 'b'",
+		"  AlterCommand MODIFY_ORDER_BY (children 1)",
+		"   Function tuple (children 1)",
+		"    ExpressionList (children 2)",
+		"     Identifier a",
+		"     Identifier b",
+		" Identifier db",
+		" Identifier t",
+	}
+}
+
+func TestFormatCreateTable(t *testing.T) {
+	root, err := Parse("create table db.t1 (z Int64, s String materialized 'x' comment 'a comment' codec(ZSTD(1))) engine = MergeTree() partition by toYYYYMM(d) order by z settings index_granularity = 8192", createTableLines())
+	assert.NoError(t, err)
+
+	sql, err := Format(root)
+	assert.NoError(t, err)
+	assert.Equal(t, `CREATE TABLE db.t1
+(
+    z Int64,
+    s String MATERIALIZED 'x' COMMENT 'a comment' CODEC(ZSTD(1))
+)
+ENGINE = MergeTree()
+PARTITION BY toYYYYMM(d)
+ORDER BY z
+SETTINGS index_granularity = 8192`, sql)
+
+	root, err = Parse(createTableWithKeysQuery(), createTableWithKeysLines())
+	assert.NoError(t, err)
+
+	sql, err = Format(root)
+	assert.NoError(t, err)
+	assert.Equal(t, `CREATE TABLE t2
+(
+    id UInt64,
+    name Nullable(String),
+    tags Array(LowCardinality(String)) ALIAS splitByChar(',', name),
+    d Date TTL d + toIntervalDay(1),
+    INDEX idx name TYPE bloom_filter(0.01) GRANULARITY 4
+)
+ENGINE = MergeTree
+PRIMARY KEY id
+ORDER BY (id, d)
+TTL d + toIntervalMonth(1) TO DISK 'cold'`, sql)
+
+	c, _ := AsCreateQuery(root)
+	assert.Equal(t, "id", c.PrimaryKey().Value)
+	assert.Nil(t, c.PartitionBy())
+	assert.Equal(t, "plus", c.Columns()[3].TTL().Value)
+	assert.Nil(t, c.Columns()[3].Default())
+}
+
+func TestFormatCreateViewsAndFunctions(t *testing.T) {
+	root, err := Parse(materializedViewQuery(), materializedViewLines())
+	assert.NoError(t, err)
+
+	sql, err := Format(root)
+	assert.NoError(t, err)
+	assert.Equal(t, `CREATE MATERIALIZED VIEW mv TO dest
+AS SELECT
+    a
+FROM src`, sql)
+
+	// explain ast doesn't say whether it's a view or a table.
+	root, err = Parse("", createQueryAstLines())
+	assert.NoError(t, err)
+
+	_, err = Format(root)
+	assert.ErrorContains(t, err, "explain ast doesn't say what it creates")
+
+	root, err = Parse("create view my_table_or_view as select *, ' ', 'a literal with spaces', ['an', 'array', 'literal'] from z", createQueryAstLines())
+	assert.NoError(t, err)
+
+	sql, err = Format(root)
+	assert.NoError(t, err)
+	assert.Equal(t, `CREATE VIEW my_table_or_view
+AS SELECT
+    *,
+    ' ',
+    'a literal with spaces',
+    ['an', 'array', 'literal']
+FROM z`, sql)
+
+	root, err = Parse("create function z as (z) -> true", createFunctionAstLines())
+	assert.NoError(t, err)
+
+	sql, err = Format(root)
+	assert.NoError(t, err)
+	assert.Equal(t, "CREATE FUNCTION z AS z -> true", sql)
+}
+
+func TestFormatAlter(t *testing.T) {
+	root, err := Parse("alter table t1 add column if not exists b UInt8 after z, rename column c to d", alterTableLines())
+	assert.NoError(t, err)
+
+	sql, err := Format(root)
+	assert.NoError(t, err)
+	assert.Equal(t, `ALTER TABLE t1
+    ADD COLUMN IF NOT EXISTS b UInt8 AFTER z,
+    RENAME COLUMN c TO d`, sql)
+
+	root, err = Parse(alterCommandsQuery(), alterCommandsLines())
+	assert.NoError(t, err)
+
+	sql, err = Format(root)
+	assert.NoError(t, err)
+	assert.Equal(t, `ALTER TABLE db.t
+    MODIFY COLUMN x String DEFAULT 'a' FIRST,
+    DROP COLUMN y,
+    COMMENT COLUMN z 'c',
+    MODIFY TTL d + toIntervalDay(1),
+    MODIFY SETTING max_parts = 10,
+    DELETE WHERE x = 1,
+    UPDATE x = 'b' WHERE y > 0,
+    MODIFY ORDER BY (a, b)`, sql)
+}
+
+func TestFormatAlterClearAndDetach(t *testing.T) {
+	// explain ast reports CLEAR and DETACH commands as DROP commands.
+	lines := []string{
+		"AlterQuery  t (children 2)",
+		" ExpressionList (children 2)",
+		"  AlterCommand DROP_PARTITION (children 1)",
+		"   Partition (children 1)",
+		"    Literal UInt64_202001",
+		"  AlterCommand DROP_COLUMN (children 1)",
+		"   Identifier x",
+		" Identifier t",
+	}
+
+	root, err := Parse("alter table t detach partition 202001, clear column x", lines)
+	assert.NoError(t, err)
+
+	sql, err := Format(root)
+	assert.NoError(t, err)
+	assert.Equal(t, `ALTER TABLE t
+    DETACH PARTITION 202001,
+    CLEAR COLUMN x`, sql)
+
+	root, err = Parse("alter table t drop partition 202001, drop column x", lines)
+	assert.NoError(t, err)
+
+	sql, err = Format(root)
+	assert.NoError(t, err)
+	assert.Equal(t, `ALTER TABLE t
+    DROP PARTITION 202001,
+    DROP COLUMN x`, sql)
+
+	root, err = Parse("", lines)
+	assert.NoError(t, err)
+
+	_, err = Format(root)
+	assert.ErrorContains(t, err, "cannot format AlterCommand node on line 3")
+}
+
+func TestFormatDDLRoundTrip(t *testing.T) {
+	fixtures := []struct {
+		query string
+		lines []string
+	}{
+		{createTableWithKeysQuery(), createTableWithKeysLines()},
+		{materializedViewQuery(), materializedViewLines()},
+		{alterCommandsQuery(), alterCommandsLines()},
+	}
+
+	for _, fixture := range fixtures {
+		root, err := Parse(fixture.query, fixture.lines)
+		assert.NoError(t, err)
+
+		sql, err := Format(root)
+		assert.NoError(t, err)
+
+		reparsed, err := NewFromQuery(sql, stubExplain(sql, fixture.lines))
+		assert.NoError(t, err)
+		assert.Equal(t, root.Hash, reparsed.Root.Hash)
+
+		reformatted, err := Format(reparsed.Root)
+		assert.NoError(t, err)
+		assert.Equal(t, sql, reformatted)
+	}
+}
+
+func TestFormatDDLErrors(t *testing.T) {
+	root, err := Parse("", createTableWithKeysLines())
+	assert.NoError(t, err)
+
+	_, err = Format(root)
+	assert.ErrorContains(t, err, "explain ast doesn't say what it creates")
+
+	root, err = Parse("alter table t freeze", []string{
+		"AlterQuery  t (children 2)",
+		" ExpressionList (children 1)",
+		"  AlterCommand FREEZE_ALL",
+		" Identifier t",
+	})
+	assert.NoError(t, err)
+
+	_, err = Format(root)
+	assert.ErrorContains(t, err, "cannot format FREEZE_ALL command")
+}
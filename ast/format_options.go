@@ -0,0 +1,233 @@
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ConfigFileName is the repo-level config file FindFormatOptions looks for.
+const ConfigFileName = ".treehouse.json"
+
+// Keyword cases for FormatOptions.KeywordCase.
+const (
+	KeywordCaseUpper = "upper"
+	KeywordCaseLower = "lower"
+)
+
+// Identifier quoting policies for FormatOptions.IdentifierQuoting.
+const (
+	// QuoteAsWritten keeps the quotes identifiers had in the source, adding backquotes
+	// where they're needed.
+	QuoteAsWritten = "as_written"
+	// QuoteAsNeeded only quotes identifiers that aren't valid bare, or are keywords.
+	QuoteAsNeeded = "as_needed"
+	// QuoteAlways backquotes every identifier.
+	QuoteAlways = "always"
+)
+
+// FormatOptions controls how FormatWithOptions lays out SQL.
+type FormatOptions struct {
+	// KeywordCase is KeywordCaseUpper or KeywordCaseLower, with empty meaning upper.
+	KeywordCase string `json:"keyword_case"`
+	// IndentWidth is the number of spaces per indentation level.
+	IndentWidth int `json:"indent_width"`
+	// PackColumns puts SELECT and WITH lists on the clause's line instead of one
+	// expression per line. Packed lists longer than MaxLineWidth still wrap.
+	PackColumns bool `json:"pack_columns"`
+	// LeadingCommas starts each item of a multi-line list with its comma.
+	LeadingCommas bool `json:"leading_commas"`
+	// MaxLineWidth wraps function calls with more than one argument onto one argument
+	// per line when they'd run past it. Zero turns wrapping off.
+	MaxLineWidth int `json:"max_line_width"`
+	// IdentifierQuoting is QuoteAsWritten, QuoteAsNeeded or QuoteAlways, with empty
+	// meaning QuoteAsWritten.
+	IdentifierQuoting string `json:"identifier_quoting"`
+}
+
+// DefaultFormatOptions returns the options Format uses.
+func DefaultFormatOptions() FormatOptions {
+	return FormatOptions{
+		KeywordCase:       KeywordCaseUpper,
+		IndentWidth:       4,
+		IdentifierQuoting: QuoteAsWritten,
+	}
+}
+
+// withDefaults fills in the KeywordCase and IdentifierQuoting left empty, as they are in
+// the zero FormatOptions, with their defaults.
+func (o FormatOptions) withDefaults() FormatOptions {
+	defaults := DefaultFormatOptions()
+
+	if o.KeywordCase == "" {
+		o.KeywordCase = defaults.KeywordCase
+	}
+
+	if o.IdentifierQuoting == "" {
+		o.IdentifierQuoting = defaults.IdentifierQuoting
+	}
+
+	return o
+}
+
+// Validate returns an error describing the first invalid option.
+func (o FormatOptions) Validate() error {
+	o = o.withDefaults()
+
+	switch {
+	case o.KeywordCase != KeywordCaseUpper && o.KeywordCase != KeywordCaseLower:
+		return fmt.Errorf("keyword_case must be %q or %q, got %q", KeywordCaseUpper, KeywordCaseLower, o.KeywordCase)
+	case o.IdentifierQuoting != QuoteAsWritten && o.IdentifierQuoting != QuoteAsNeeded && o.IdentifierQuoting != QuoteAlways:
+		return fmt.Errorf("identifier_quoting must be %q, %q or %q, got %q", QuoteAsWritten, QuoteAsNeeded, QuoteAlways, o.IdentifierQuoting)
+	case o.IndentWidth < 0:
+		return fmt.Errorf("indent_width can't be negative")
+	case o.MaxLineWidth < 0:
+		return fmt.Errorf("max_line_width can't be negative")
+	}
+
+	return nil
+}
+
+// LoadFormatOptions reads the "format" object of a JSON config file such as
+//
+//	{"format": {"keyword_case": "lower", "indent_width": 2, "leading_commas": true}}
+//
+// Options the file leaves out keep their defaults.
+func LoadFormatOptions(path string) (FormatOptions, error) {
+	options := DefaultFormatOptions()
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return options, err
+	}
+
+	var config struct {
+		Format json.RawMessage `json:"format"`
+	}
+
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return options, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+
+	if len(config.Format) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(config.Format))
+		decoder.DisallowUnknownFields()
+
+		if err := decoder.Decode(&options); err != nil {
+			return options, fmt.Errorf("error parsing format options in %s: %w", path, err)
+		}
+	}
+
+	if err := options.Validate(); err != nil {
+		return options, fmt.Errorf("invalid format options in %s: %w", path, err)
+	}
+
+	return options, nil
+}
+
+// FindFormatOptions loads the options from the ConfigFileName in dir or the closest
+// of its parents, returning the defaults if there isn't one.
+func FindFormatOptions(dir string) (FormatOptions, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return DefaultFormatOptions(), err
+	}
+
+	for {
+		path := filepath.Join(dir, ConfigFileName)
+
+		options, err := LoadFormatOptions(path)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return options, err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return DefaultFormatOptions(), nil
+		}
+		dir = parent
+	}
+}
+
+func newFormatter(options FormatOptions) *formatter {
+	options = options.withDefaults()
+
+	return &formatter{options: options, indent: strings.Repeat(" ", options.IndentWidth)}
+}
+
+// kw renders keywords, which are written in uppercase, in the configured case.
+func (f *formatter) kw(keywords string) string {
+	if f.options.KeywordCase == KeywordCaseLower {
+		return strings.ToLower(keywords)
+	}
+
+	return keywords
+}
+
+// kwOperands renders the keywords of a hint such as "WITH FILL FROM STEP", following
+// each one that takes an operand with the next of operands, and each in names with
+// its text there, such as the disk name after DISK.
+func (f *formatter) kwOperands(node *AstNode, keywords string, takesOperand map[string]bool, operands []*AstNode, names map[string]string) (string, error) {
+	var parts []string
+
+	for _, keyword := range strings.Fields(keywords) {
+		parts = append(parts, f.kw(keyword))
+		if name := names[keyword]; name != "" {
+			parts = append(parts, name)
+		}
+
+		if !takesOperand[keyword] {
+			continue
+		}
+
+		if len(operands) == 0 {
+			return "", fmt.Errorf("%s on line %d is missing the expression after %s", node.Type, node.LineNumber, keyword)
+		}
+
+		text, err := f.expression(operands[0])
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, text)
+		operands = operands[1:]
+	}
+
+	if len(operands) > 0 {
+		return "", fmt.Errorf("%s on line %d has %d more children than its source query keywords", node.Type, node.LineNumber, len(operands))
+	}
+
+	return strings.Join(parts, " "), nil
+}
+
+// verticalList renders items one per line, indented, with commas placed as configured.
+func (f *formatter) verticalList(items []string) string {
+	if !f.options.LeadingCommas {
+		return f.indentText(strings.Join(items, ",\n"))
+	}
+
+	lines := make([]string, len(items))
+	for i, item := range items {
+		prefix := ", "
+		if i == 0 {
+			prefix = "  "
+		}
+		lines[i] = prefix + strings.ReplaceAll(item, "\n", "\n  ")
+	}
+
+	return f.indentText(strings.Join(lines, "\n"))
+}
+
+// fits reports whether a single line of text starting at the current nesting level
+// stays within MaxLineWidth.
+func (f *formatter) fits(text string) bool {
+	if f.options.MaxLineWidth == 0 || strings.Contains(text, "\n") {
+		return true
+	}
+
+	return f.level*len(f.indent)+len(text) <= f.options.MaxLineWidth
+}
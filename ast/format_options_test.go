@@ -0,0 +1,186 @@
+package ast
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatWithOptions(t *testing.T) {
+	root, err := Parse(selectWithJoinQuery(), selectWithJoinLines())
+	assert.NoError(t, err)
+
+	sql, err := FormatWithOptions(root, FormatOptions{
+		KeywordCase:       KeywordCaseLower,
+		IndentWidth:       2,
+		LeadingCommas:     true,
+		IdentifierQuoting: QuoteAsWritten,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, `select distinct
+    a
+  , count() as c
+  , arrayMap(x -> x * 2, arr) as doubled
+from db.t1 as t
+left join (
+  select
+      id
+    , b
+  from t2
+  where b > 1
+) as s using (id)
+where a in (1, 2) and not b
+group by a
+order by c desc, a
+limit 10
+settings max_threads = 2`, sql)
+
+	sql, err = FormatWithOptions(root, FormatOptions{
+		KeywordCase:       KeywordCaseUpper,
+		IndentWidth:       4,
+		PackColumns:       true,
+		MaxLineWidth:      30,
+		IdentifierQuoting: QuoteAlways,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "SELECT DISTINCT\n"+
+		"    `a`,\n"+
+		"    count() AS `c`,\n"+
+		"    arrayMap(\n"+
+		"        `x` -> `x` * 2,\n"+
+		"        `arr`\n"+
+		"    ) AS `doubled`\n"+
+		"FROM `db`.`t1` AS `t`\n"+
+		"LEFT JOIN (\n"+
+		"    SELECT `id`, `b`\n"+
+		"    FROM `t2`\n"+
+		"    WHERE `b` > 1\n"+
+		") AS `s` USING (`id`)\n"+
+		"WHERE `a` IN (1, 2) AND NOT `b`\n"+
+		"GROUP BY `a`\n"+
+		"ORDER BY `c` DESC, `a`\n"+
+		"LIMIT 10\n"+
+		"SETTINGS max_threads = 2", sql)
+
+	root, err = Parse(unionQuery(), unionLines())
+	assert.NoError(t, err)
+
+	options := DefaultFormatOptions()
+	options.KeywordCase = KeywordCaseLower
+	options.PackColumns = true
+
+	sql, err = FormatWithOptions(root, options)
+	assert.NoError(t, err)
+	assert.Equal(t, `select a
+from t1 final
+union distinct
+select a
+from t1 as x
+any inner join t2 on x.a = t2.a, t3
+where x.a > 0
+order by a desc nulls first`, sql)
+
+	_, err = FormatWithOptions(root, FormatOptions{KeywordCase: "title", IdentifierQuoting: QuoteAsWritten})
+	assert.ErrorContains(t, err, "keyword_case must be")
+
+	// Options left empty take their defaults.
+	assert.NoError(t, FormatOptions{}.Validate())
+
+	sql, err = FormatWithOptions(root, FormatOptions{IndentWidth: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT
+  a
+FROM t1 FINAL
+UNION DISTINCT
+SELECT
+  a
+FROM t1 AS x
+ANY INNER JOIN t2 ON x.a = t2.a, t3
+WHERE x.a > 0
+ORDER BY a DESC NULLS FIRST`, sql)
+}
+
+func TestFormatDDLWithOptions(t *testing.T) {
+	root, err := Parse(createTableWithKeysQuery(), createTableWithKeysLines())
+	assert.NoError(t, err)
+
+	sql, err := FormatWithOptions(root, FormatOptions{
+		KeywordCase:       KeywordCaseLower,
+		IndentWidth:       2,
+		LeadingCommas:     true,
+		IdentifierQuoting: QuoteAsNeeded,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, `create table t2
+(
+    id UInt64
+  , name Nullable(String)
+  , tags Array(LowCardinality(String)) alias splitByChar(',', name)
+  , d Date ttl d + toIntervalDay(1)
+  , index idx name type bloom_filter(0.01) granularity 4
+)
+engine = MergeTree
+primary key id
+order by (id, d)
+ttl d + toIntervalMonth(1) to disk 'cold'`, sql)
+
+	root, err = Parse("select `a` from t", []string{
+		"SelectWithUnionQuery (children 1)",
+		" ExpressionList (children 1)",
+		"  SelectQuery (children 2)",
+		"   ExpressionList (children 1)",
+		"    Identifier `a`",
+		"   TablesInSelectQuery (children 1)",
+		"    TablesInSelectQueryElement (children 1)",
+		"     TableExpression (children 1)",
+		"      TableIdentifier t",
+	})
+	assert.NoError(t, err)
+
+	options := DefaultFormatOptions()
+	options.PackColumns = true
+
+	sql, err = FormatWithOptions(root, options)
+	assert.NoError(t, err)
+	assert.Equal(t, "SELECT `a`\nFROM t", sql)
+
+	options.IdentifierQuoting = QuoteAsNeeded
+	sql, err = FormatWithOptions(root, options)
+	assert.NoError(t, err)
+	assert.Equal(t, "SELECT a\nFROM t", sql)
+}
+
+func TestLoadFormatOptions(t *testing.T) {
+	dir := t.TempDir()
+	nested := filepath.Join(dir, "queries", "views")
+	assert.NoError(t, os.MkdirAll(nested, 0o755))
+
+	options, err := FindFormatOptions(nested)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultFormatOptions(), options)
+
+	config := `{"format": {"keyword_case": "lower", "indent_width": 2, "leading_commas": true}}`
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, ConfigFileName), []byte(config), 0o644))
+
+	options, err = FindFormatOptions(nested)
+	assert.NoError(t, err)
+	assert.Equal(t, FormatOptions{
+		KeywordCase:       KeywordCaseLower,
+		IndentWidth:       2,
+		LeadingCommas:     true,
+		IdentifierQuoting: QuoteAsWritten,
+	}, options)
+
+	path := filepath.Join(nested, ConfigFileName)
+	assert.NoError(t, os.WriteFile(path, []byte(`{"format": {"keyword_cases": "lower"}}`), 0o644))
+
+	_, err = FindFormatOptions(nested)
+	assert.ErrorContains(t, err, `unknown field "keyword_cases"`)
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"format": {"identifier_quoting": "never"}}`), 0o644))
+
+	_, err = LoadFormatOptions(path)
+	assert.ErrorContains(t, err, "identifier_quoting must be")
+}
@@ -0,0 +1,518 @@
+package ast
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stubExplain returns an ExecQueryFunc that answers explain ast for query with lines.
+func stubExplain(query string, lines []string) ExecQueryFunc {
+	return func(explainQuery string) ([]map[string]interface{}, error) {
+		if explainQuery != "explain ast "+query {
+			return nil, fmt.Errorf("unexpected query: %s", explainQuery)
+		}
+
+		rows := make([]map[string]interface{}, len(lines))
+		for i, line := range lines {
+			rows[i] = map[string]interface{}{"explain": line}
+		}
+		return rows, nil
+	}
+}
+
+func selectWithJoinQuery() string {
+	return `select distinct a, count() as c, arrayMap(x -> x * 2, arr) as doubled
+from db.t1 as t left join (select id, b from t2 where b > 1) as s using (id)
+where a in (1, 2) and not b
+group by a
+order by c desc, a
+limit 10
+settings max_threads = 2`
+}
+
+func selectWithJoinLines() []string {
+	return []string{
+		"SelectWithUnionQuery (children 1)",
+		" ExpressionList (children 1)",
+		"  SelectQuery (children 7)",
+		"   ExpressionList (children 3)",
+		"    Identifier a",
+		"    Function count (alias c) (children 1)",
+		"     ExpressionList",
+		"    Function arrayMap (alias doubled) (children 1)",
+		"     ExpressionList (children 2)",
+		"      Function lambda (children 1)",
+		"       ExpressionList (children 2)",
+		"        Function tuple (children 1)",
+		"         ExpressionList (children 1)",
+		"          Identifier x",
+		"        Function multiply (children 1)",
+		"         ExpressionList (children 2)",
+		"          Identifier x",
+		"          Literal UInt64_2",
+		"      Identifier arr",
+		"   TablesInSelectQuery (children 2)",
+		"    TablesInSelectQueryElement (children 1)",
+		"     TableExpression (children 1)",
+		"      TableIdentifier db.t1 (alias t)",
+		"    TablesInSelectQueryElement (children 2)",
+		"     TableExpression (children 1)",
+		"      Subquery (alias s) (children 1)",
+		"       SelectWithUnionQuery (children 1)",
+		"        ExpressionList (children 1)",
+		"         SelectQuery (children 3)",
+		"          ExpressionList (children 2)",
+		"           Identifier id",
+		"           Identifier b",
+		"          TablesInSelectQuery (children 1)",
+		"           TablesInSelectQueryElement (children 1)",
+		"            TableExpression (children 1)",
+		"             TableIdentifier t2",
+		"          Function greater (children 1)",
+		"           ExpressionList (children 2)",
+		"            Identifier b",
+		"            Literal UInt64_1",
+		"     TableJoin (children 1)",
+		"      ExpressionList (children 1)",
+		"       Identifier id",
+		"   Function and (children 1)",
+		"    ExpressionList (children 2)",
+		"     Function in (children 1)",
+		"      ExpressionList (children 2)",
+		"       Identifier a",
+		"       Literal Tuple_(UInt64_1, UInt64_2)",
+		"     Function not (children 1)",
+		"      ExpressionList (children 1)",
+		"       Identifier b",
+		"   ExpressionList (children 1)",
+		"    Identifier a",
+		"   ExpressionList (children 2)",
+		"    OrderByElement (children 1)",
+		"     Identifier c",
+		"    OrderByElement (children 1)",
+		"     Identifier a",
+		"   Literal UInt64_10",
+		"   Set",
+	}
+}
+
+func unionQuery() string {
+	return `SELECT a FROM t1 FINAL
+union distinct
+SELECT a FROM t1 AS x ANY INNER JOIN t2 ON x.a = t2.a, t3 WHERE x.a > 0 ORDER BY a DESC NULLS FIRST`
+}
+
+func unionLines() []string {
+	return []string{
+		"SelectWithUnionQuery (children 1)",
+		" ExpressionList (children 2)",
+		"  SelectQuery (children 2)",
+		"   ExpressionList (children 1)",
+		"    Identifier a",
+		"   TablesInSelectQuery (children 1)",
+		"    TablesInSelectQueryElement (children 1)",
+		"     TableExpression (children 1)",
+		"      TableIdentifier t1",
+		"  SelectQuery (children 4)",
+		"   ExpressionList (children 1)",
+		"    Identifier a",
+		"   TablesInSelectQuery (children 3)",
+		"    TablesInSelectQueryElement (children 1)",
+		"     TableExpression (children 1)",
+		"      TableIdentifier t1 (alias x)",
+		"    TablesInSelectQueryElement (children 2)",
+		"     TableExpression (children 1)",
+		"      TableIdentifier t2",
+		"     TableJoin (children 1)",
+		"      Function equals (children 1)",
+		"       ExpressionList (children 2)",
+		"        Identifier x.a",
+		"        Identifier t2.a",
+		"    TablesInSelectQueryElement (children 2)",
+		"     TableExpression (children 1)",
+		"      TableIdentifier t3",
+		"     TableJoin",
+		"   Function greater (children 1)",
+		"    ExpressionList (children 2)",
+		"     Identifier x.a",
+		"     Literal UInt64_0",
+		"   ExpressionList (children 1)",
+		"    OrderByElement (children 1)",
+		"     Identifier a",
+	}
+}
+
+func TestFormatSelect(t *testing.T) {
+	root, err := Parse(selectWithJoinQuery(), selectWithJoinLines())
+	assert.NoError(t, err)
+
+	sql, err := Format(root)
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT DISTINCT
+    a,
+    count() AS c,
+    arrayMap(x -> x * 2, arr) AS doubled
+FROM db.t1 AS t
+LEFT JOIN (
+    SELECT
+        id,
+        b
+    FROM t2
+    WHERE b > 1
+) AS s USING (id)
+WHERE a IN (1, 2) AND NOT b
+GROUP BY a
+ORDER BY c DESC, a
+LIMIT 10
+SETTINGS max_threads = 2`, sql)
+}
+
+func TestFormatUnion(t *testing.T) {
+	root, err := Parse(unionQuery(), unionLines())
+	assert.NoError(t, err)
+
+	sql, err := Format(root)
+	assert.NoError(t, err)
+	assert.Equal(t, `SELECT
+    a
+FROM t1 FINAL
+UNION DISTINCT
+SELECT
+    a
+FROM t1 AS x
+ANY INNER JOIN t2 ON x.a = t2.a, t3
+WHERE x.a > 0
+ORDER BY a DESC NULLS FIRST`, sql)
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	fixtures := []struct {
+		query string
+		lines []string
+	}{
+		{selectWithJoinQuery(), selectWithJoinLines()},
+		{unionQuery(), unionLines()},
+		{"select *, z as n, z() as r from my_table_or_view", astLines()},
+		{"select describe('thing', arrayMap((z, a, b) -> expect(format('{} and {} have {}', a, b, toString(tokens)), tokens, funky(a, b)), " +
+			"[(3, 'abc', 'abc'), (5, 'maximus', 'jebediah'), (3, 'maximus', 'asdf')]))", queryWithTupleLines()},
+	}
+
+	for _, fixture := range fixtures {
+		root, err := Parse(fixture.query, fixture.lines)
+		assert.NoError(t, err)
+
+		sql, err := Format(root)
+		assert.NoError(t, err)
+
+		// Explaining the formatted SQL gives back the same tree, and the hints recovered
+		// from it format it identically.
+		reparsed, err := NewFromQuery(sql, stubExplain(sql, fixture.lines))
+		assert.NoError(t, err)
+		assert.Equal(t, root.Hash, reparsed.Root.Hash)
+
+		reformatted, err := Format(reparsed.Root)
+		assert.NoError(t, err)
+		assert.Equal(t, sql, reformatted)
+	}
+}
+
+func TestFormatExpressions(t *testing.T) {
+	fixtures := []struct {
+		lines    []string
+		expected string
+	}{
+		{
+			[]string{
+				"Function multiply (children 1)",
+				" ExpressionList (children 2)",
+				"  Function plus (children 1)",
+				"   ExpressionList (children 2)",
+				"    Identifier a",
+				"    Identifier b",
+				"  Identifier c",
+			},
+			"(a + b) * c",
+		},
+		{
+			[]string{
+				"Function minus (children 1)",
+				" ExpressionList (children 2)",
+				"  Function minus (children 1)",
+				"   ExpressionList (children 2)",
+				"    Identifier a",
+				"    Identifier b",
+				"  Function minus (children 1)",
+				"   ExpressionList (children 2)",
+				"    Identifier c",
+				"    Literal Int64_-1",
+			},
+			"a - b - (c - -1)",
+		},
+		{
+			[]string{
+				"Function and (children 1)",
+				" ExpressionList (children 2)",
+				"  Function or (children 1)",
+				"   ExpressionList (children 2)",
+				"    Identifier a",
+				"    Identifier b",
+				"  Function not (children 1)",
+				"   ExpressionList (children 1)",
+				"    Function and (children 1)",
+				"     ExpressionList (children 2)",
+				"      Identifier c",
+				"      Function isNull (children 1)",
+				"       ExpressionList (children 1)",
+				"        Identifier d",
+			},
+			"(a OR b) AND NOT (c AND d IS NULL)",
+		},
+		{
+			[]string{
+				"Function plus (children 1)",
+				" ExpressionList (children 2)",
+				"  Function negate (children 1)",
+				"   ExpressionList (children 1)",
+				"    Literal UInt64_1",
+				"  Function arrayElement (alias first) (children 1)",
+				"   ExpressionList (children 2)",
+				"    Identifier arr",
+				"    Literal UInt64_1",
+			},
+			"-(1) + (arr[1] AS first)",
+		},
+		{
+			[]string{
+				"Function quantile (children 2)",
+				" ExpressionList (children 1)",
+				"  Identifier x",
+				" ExpressionList (children 1)",
+				"  Literal Float64_0.5",
+			},
+			"quantile(0.5)(x)",
+		},
+		{
+			[]string{
+				"Function count (children 2)",
+				" ExpressionList",
+				" WindowDefinition (children 2)",
+				"  ExpressionList (children 1)",
+				"   Identifier a",
+				"  ExpressionList (children 1)",
+				"   OrderByElement (children 1)",
+				"    Identifier b",
+			},
+			"count() OVER (PARTITION BY a ORDER BY b)",
+		},
+		{
+			[]string{
+				"Function arrayFilter (children 1)",
+				" ExpressionList (children 2)",
+				"  Function lambda (children 1)",
+				"   ExpressionList (children 2)",
+				"    Function tuple (children 1)",
+				"     ExpressionList (children 2)",
+				"      Identifier k",
+				"      Identifier `select`",
+				"    Function equals (children 1)",
+				"     ExpressionList (children 2)",
+				"      Identifier k",
+				"      Literal 'it\\'s'",
+				"  Literal Array_[Float64_1, Bool_1, NULL]",
+			},
+			"arrayFilter((k, `select`) -> k = 'it\\'s', [1.0, true, NULL])",
+		},
+	}
+
+	for _, fixture := range fixtures {
+		root, err := Parse(fixture.expected, fixture.lines)
+		assert.NoError(t, err)
+
+		f := newFormatter(DefaultFormatOptions())
+		sql, err := f.expression(root)
+		assert.NoError(t, err)
+		assert.Equal(t, fixture.expected, sql)
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	root, err := Parse("", selectWithJoinLines())
+	assert.NoError(t, err)
+
+	_, err = Format(root)
+	assert.ErrorContains(t, err, "parse the tree with its source query")
+
+	_, err = Format(root.Children[0])
+	assert.ErrorContains(t, err, "cannot format ExpressionList node on line 2 as a query")
+}
+
+func TestSourceHints(t *testing.T) {
+	root, err := Parse(selectWithJoinQuery(), selectWithJoinLines())
+	assert.NoError(t, err)
+
+	selects := nodesOfTypes(root, "SelectQuery")
+	assert.Equal(t, "DISTINCT", selects[0].Hints[hintDistinct])
+	assert.Equal(t, "SELECT,FROM,WHERE,GROUP BY,ORDER BY,LIMIT,SETTINGS", selects[0].Hints[hintClauses])
+	assert.Equal(t, "SELECT,FROM,WHERE", selects[1].Hints[hintClauses])
+	assert.Equal(t, "LEFT JOIN", nodesOfTypes(root, "TableJoin")[0].Hints[hintJoin])
+	assert.Equal(t, "max_threads = 2", nodesOfTypes(root, "Set")[0].Hints[hintSettings])
+
+	q, _ := AsSelectQuery(selects[0])
+	assert.Equal(t, "and", q.Where().Value)
+	assert.Equal(t, "a", q.GroupBy()[0].Value)
+
+	clone := root.Clone()
+	assert.Equal(t, "DISTINCT", nodesOfTypes(clone, "SelectQuery")[0].Hints[hintDistinct])
+
+	// A WITH clause starts its query, so CTE subqueries come after it.
+	h := extractSourceHints("WITH (SELECT max(x) FROM t ORDER BY y DESC) AS m SELECT m LIMIT 1 BY m")
+	assert.Equal(t, []string{"DESC"}, constructHints(h.orderBys, hintOrderByModifiers))
+	assert.Equal(t, []string{"WITH,SELECT,LIMIT BY", "SELECT,FROM,ORDER BY"}, constructHints(h.selects, hintClauses))
+
+	// Storage keys aren't OrderByElements and joins are ordered as their nodes are visited.
+	h = extractSourceHints("CREATE TABLE t ENGINE = MergeTree ORDER BY x AS SELECT * FROM a FULL JOIN (SELECT * FROM b SEMI LEFT JOIN c USING z) USING z ORDER BY x ASC")
+	assert.Equal(t, []string{"ASC"}, constructHints(h.orderBys, hintOrderByModifiers))
+	assert.Equal(t, []string{"SEMI LEFT JOIN", "FULL JOIN"}, constructHints(h.joins, hintJoin))
+
+	// Commas between table expressions are joins too, but not those in an ARRAY JOIN list.
+	h = extractSourceHints("SELECT * FROM a, b ARRAY JOIN x, y CROSS JOIN c, d")
+	assert.Equal(t, []string{",", "CROSS JOIN", ","}, constructHints(h.joins, hintJoin))
+	assert.Equal(t, []string{"ARRAY JOIN"}, constructHints(h.arrayJoins, hintJoin))
+
+	// Only keywords are kept, the expressions they take are children of the node.
+	h = extractSourceHints("SELECT * FROM t ORDER BY d DESC WITH FILL FROM toDate('2020-01-01') STEP 1, s COLLATE 'tr'")
+	assert.Equal(t, []string{"DESC WITH FILL FROM STEP", "COLLATE"}, constructHints(h.orderBys, hintOrderByModifiers))
+}
+
+func constructHints(constructs []sourceConstruct, key string) []string {
+	values := make([]string, len(constructs))
+	for i, construct := range constructs {
+		values[i] = construct.hints[key]
+	}
+
+	return values
+}
+
+func TestSourceHintMismatchWarning(t *testing.T) {
+	var warnings []error
+	root, err := ParseWithOptions("SELECT DISTINCT a FROM t", unionLines(), ParseOptions{
+		Warn: func(err error) { warnings = append(warnings, err) },
+	})
+	assert.NoError(t, err)
+
+	var mismatch *HintMismatchError
+	assert.NotEmpty(t, warnings)
+	assert.ErrorAs(t, warnings[0], &mismatch)
+	assert.Equal(t, "SelectQuery", mismatch.NodeType)
+	assert.Equal(t, 2, mismatch.Nodes)
+	assert.Equal(t, 1, mismatch.Found)
+	assert.Empty(t, nodesOfTypes(root, "SelectQuery")[0].Hints)
+
+	// Hints are only matched once, when the tree is parsed, and Format won't guess at
+	// the ones that couldn't be.
+	count := len(warnings)
+	_, err = Format(root)
+	assert.ErrorAs(t, err, &mismatch)
+	assert.Equal(t, "SelectQuery", mismatch.NodeType)
+	assert.Len(t, warnings, count)
+}
+
+func commaJoinLines() []string {
+	return []string{
+		"SelectWithUnionQuery (children 1)",
+		" ExpressionList (children 1)",
+		"  SelectQuery (children 2)",
+		"   ExpressionList (children 1)",
+		"    Identifier a",
+		"   TablesInSelectQuery (children 2)",
+		"    TablesInSelectQueryElement (children 1)",
+		"     TableExpression (children 1)",
+		"      TableIdentifier t1",
+		"    TablesInSelectQueryElement (children 2)",
+		"     TableJoin",
+		"     TableExpression (children 1)",
+		"      TableIdentifier t2 (alias x)",
+	}
+}
+
+func TestSourceHintsMustMatchTheirNodes(t *testing.T) {
+	parse := func(query string, lines []string) (*AstNode, []error) {
+		var warnings []error
+		root, err := ParseWithOptions(query, lines, ParseOptions{Warn: func(err error) { warnings = append(warnings, err) }})
+		assert.NoError(t, err)
+		return root, warnings
+	}
+
+	root, warnings := parse("SELECT a FROM t1, t2 x FINAL", commaJoinLines())
+	assert.Empty(t, warnings)
+	assert.Equal(t, ",", nodesOfTypes(root, "TableJoin")[0].Hints[hintJoin])
+	assert.Equal(t, "FINAL", nodesOfTypes(root, "TableIdentifier")[1].Hints[hintFinal])
+
+	// A join with ON can't be the TableJoin without a condition.
+	root, warnings = parse("SELECT a FROM t1 JOIN t2 x ON a", commaJoinLines())
+	var mismatch *HintMismatchError
+	assert.Len(t, warnings, 1)
+	assert.ErrorAs(t, warnings[0], &mismatch)
+	assert.Equal(t, "TableJoin", mismatch.NodeType)
+	assert.Equal(t, 11, mismatch.Line)
+	assert.Nil(t, nodesOfTypes(root, "TableJoin")[0].Hints)
+
+	// FINAL has to follow a table with the same name and alias.
+	root, warnings = parse("SELECT a FROM t1, t2 AS y FINAL", commaJoinLines())
+	assert.Len(t, warnings, 1)
+	assert.ErrorAs(t, warnings[0], &mismatch)
+	assert.Equal(t, "TableIdentifier", mismatch.NodeType)
+	assert.Empty(t, nodesOfTypes(root, "TableIdentifier")[1].Hints[hintFinal])
+
+	orderByLines := []string{
+		"SelectWithUnionQuery (children 1)",
+		" ExpressionList (children 1)",
+		"  SelectQuery (children 2)",
+		"   ExpressionList (children 1)",
+		"    Identifier d",
+		"   ExpressionList (children 1)",
+		"    OrderByElement (children 3)",
+		"     Identifier d",
+		"     Literal UInt64_1",
+		"     Literal UInt64_2",
+	}
+
+	root, warnings = parse("SELECT d ORDER BY d DESC WITH FILL FROM 1 STEP 2", orderByLines)
+	assert.Empty(t, warnings)
+	options := DefaultFormatOptions()
+	options.KeywordCase = KeywordCaseLower
+	sql, err := FormatWithOptions(root, options)
+	assert.NoError(t, err)
+	assert.Equal(t, "select\n    d\norder by d desc with fill from 1 step 2", sql)
+
+	// The element has a child for STEP that the source query doesn't have.
+	_, warnings = parse("SELECT d ORDER BY d WITH FILL FROM 1", orderByLines)
+	assert.Len(t, warnings, 1)
+	assert.ErrorAs(t, warnings[0], &mismatch)
+	assert.Equal(t, "OrderByElement", mismatch.NodeType)
+
+	// Only single token values are copied into SETTINGS hints.
+	root, warnings = parse("SELECT 1 SETTINGS a = [1]", []string{
+		"SelectWithUnionQuery (children 1)",
+		" ExpressionList (children 1)",
+		"  SelectQuery (children 2)",
+		"   ExpressionList (children 1)",
+		"    Literal UInt64_1",
+		"   Set",
+	})
+	assert.Len(t, warnings, 1)
+	assert.ErrorAs(t, warnings[0], &mismatch)
+	assert.Equal(t, "Set", mismatch.NodeType)
+	assert.Empty(t, nodesOfTypes(root, "Set")[0].Hints[hintSettings])
+}
+
+func TestFormatWithoutSourceQuery(t *testing.T) {
+	root, err := Parse("", unionLines())
+	assert.NoError(t, err)
+
+	// Join kinds, DISTINCT and UNION modes would have to be guessed.
+	_, err = Format(root)
+	assert.ErrorContains(t, err, "cannot format SelectQuery node on line 3: explain ast leaves out parts of it, parse the tree with its source query")
+}
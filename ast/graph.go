@@ -0,0 +1,424 @@
+package ast
+
+import (
+	"container/list"
+	"strings"
+)
+
+// DependencyRule names the kind of dependency an Edge was found by.
+type DependencyRule string
+
+const (
+	// RuleTable: Parent creates a table or view that Child uses.
+	RuleTable DependencyRule = "table"
+	// RuleAlter: Parent creates a table that Child alters.
+	RuleAlter DependencyRule = "alter"
+	// RuleFunction: Parent creates a function that Child calls.
+	RuleFunction DependencyRule = "function"
+	// RuleRename: Parent creates a table that Child renames.
+	RuleRename DependencyRule = "rename"
+	// RuleRenameBeforeDrop: Parent renames a table before Child drops it.
+	RuleRenameBeforeDrop DependencyRule = "rename_before_drop"
+	// RuleDrop: Parent drops a table or view that Child uses, e.g. to recreate it.
+	RuleDrop DependencyRule = "drop"
+	// RuleColumnSelect: Parent creates, adds or renames a column that Child selects.
+	RuleColumnSelect DependencyRule = "column_select"
+	// RuleColumnModify: Parent creates, adds or renames a column that Child modifies.
+	RuleColumnModify DependencyRule = "column_modify"
+	// RuleColumnComment: Parent creates, adds or renames a column that Child comments.
+	RuleColumnComment DependencyRule = "column_comment"
+	// RuleColumnMaterialize: Parent creates, adds or renames a column that Child materializes.
+	RuleColumnMaterialize DependencyRule = "column_materialize"
+	// RuleColumnRename: Parent creates or adds a column that Child renames, or renames
+	// another column to.
+	RuleColumnRename DependencyRule = "column_rename"
+	// RuleDropColumn: Parent uses or changes a column that Child drops.
+	RuleDropColumn DependencyRule = "drop_column"
+	// RuleUse: Parent is a USE statement and Child came after it, or Child is a USE
+	// statement and Parent came before it, so unqualified names keep the database
+	// they were resolved against.
+	RuleUse DependencyRule = "use"
+)
+
+// ruleDescriptions say what each rule means, for Why.
+var ruleDescriptions = map[DependencyRule]string{
+	RuleTable:             "table or view created, then referenced",
+	RuleAlter:             "table created, then altered",
+	RuleFunction:          "function created, then called",
+	RuleRename:            "table created, then renamed",
+	RuleRenameBeforeDrop:  "table renamed, then dropped",
+	RuleDrop:              "table or view dropped, then referenced",
+	RuleColumnSelect:      "column added, then selected",
+	RuleColumnModify:      "column added, then modified",
+	RuleColumnComment:     "column added, then commented",
+	RuleColumnMaterialize: "column added, then materialized",
+	RuleColumnRename:      "column added, then renamed",
+	RuleDropColumn:        "column used, then dropped",
+	RuleUse:               "database switched by USE around the statement",
+}
+
+// Reason is one rule that found an Edge, with the identifiers it matched.
+type Reason struct {
+	Rule DependencyRule
+	// Identifiers are the names of the tables, functions or columns both statements
+	// have in common, in the order found.
+	Identifiers []string
+}
+
+// String renders the reason as its rule followed by its identifiers, e.g. "table t1".
+func (r Reason) String() string {
+	return string(r.Rule) + " " + strings.Join(r.Identifiers, ", ")
+}
+
+// Edge says Parent has to run before Child.
+type Edge struct {
+	Parent *Ast
+	Child  *Ast
+	// Reasons are the rules that found the edge, in the order they were checked.
+	Reasons []Reason
+}
+
+// Rules returns the rules of the edge's Reasons.
+func (e Edge) Rules() []DependencyRule {
+	rules := make([]DependencyRule, len(e.Reasons))
+	for i, reason := range e.Reasons {
+		rules[i] = reason.Rule
+	}
+
+	return rules
+}
+
+// Graph is the dependency graph of a set of statements: statements that create,
+// drop, rename or change tables, views, functions and columns are parents of the
+// statements that use them. Each edge is kept once however many rules find it.
+type Graph struct {
+	nodes    []*Ast
+	edges    []Edge
+	edgeAt   map[[2]*Ast]int
+	parents  map[*Ast][]*Ast
+	children map[*Ast][]*Ast
+}
+
+// GraphOptions configures how NewGraphWithOptions matches statements to each other.
+type GraphOptions struct {
+	// DefaultDatabase is the database of unqualified table names until a USE
+	// statement switches to another. When it's empty, unqualified names match tables
+	// of the same name in any database until then.
+	DefaultDatabase string
+}
+
+// NewGraph works out the dependencies between asts with the default GraphOptions.
+// The asts aren't changed.
+func NewGraph(asts ...*Ast) *Graph {
+	return NewGraphWithOptions(GraphOptions{}, asts...)
+}
+
+// NewGraphWithOptions works out the dependencies between asts. Tables, views and
+// dictionaries are matched by database and name, with unqualified names resolved
+// against the database of the last USE statement before them in asts, or
+// opts.DefaultDatabase. Statements are kept between the USE statements around them
+// so they still run against that database, which makes a statement that depends on
+// one given after the next USE a cycle. Columns are matched within their table, with SELECT columns
+// resolved through the FROM and JOIN tables and their aliases. The asts aren't
+// changed.
+func NewGraphWithOptions(opts GraphOptions, asts ...*Ast) *Graph {
+	g := &Graph{
+		edgeAt:   map[[2]*Ast]int{},
+		parents:  map[*Ast][]*Ast{},
+		children: map[*Ast][]*Ast{},
+	}
+
+	seen := map[*Ast]bool{}
+	for _, ast := range asts {
+		if !seen[ast] {
+			seen[ast] = true
+			g.nodes = append(g.nodes, ast)
+		}
+	}
+
+	g.findDependencies(opts)
+
+	return g
+}
+
+func (g *Graph) findDependencies(opts GraphOptions) {
+	objects := make(map[*Ast]statementObjects, len(g.nodes))
+	database := opts.DefaultDatabase
+
+	for _, ast := range g.nodes {
+		if use, ok := useDatabase(ast); ok {
+			database = use
+		}
+		objects[ast] = objectsOf(ast, database)
+	}
+
+	for _, ast := range g.nodes {
+		created := objects[ast].created
+		createFunctionStatements := ast.CreateFunctionStatements()
+		dropped := objects[ast].dropped
+		renamed := objects[ast].renamed
+
+		columns := objects[ast]
+		createdAndAddedColumns := append(append([]ColumnName(nil), columns.createdColumns...), columns.addedColumns...)
+		originatingColumns := append(append([]ColumnName(nil), createdAndAddedColumns...), columns.renamedToColumns...)
+
+		for _, candidate := range g.nodes {
+			if candidate != ast {
+				g.addEdgeIfSharesObjects(ast, candidate, RuleTable, created, objects[candidate].referenced)
+				g.addEdgeIfSharesObjects(ast, candidate, RuleAlter, created, objects[candidate].altered)
+				g.addEdgeIfContainsAny(ast, candidate, RuleFunction, createFunctionStatements, candidate.FunctionCalls())
+				g.addEdgeIfSharesObjects(ast, candidate, RuleRename, created, objects[candidate].renamed)
+				g.addEdgeIfSharesObjects(ast, candidate, RuleDrop, dropped, objects[candidate].referenced)
+				g.addEdgeIfSharesObjects(ast, candidate, RuleRenameBeforeDrop, renamed, objects[candidate].dropped)
+
+				// Column relationships, between columns of the same table
+				other := objects[candidate]
+				g.addEdgeIfSharesColumns(ast, candidate, RuleColumnSelect, originatingColumns, other.selectedColumns)
+				g.addEdgeIfSharesColumns(ast, candidate, RuleColumnModify, originatingColumns, other.modifiedColumns)
+				g.addEdgeIfSharesColumns(ast, candidate, RuleColumnComment, originatingColumns, other.commentedColumns)
+				g.addEdgeIfSharesColumns(ast, candidate, RuleColumnMaterialize, originatingColumns, other.materializedColumns)
+				g.addEdgeIfSharesColumns(ast, candidate, RuleColumnRename, originatingColumns, other.renamedFromColumns)
+				g.addEdgeIfSharesColumns(ast, candidate, RuleColumnRename, createdAndAddedColumns, other.renamedToColumns)
+
+				// drop comes after add, modify, comment, materialize, rename
+				g.addEdgeIfSharesColumns(ast, candidate, RuleDropColumn, columns.selectedColumns, other.droppedColumns)
+				g.addEdgeIfSharesColumns(ast, candidate, RuleDropColumn, columns.addedColumns, other.droppedColumns)
+				g.addEdgeIfSharesColumns(ast, candidate, RuleDropColumn, columns.modifiedColumns, other.droppedColumns)
+				g.addEdgeIfSharesColumns(ast, candidate, RuleDropColumn, columns.commentedColumns, other.droppedColumns)
+				g.addEdgeIfSharesColumns(ast, candidate, RuleDropColumn, columns.materializedColumns, other.droppedColumns)
+				g.addEdgeIfSharesColumns(ast, candidate, RuleDropColumn, columns.renamedFromColumns, other.droppedColumns)
+				g.addEdgeIfSharesColumns(ast, candidate, RuleDropColumn, columns.renamedToColumns, other.droppedColumns)
+			}
+		}
+	}
+
+	g.addUseEdges()
+}
+
+// addUseEdges makes each USE statement a parent of the statements after it up to the
+// next USE, and those statements parents of the next USE, so sorting can't move a
+// statement to where another database is in use.
+func (g *Graph) addUseEdges() {
+	var use *Ast
+	var since []*Ast
+
+	for _, ast := range g.nodes {
+		database, ok := useDatabase(ast)
+		if !ok {
+			if use != nil {
+				name, _ := useDatabase(use)
+				g.addEdge(use, ast, RuleUse, []string{name})
+			}
+			since = append(since, ast)
+			continue
+		}
+
+		for _, previous := range since {
+			g.addEdge(previous, ast, RuleUse, []string{database})
+		}
+
+		if use != nil && len(since) == 0 {
+			name, _ := useDatabase(use)
+			g.addEdge(use, ast, RuleUse, []string{name})
+		}
+
+		use, since = ast, nil
+	}
+}
+
+func (g *Graph) addEdgeIfContainsAny(parent *Ast, child *Ast, rule DependencyRule, a []string, b []string) {
+	if shared := sharedValues(a, b); len(shared) > 0 {
+		g.addEdge(parent, child, rule, shared)
+	}
+}
+
+func (g *Graph) addEdgeIfSharesObjects(parent *Ast, child *Ast, rule DependencyRule, a []ObjectName, b []ObjectName) {
+	if shared := sharedObjects(a, b); len(shared) > 0 {
+		g.addEdge(parent, child, rule, shared)
+	}
+}
+
+func (g *Graph) addEdgeIfSharesColumns(parent *Ast, child *Ast, rule DependencyRule, a []ColumnName, b []ColumnName) {
+	if shared := sharedColumns(a, b); len(shared) > 0 {
+		g.addEdge(parent, child, rule, shared)
+	}
+}
+
+// sharedValues returns the values of a that are also in b, once each.
+func sharedValues(a []string, b []string) []string {
+	inB := make(map[string]bool, len(b))
+	for _, value := range b {
+		inB[value] = true
+	}
+
+	var shared []string
+	for _, value := range a {
+		if inB[value] {
+			shared = appendUnique(shared, value)
+		}
+	}
+
+	return shared
+}
+
+func appendUnique[T comparable](values []T, additions ...T) []T {
+	for _, addition := range additions {
+		found := false
+		for _, value := range values {
+			found = found || value == addition
+		}
+		if !found {
+			values = append(values, addition)
+		}
+	}
+
+	return values
+}
+
+func (g *Graph) addEdge(parent *Ast, child *Ast, rule DependencyRule, identifiers []string) {
+	key := [2]*Ast{parent, child}
+	i, ok := g.edgeAt[key]
+	if !ok {
+		i = len(g.edges)
+		g.edgeAt[key] = i
+		g.edges = append(g.edges, Edge{Parent: parent, Child: child})
+		g.parents[child] = append(g.parents[child], parent)
+		g.children[parent] = append(g.children[parent], child)
+	}
+
+	edge := &g.edges[i]
+	for j := range edge.Reasons {
+		if edge.Reasons[j].Rule == rule {
+			edge.Reasons[j].Identifiers = appendUnique(edge.Reasons[j].Identifiers, identifiers...)
+			return
+		}
+	}
+
+	edge.Reasons = append(edge.Reasons, Reason{Rule: rule, Identifiers: identifiers})
+}
+
+// populate sets each node's ParentAsts and DependentAsts to its edges in the graph.
+func (g *Graph) populate() {
+	for _, ast := range g.nodes {
+		ast.ParentAsts = g.Parents(ast)
+		ast.DependentAsts = g.Children(ast)
+	}
+}
+
+// Nodes returns the asts in the order they were given.
+func (g *Graph) Nodes() []*Ast { return append([]*Ast(nil), g.nodes...) }
+
+// Edges returns the edges in the order they were found.
+func (g *Graph) Edges() []Edge {
+	edges := make([]Edge, len(g.edges))
+	for i, edge := range g.edges {
+		edge.Reasons = make([]Reason, len(g.edges[i].Reasons))
+		for j, reason := range g.edges[i].Reasons {
+			reason.Identifiers = append([]string(nil), reason.Identifiers...)
+			edge.Reasons[j] = reason
+		}
+		edges[i] = edge
+	}
+
+	return edges
+}
+
+// Parents returns the asts that have to run before ast.
+func (g *Graph) Parents(ast *Ast) []*Ast { return append([]*Ast(nil), g.parents[ast]...) }
+
+// Children returns the asts that have to run after ast.
+func (g *Graph) Children(ast *Ast) []*Ast { return append([]*Ast(nil), g.children[ast]...) }
+
+// Roots returns the asts without parents.
+func (g *Graph) Roots() []*Ast {
+	var roots []*Ast
+	for _, ast := range g.nodes {
+		if len(g.parents[ast]) == 0 {
+			roots = append(roots, ast)
+		}
+	}
+
+	return roots
+}
+
+// Leaves returns the asts without children.
+func (g *Graph) Leaves() []*Ast {
+	var leaves []*Ast
+	for _, ast := range g.nodes {
+		if len(g.children[ast]) == 0 {
+			leaves = append(leaves, ast)
+		}
+	}
+
+	return leaves
+}
+
+// TopoSort returns the asts ordered so each comes after its parents. Asts without
+// parents come first in the order they were given, then each ast follows as soon as
+// its last parent has been output, so the same input always sorts the same way but
+// an ast can move ahead of ones given before it that it doesn't depend on.
+func (g *Graph) TopoSort() ([]*Ast, error) {
+	queue := list.New()
+	output := make([]*Ast, 0)
+	nodeDegrees := make(map[*Ast]int)
+
+	for _, ast := range g.nodes {
+		nodeDegrees[ast] = len(g.parents[ast])
+
+		if len(g.parents[ast]) == 0 {
+			queue.PushBack(ast)
+		}
+	}
+
+	for queue.Len() > 0 {
+		element := queue.Front()
+		queue.Remove(element)
+		ast := element.Value.(*Ast)
+
+		output = append(output, ast)
+
+		for _, dependentAst := range g.children[ast] {
+			nodeDegrees[dependentAst]--
+
+			if nodeDegrees[dependentAst] == 0 {
+				queue.PushBack(dependentAst)
+			}
+		}
+	}
+
+	if len(output) != len(g.nodes) {
+		return []*Ast{}, &CycleError{Cycles: g.cycles()}
+	}
+
+	return output, nil
+}
+
+// Levels groups the asts by how many statements have to run before them: roots are
+// in the first level and every other ast is one level below its deepest parent, so
+// the asts in a level only depend on earlier levels.
+func (g *Graph) Levels() ([][]*Ast, error) {
+	sorted, err := g.TopoSort()
+	if err != nil {
+		return nil, err
+	}
+
+	var levels [][]*Ast
+	depths := map[*Ast]int{}
+
+	for _, ast := range sorted {
+		depth := 0
+		for _, parent := range g.parents[ast] {
+			if depths[parent]+1 > depth {
+				depth = depths[parent] + 1
+			}
+		}
+
+		depths[ast] = depth
+		if depth == len(levels) {
+			levels = append(levels, nil)
+		}
+		levels[depth] = append(levels[depth], ast)
+	}
+
+	return levels, nil
+}
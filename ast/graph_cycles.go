@@ -0,0 +1,151 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Cycle is a group of statements that each depend, directly or not, on all the others,
+// which is a strongly connected component of a Graph.
+type Cycle struct {
+	// Statements are in the order they were given to the Graph.
+	Statements []*Ast
+	// Edges are the edges between the statements.
+	Edges []Edge
+}
+
+// CycleError is returned when statements can't be sorted because some depend on
+// each other. It lists every cycle.
+type CycleError struct {
+	Cycles []Cycle
+}
+
+// The most characters of a query shown to describe its statement.
+const snippetLength = 80
+
+func (e *CycleError) Error() string {
+	var sb strings.Builder
+
+	groups := "group"
+	if len(e.Cycles) != 1 {
+		groups += "s"
+	}
+	fmt.Fprintf(&sb, "circular dependency detected in %d %s of statements", len(e.Cycles), groups)
+
+	for i, cycle := range e.Cycles {
+		fmt.Fprintf(&sb, "\ncycle %d:", i+1)
+
+		numbers := map[*Ast]int{}
+		for j, statement := range cycle.Statements {
+			numbers[statement] = j + 1
+			fmt.Fprintf(&sb, "\n  [%d] %s", j+1, describeStatement(statement))
+		}
+
+		for _, edge := range cycle.Edges {
+			fmt.Fprintf(&sb, "\n  [%d] -> [%d] %s", numbers[edge.Parent], numbers[edge.Child], edgeReasons(edge))
+		}
+	}
+
+	return sb.String()
+}
+
+// describeStatement labels a statement with its source file, if known, and the start
+// of its query.
+func describeStatement(a *Ast) string {
+	return describeNode(a) + ": " + querySnippet(a.Query)
+}
+
+// querySnippet puts query on one line, cut down to snippetLength characters.
+func querySnippet(query string) string {
+	snippet := []rune(strings.Join(strings.Fields(stripSqlComments(query)), " "))
+	if len(snippet) > snippetLength {
+		return string(snippet[:snippetLength-3]) + "..."
+	}
+
+	return string(snippet)
+}
+
+// cycles finds the strongly connected components of more than one statement with
+// Tarjan's algorithm, ordered by their first statement.
+func (g *Graph) cycles() []Cycle {
+	index := map[*Ast]int{}
+	lowLink := map[*Ast]int{}
+	onStack := map[*Ast]bool{}
+	var stack []*Ast
+	component := map[*Ast]int{}
+	components := 0
+
+	var connect func(ast *Ast)
+	connect = func(ast *Ast) {
+		index[ast] = len(index)
+		lowLink[ast] = index[ast]
+		stack = append(stack, ast)
+		onStack[ast] = true
+
+		for _, child := range g.children[ast] {
+			if _, visited := index[child]; !visited {
+				connect(child)
+				if lowLink[child] < lowLink[ast] {
+					lowLink[ast] = lowLink[child]
+				}
+			} else if onStack[child] && index[child] < lowLink[ast] {
+				lowLink[ast] = index[child]
+			}
+		}
+
+		if lowLink[ast] != index[ast] {
+			return
+		}
+
+		for {
+			member := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[member] = false
+			component[member] = components
+
+			if member == ast {
+				break
+			}
+		}
+		components++
+	}
+
+	for _, ast := range g.nodes {
+		if _, visited := index[ast]; !visited {
+			connect(ast)
+		}
+	}
+
+	sizes := make([]int, components)
+	for _, id := range component {
+		sizes[id]++
+	}
+
+	var cycles []Cycle
+	cycleAt := map[int]int{}
+
+	for _, ast := range g.nodes {
+		id := component[ast]
+		if sizes[id] < 2 {
+			continue
+		}
+
+		if _, ok := cycleAt[id]; !ok {
+			cycleAt[id] = len(cycles)
+			cycles = append(cycles, Cycle{})
+		}
+
+		cycle := &cycles[cycleAt[id]]
+		cycle.Statements = append(cycle.Statements, ast)
+	}
+
+	for _, edge := range g.Edges() {
+		id := component[edge.Parent]
+		if sizes[id] >= 2 && component[edge.Child] == id {
+			cycle := &cycles[cycleAt[id]]
+			cycle.Edges = append(cycle.Edges, edge)
+		}
+	}
+
+	return cycles
+}
@@ -0,0 +1,175 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Edge colours by the first rule that found the edge, shared by DOT and Mermaid.
+var ruleColors = map[DependencyRule]string{
+	RuleTable:             "#1f77b4",
+	RuleAlter:             "#ff7f0e",
+	RuleFunction:          "#2ca02c",
+	RuleRename:            "#9467bd",
+	RuleRenameBeforeDrop:  "#e377c2",
+	RuleDrop:              "#d62728",
+	RuleColumnSelect:      "#17becf",
+	RuleColumnModify:      "#bcbd22",
+	RuleColumnComment:     "#7f7f7f",
+	RuleColumnMaterialize: "#aec7e8",
+	RuleColumnRename:      "#c5b0d5",
+	RuleDropColumn:        "#8c564b",
+	RuleUse:               "#c49c94",
+}
+
+// Statement kinds by root node type, for the ones that don't need a closer look.
+var statementKinds = map[string]string{
+	"CreateFunctionQuery":  "CREATE FUNCTION",
+	"AlterQuery":           "ALTER TABLE",
+	"DropQuery":            "DROP",
+	"TruncateQuery":        "TRUNCATE",
+	"Rename":               "RENAME",
+	"InsertQuery":          "INSERT",
+	"SelectWithUnionQuery": "SELECT",
+}
+
+// StatementLabel describes a statement by its kind and the object it works on, e.g.
+// "CREATE MATERIALIZED VIEW db.mv" or "ALTER TABLE t".
+func StatementLabel(a *Ast) string {
+	if a.Root == nil {
+		return "empty statement"
+	}
+
+	root := a.Root
+	kind, ok := statementKinds[root.Type]
+	if !ok {
+		kind = root.Type
+	}
+
+	if root.Type == "CreateQuery" {
+		kind = createKind(root)
+	}
+
+	var name string
+	switch {
+	case root.Type == "TruncateQuery" && len(root.Children) > 0:
+		name = root.Children[0].Value
+	case root.Type == "Rename":
+		var names []string
+		for _, child := range root.Children {
+			if child.Type == "Identifier" {
+				names = append(names, child.Value)
+			}
+		}
+		name = strings.Join(names, " TO ")
+	case tableLevelTypes[root.Type] || root.Type == "CreateFunctionQuery":
+		name = root.Value
+		if root.ValueQualifier != "" {
+			name = root.ValueQualifier + "." + name
+		}
+	}
+
+	if name == "" {
+		return kind
+	}
+
+	return kind + " " + name
+}
+
+// createKind returns what a CreateQuery creates, e.g. "CREATE VIEW", preferring the
+// keywords in the source query.
+func createKind(root *AstNode) string {
+	if hint := root.Hints[hintCreate]; hint != "" {
+		hint = strings.Replace(hint, " OR REPLACE", "", 1)
+		return strings.TrimSuffix(hint, " IF NOT EXISTS")
+	}
+
+	create, _ := AsCreateQuery(root)
+	switch {
+	case create.Select() != nil && (create.Storage() != nil || create.To() != ""):
+		return "CREATE MATERIALIZED VIEW"
+	case create.Select() != nil:
+		return "CREATE VIEW"
+	case create.Node.firstChildOfType("Columns") != nil || create.Storage() != nil:
+		return "CREATE TABLE"
+	}
+
+	return "CREATE"
+}
+
+// edgeLabel joins an edge's rules, e.g. "table, column_select".
+func edgeLabel(edge Edge) string {
+	var rules []string
+	for _, rule := range edge.Rules() {
+		rules = append(rules, string(rule))
+	}
+
+	return strings.Join(rules, ", ")
+}
+
+// nodeIDs names each node n0, n1, ... in the order they were given.
+func (g *Graph) nodeIDs() map[*Ast]string {
+	ids := make(map[*Ast]string, len(g.nodes))
+	for i, ast := range g.nodes {
+		ids[ast] = fmt.Sprintf("n%d", i)
+	}
+
+	return ids
+}
+
+// DOT renders the graph in Graphviz's DOT language. Nodes are labelled with
+// StatementLabel and edges with their rules, coloured by the first one.
+func (g *Graph) DOT() string {
+	var sb strings.Builder
+	ids := g.nodeIDs()
+
+	sb.WriteString("digraph dependencies {\n")
+	sb.WriteString("  node [shape=box];\n")
+
+	for _, ast := range g.nodes {
+		fmt.Fprintf(&sb, "  %s [label=%s];\n", ids[ast], dotString(StatementLabel(ast)))
+	}
+
+	for _, edge := range g.edges {
+		fmt.Fprintf(&sb, "  %s -> %s [label=%s, color=%s];\n",
+			ids[edge.Parent], ids[edge.Child], dotString(edgeLabel(edge)), dotString(ruleColors[edge.Reasons[0].Rule]))
+	}
+
+	sb.WriteString("}\n")
+
+	return sb.String()
+}
+
+// dotString quotes s as a DOT string.
+func dotString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// Mermaid renders the graph as a Mermaid flowchart. Nodes are labelled with
+// StatementLabel and edges with their rules, coloured by the first one.
+func (g *Graph) Mermaid() string {
+	var sb strings.Builder
+	ids := g.nodeIDs()
+
+	sb.WriteString("flowchart TD\n")
+
+	for _, ast := range g.nodes {
+		fmt.Fprintf(&sb, "  %s[%s]\n", ids[ast], mermaidString(StatementLabel(ast)))
+	}
+
+	for _, edge := range g.edges {
+		fmt.Fprintf(&sb, "  %s -->|%s| %s\n", ids[edge.Parent], mermaidString(edgeLabel(edge)), ids[edge.Child])
+	}
+
+	for i, edge := range g.edges {
+		fmt.Fprintf(&sb, "  linkStyle %d stroke:%s\n", i, ruleColors[edge.Reasons[0].Rule])
+	}
+
+	return sb.String()
+}
+
+// mermaidString quotes s as Mermaid label text, escaping the characters that would
+// end it.
+func mermaidString(s string) string {
+	return `"` + strings.NewReplacer(`"`, "#quot;", "|", "#124;", "\n", " ").Replace(s) + `"`
+}
@@ -0,0 +1,273 @@
+package ast
+
+// ObjectName identifies a table, view or dictionary by its database and name. An
+// empty Database stands for whichever database the name was used in.
+type ObjectName struct {
+	Database string
+	Name     string
+}
+
+func (o ObjectName) String() string {
+	if o.Database == "" {
+		return o.Name
+	}
+
+	return o.Database + "." + o.Name
+}
+
+// matches reports whether the two names could be the same object: their names are
+// equal and so are their databases, unless either database is unknown.
+func (o ObjectName) matches(other ObjectName) bool {
+	return o.Name == other.Name && (o.Database == "" || other.Database == "" || o.Database == other.Database)
+}
+
+// ColumnName identifies a column by the table it belongs to. An empty Table.Name
+// stands for a column whose table couldn't be worked out, which could be in any table.
+type ColumnName struct {
+	Table  ObjectName
+	Column string
+}
+
+func (c ColumnName) String() string {
+	if c.Table.Name == "" {
+		return c.Column
+	}
+
+	return c.Table.String() + "." + c.Column
+}
+
+// matches reports whether the two names could be the same column.
+func (c ColumnName) matches(other ColumnName) bool {
+	return c.Column == other.Column && (c.Table.Name == "" || other.Table.Name == "" || c.Table.matches(other.Table))
+}
+
+// statementObjects are the objects a statement creates, uses and changes, resolved
+// against the database it runs in.
+type statementObjects struct {
+	created    []ObjectName
+	referenced []ObjectName
+	altered    []ObjectName
+	dropped    []ObjectName
+	renamed    []ObjectName
+
+	createdColumns      []ColumnName
+	addedColumns        []ColumnName
+	selectedColumns     []ColumnName
+	modifiedColumns     []ColumnName
+	commentedColumns    []ColumnName
+	materializedColumns []ColumnName
+	renamedFromColumns  []ColumnName
+	renamedToColumns    []ColumnName
+	droppedColumns      []ColumnName
+}
+
+// objectsOf finds the objects a statement works on, qualifying unqualified names with
+// database. These are the qualified versions of CreateTableAndViewStatements,
+// TableAndViewIdentifiers, AlterQueryStatements, DropTableOrViewStatements and
+// RenameIdentifiers, except that table aliases aren't counted as references, and of
+// the column identifier methods with each column resolved to its table.
+func objectsOf(a *Ast, database string) statementObjects {
+	var objects statementObjects
+
+	qualified := func(node *AstNode) ObjectName {
+		if node.ValueQualifier != "" {
+			return ObjectName{Database: node.ValueQualifier, Name: node.Value}
+		}
+
+		return ObjectName{Database: database, Name: node.Value}
+	}
+
+	switch a.Root.Type {
+	case "CreateQuery":
+		if tableDatabase, table, ok := createTableAsTable(a.Query); ok {
+			name := ObjectName{Database: tableDatabase, Name: table}
+			if name.Database == "" {
+				name.Database = database
+			}
+			objects.referenced = append(objects.referenced, name)
+		}
+	case "TruncateQuery":
+		objects.referenced = append(objects.referenced, qualified(a.Root.Children[0]))
+	}
+
+	a.Root.Walk(func(node *AstNode) {
+		switch node.Type {
+		case "CreateQuery":
+			table := qualified(node)
+			objects.created = append(objects.created, table)
+
+			create, _ := AsCreateQuery(node)
+			for _, column := range create.Columns() {
+				objects.createdColumns = append(objects.createdColumns, ColumnName{Table: table, Column: column.Name()})
+			}
+		case "AlterCommand":
+			objects.addAlterColumns(node, qualified)
+		case "Identifier":
+			if node.descendentOf("SelectQuery") && !node.parentIsType("SelectQuery") {
+				objects.selectedColumns = append(objects.selectedColumns, selectedColumns(node, qualified)...)
+			}
+		case "TableIdentifier":
+			objects.referenced = append(objects.referenced, qualified(node))
+		case "AlterQuery":
+			objects.altered = append(objects.altered, qualified(node))
+		case "DropQuery":
+			objects.dropped = append(objects.dropped, qualified(node))
+		case "Rename":
+			for _, child := range node.Children {
+				if child.Type == "Identifier" {
+					objects.renamed = append(objects.renamed, qualified(child))
+				}
+			}
+		}
+	})
+
+	return objects
+}
+
+// addAlterColumns adds the columns an AlterCommand node changes, which belong to
+// the table being altered.
+func (objects *statementObjects) addAlterColumns(node *AstNode, qualified func(node *AstNode) ObjectName) {
+	alter := node.nearestParentOfType("AlterQuery")
+	if alter == nil {
+		return
+	}
+
+	table := qualified(alter)
+	columns := func(nodeType string) []ColumnName {
+		var names []ColumnName
+		for _, child := range node.childrenOfType(nodeType) {
+			names = append(names, ColumnName{Table: table, Column: child.Value})
+		}
+		return names
+	}
+
+	command, _ := AsAlterCommand(node)
+
+	// alter table clear column also uses drop column as the command type
+	switch command.Kind() {
+	case "ADD_COLUMN":
+		objects.addedColumns = append(objects.addedColumns, columns("ColumnDeclaration")...)
+	case "MODIFY_COLUMN":
+		objects.modifiedColumns = append(objects.modifiedColumns, columns("ColumnDeclaration")...)
+	case "COMMENT_COLUMN":
+		objects.commentedColumns = append(objects.commentedColumns, columns("Identifier")...)
+	case "MATERIALIZE_COLUMN":
+		objects.materializedColumns = append(objects.materializedColumns, columns("Identifier")...)
+	case "DROP_COLUMN":
+		objects.droppedColumns = append(objects.droppedColumns, columns("Identifier")...)
+	case "RENAME_COLUMN":
+		if len(command.Identifiers()) == 2 {
+			objects.renamedFromColumns = append(objects.renamedFromColumns, ColumnName{Table: table, Column: command.ColumnName()})
+			objects.renamedToColumns = append(objects.renamedToColumns, ColumnName{Table: table, Column: command.RenameTo()})
+		}
+	}
+}
+
+// scopeTable is a table a SELECT reads from, with the alias it's read under.
+type scopeTable struct {
+	name  ObjectName
+	alias string
+}
+
+// selectedColumns resolves a column Identifier in a SELECT to the columns it could
+// be. A qualifier picks the table with that alias or name out of the nearest SELECT's
+// FROM and JOIN tables. Otherwise, or when the qualifier isn't a table and so names
+// a subcolumn, the column could be in any of those tables, or in any table at all
+// when none of them are plain tables.
+func selectedColumns(node *AstNode, qualified func(node *AstNode) ObjectName) []ColumnName {
+	var tables []scopeTable
+
+	query, _ := AsSelectQuery(node.nearestParentOfType("SelectQuery"))
+	for _, element := range query.Tables() {
+		expression, ok := AsTableExpression(element.firstChildOfType("TableExpression"))
+		if !ok || expression.Table() == nil {
+			continue
+		}
+
+		tables = append(tables, scopeTable{name: qualified(expression.Table()), alias: expression.Alias()})
+	}
+
+	names := []string{node.Value}
+	if len(node.Path.Parts) > 0 {
+		names = make([]string, len(node.Path.Parts))
+		for i, part := range node.Path.Parts {
+			names[i] = part.Name
+		}
+	}
+
+	for _, table := range tables {
+		switch {
+		case len(names) > 2 && table.name.matches(ObjectName{Database: names[0], Name: names[1]}):
+			return []ColumnName{{Table: table.name, Column: names[2]}}
+		case len(names) > 1 && (table.alias == names[0] || table.name.Name == names[0]):
+			return []ColumnName{{Table: table.name, Column: names[1]}}
+		}
+	}
+
+	if len(tables) == 0 {
+		return []ColumnName{{Column: names[0]}}
+	}
+
+	columns := make([]ColumnName, len(tables))
+	for i, table := range tables {
+		columns[i] = ColumnName{Table: table.name, Column: names[0]}
+	}
+
+	return columns
+}
+
+// sharedColumns returns the columns in a that match columns in b, once each, using
+// whichever of the two is resolved.
+func sharedColumns(a []ColumnName, b []ColumnName) []string {
+	var shared []string
+
+	for _, x := range a {
+		for _, y := range b {
+			if !x.matches(y) {
+				continue
+			}
+
+			if x.Table.Name == "" || x.Table.Database == "" && y.Table.Name != "" {
+				x = y
+			}
+			shared = appendUnique(shared, x.String())
+		}
+	}
+
+	return shared
+}
+
+// sharedObjects returns the names in a that match names in b, once each, using
+// whichever of the two is qualified.
+func sharedObjects(a []ObjectName, b []ObjectName) []string {
+	var shared []string
+
+	for _, x := range a {
+		for _, y := range b {
+			if !x.matches(y) {
+				continue
+			}
+
+			if x.Database == "" {
+				x = y
+			}
+			shared = appendUnique(shared, x.String())
+		}
+	}
+
+	return shared
+}
+
+// useDatabase returns the database a USE statement switches to, if a is one.
+func useDatabase(a *Ast) (string, bool) {
+	if a.Root == nil || a.Root.Type != "UseQuery" {
+		return "", false
+	}
+
+	parts, err := splitIdentifier(a.Root.Value)
+	if err != nil || len(parts) != 1 {
+		return a.Root.Value, true
+	}
+
+	return parts[0].Name, true
+}
@@ -0,0 +1,293 @@
+package ast
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraph(t *testing.T) {
+	query, _ := NewFromExplainLines("query func", astLines())
+	function, _ := NewFromExplainLines("create func", createFunctionAstLines())
+	view, _ := NewFromExplainLines("create table/view/materialized view", createQueryAstLines())
+
+	graph := NewGraph(query, function, view, query)
+
+	assert.Nil(t, query.ParentAsts, "building a graph doesn't change the asts")
+	assert.Equal(t, []*Ast{query, function, view}, graph.Nodes())
+	assert.Equal(t, []Edge{
+		{Parent: function, Child: query, Reasons: []Reason{{Rule: RuleFunction, Identifiers: []string{"z"}}}},
+		{Parent: view, Child: query, Reasons: []Reason{{Rule: RuleTable, Identifiers: []string{"my_table_or_view"}}}},
+	}, graph.Edges())
+	assert.Equal(t, []*Ast{function, view}, graph.Parents(query))
+	assert.Equal(t, []*Ast{query}, graph.Children(view))
+	assert.Equal(t, []*Ast{function, view}, graph.Roots())
+	assert.Equal(t, []*Ast{query}, graph.Leaves())
+
+	sorted, err := graph.TopoSort()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Ast{function, view, query}, sorted)
+
+	levels, err := graph.Levels()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]*Ast{{function, view}, {query}}, levels)
+
+	for i := 0; i < 2; i++ {
+		_, err = PopulateAndSort(query, function, view)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []*Ast{function, view}, query.ParentAsts, "populating twice doesn't duplicate edges")
+	assert.Equal(t, []*Ast{query}, function.DependentAsts)
+}
+
+func viewLines(name string, from string) []string {
+	return []string{
+		"CreateQuery  " + name + " (children 2)",
+		" Identifier " + name,
+		" SelectWithUnionQuery (children 1)",
+		"  ExpressionList (children 1)",
+		"   SelectQuery (children 2)",
+		"    ExpressionList (children 1)",
+		"     Asterisk",
+		"    TablesInSelectQuery (children 1)",
+		"     TablesInSelectQueryElement (children 1)",
+		"      TableExpression (children 1)",
+		"       TableIdentifier " + from,
+	}
+}
+
+func TestTopoSortOrder(t *testing.T) {
+	a, _ := NewFromExplainLines("create view a as select * from x", viewLines("a", "x"))
+	d, _ := NewFromExplainLines("create view d as select * from a", viewLines("d", "a"))
+	b, _ := NewFromExplainLines("create view b as select * from y", viewLines("b", "y"))
+
+	// d follows its parent rather than keeping its place ahead of b.
+	sorted, err := NewGraph(a, d, b).TopoSort()
+	assert.NoError(t, err)
+	assert.Equal(t, []*Ast{a, b, d}, sorted)
+}
+
+func TestGraphCycle(t *testing.T) {
+	a, _ := NewFromExplainLines("create view a as select * from b", viewLines("a", "b"))
+	b, _ := NewFromExplainLines("create view b as select * from a", viewLines("b", "a"))
+	c, _ := NewFromExplainLines("create view c as select * from a", viewLines("c", "a"))
+	d, _ := NewFromExplainLines("create view d\n  as select *\n  from e -- the other half of the second cycle", viewLines("d", "e"))
+	e, _ := NewFromExplainLines("create view e as select * from d", viewLines("e", "d"))
+	a.SourceFile = "views/a.sql"
+
+	graph := NewGraph(a, b, c)
+	assert.Equal(t, []*Ast{b, c}, graph.Children(a))
+	assert.Empty(t, graph.Roots())
+	assert.Equal(t, []*Ast{c}, graph.Leaves())
+
+	_, err := graph.TopoSort()
+	assert.ErrorContains(t, err, "circular dependency detected")
+
+	_, err = graph.Levels()
+	assert.ErrorContains(t, err, "circular dependency detected")
+
+	_, err = PopulateAndSort(d, a, b, c, e)
+
+	var cycleErr *CycleError
+	assert.ErrorAs(t, err, &cycleErr)
+	assert.Len(t, cycleErr.Cycles, 2)
+	assert.Equal(t, []*Ast{d, e}, cycleErr.Cycles[0].Statements)
+	assert.Equal(t, []*Ast{a, b}, cycleErr.Cycles[1].Statements)
+	assert.Equal(t, []string{"a"}, cycleErr.Cycles[1].Edges[0].Reasons[0].Identifiers)
+
+	assert.Equal(t, `circular dependency detected in 2 groups of statements
+cycle 1:
+  [1] CREATE VIEW d: create view d as select * from e -- the other half of the second cycle
+  [2] CREATE VIEW e: create view e as select * from d
+  [1] -> [2] table d
+  [2] -> [1] table e
+cycle 2:
+  [1] CREATE VIEW a (views/a.sql): create view a as select * from b
+  [2] CREATE VIEW b: create view b as select * from a
+  [1] -> [2] table a
+  [2] -> [1] table b`, err.Error())
+
+	assert.Equal(t, "select 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20,...",
+		querySnippet("select 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22"))
+}
+
+func TestGraphExport(t *testing.T) {
+	query, _ := NewFromExplainLines("select z(), * from my_table_or_view", astLines())
+	function, _ := NewFromExplainLines("create function z as () -> true", createFunctionAstLines())
+	table, _ := NewFromExplainLines("create or replace table my_table_or_view as select * from z", createQueryAstLines())
+	view, _ := NewFromExplainLines("create view \"v\" as select * from my_table_or_view", viewLines("\"v\"", "my_table_or_view"))
+
+	graph := NewGraph(query, function, table, view)
+
+	assert.Equal(t, "CREATE TABLE my_table_or_view", StatementLabel(table))
+	assert.Equal(t, "CREATE VIEW v", StatementLabel(view))
+
+	assert.Equal(t, `digraph dependencies {
+  node [shape=box];
+  n0 [label="SELECT"];
+  n1 [label="CREATE FUNCTION z"];
+  n2 [label="CREATE TABLE my_table_or_view"];
+  n3 [label="CREATE VIEW v"];
+  n1 -> n0 [label="function", color="#2ca02c"];
+  n2 -> n0 [label="table", color="#1f77b4"];
+  n2 -> n3 [label="table", color="#1f77b4"];
+}
+`, graph.DOT())
+
+	assert.Equal(t, `flowchart TD
+  n0["SELECT"]
+  n1["CREATE FUNCTION z"]
+  n2["CREATE TABLE my_table_or_view"]
+  n3["CREATE VIEW v"]
+  n1 -->|"function"| n0
+  n2 -->|"table"| n0
+  n2 -->|"table"| n3
+  linkStyle 0 stroke:#2ca02c
+  linkStyle 1 stroke:#1f77b4
+  linkStyle 2 stroke:#1f77b4
+`, graph.Mermaid())
+
+	create, _ := NewFromExplainLines("", viewLines("mv", "t"))
+	storage := &AstNode{Type: "Storage"}
+	assert.NoError(t, create.Root.AppendChild(storage))
+	assert.Equal(t, "CREATE MATERIALIZED VIEW mv", StatementLabel(create))
+	assert.Equal(t, `"say \"hi\"\n"`, dotString("say \"hi\"\n"))
+	assert.Equal(t, `"a #quot;b#quot; #124; c"`, mermaidString(`a "b" | c`))
+}
+
+func TestGraphWhy(t *testing.T) {
+	table, _ := NewFromExplainLines("create table my_table_or_view as select * from z", createQueryAstLines())
+	view, _ := NewFromExplainLines("create view v as select * from my_table_or_view", viewLines("v", "my_table_or_view"))
+	other, _ := NewFromExplainLines("create view w as select * from v", viewLines("w", "v"))
+	table.SourceFile = "tables/my_table_or_view.sql"
+
+	graph := NewGraph(other, view, table)
+
+	path := graph.Why(table, other)
+	assert.Len(t, path, 2)
+	assert.Equal(t, []DependencyRule{RuleTable}, path[0].Rules())
+	assert.Equal(t, `CREATE TABLE my_table_or_view (tables/my_table_or_view.sql) -> CREATE VIEW v
+  table my_table_or_view: table or view created, then referenced
+CREATE VIEW v -> CREATE VIEW w
+  table v: table or view created, then referenced
+`, FormatWhy(path))
+
+	assert.Nil(t, graph.Why(other, table))
+	assert.Nil(t, graph.Why(table, table))
+	assert.Equal(t, "no dependency\n", FormatWhy(nil))
+}
+
+func qualifiedViewLines(database string, name string, from string) []string {
+	lines := viewLines(name, from)
+	lines[0] = "CreateQuery " + database + " " + name + " (children 2)"
+
+	return lines
+}
+
+func TestGraphDatabases(t *testing.T) {
+	events1, _ := NewFromExplainLines("create view db1.events as select * from src", qualifiedViewLines("db1", "events", "src"))
+	events2, _ := NewFromExplainLines("create view db2.events as select * from src", qualifiedViewLines("db2", "events", "src"))
+	qualified, _ := NewFromExplainLines("create view db1.w as select * from db1.events", qualifiedViewLines("db1", "w", "db1.events"))
+	unqualified, _ := NewFromExplainLines("create view v as select * from events", viewLines("v", "events"))
+	use, _ := NewFromExplainLines("use db2", []string{"UseQuery db2"})
+
+	graph := NewGraph(events1, events2, qualified, unqualified)
+	assert.Equal(t, []*Ast{events1}, graph.Parents(qualified))
+	assert.Equal(t, []*Ast{events1, events2}, graph.Parents(unqualified), "unqualified names match any database by default")
+	assert.Equal(t, []string{"db1.events"}, graph.Why(events1, unqualified)[0].Reasons[0].Identifiers)
+
+	graph = NewGraphWithOptions(GraphOptions{DefaultDatabase: "db1"}, events1, events2, qualified, unqualified)
+	assert.Equal(t, []*Ast{events1}, graph.Parents(unqualified))
+
+	graph = NewGraphWithOptions(GraphOptions{DefaultDatabase: "db1"}, events1, events2, qualified, use, unqualified)
+	assert.Equal(t, []*Ast{events2, use}, graph.Parents(unqualified), "USE switches the database of later statements")
+	assert.Equal(t, []*Ast{events1}, graph.Parents(qualified))
+	assert.Equal(t, "CREATE VIEW db1.w", StatementLabel(qualified))
+}
+
+func TestGraphUseOrder(t *testing.T) {
+	use1, _ := NewFromExplainLines("use db1", []string{"UseQuery db1"})
+	use2, _ := NewFromExplainLines("use db2", []string{"UseQuery db2"})
+	a, _ := NewFromExplainLines("create view a as select * from t", viewLines("a", "t"))
+	table, _ := NewFromExplainLines("create table t (id UInt64)", tableLines("t", "id"))
+	b, _ := NewFromExplainLines("create view b as select * from db1.a", viewLines("b", "db1.a"))
+
+	// a reads db1.t, so it has to run before the database switches to db2.
+	sorted, err := PopulateAndSort(use1, a, table, use2, b)
+	assert.NoError(t, err)
+	assert.Equal(t, []*Ast{use1, table, a, use2, b}, sorted)
+	assert.Equal(t, []Reason{{Rule: RuleUse, Identifiers: []string{"db2"}}}, NewGraph(use1, a, table, use2, b).Why(a, use2)[0].Reasons)
+
+	// A view resolved against db1 can't be created after USE db2 to wait for its table.
+	view, _ := NewFromExplainLines("create view v as select * from t", viewLines("v", "t"))
+	qualifiedTable, _ := NewFromExplainLines("create table db1.t (id UInt64)", append([]string{"CreateQuery db1 t (children 2)"}, tableLines("t", "id")[1:]...))
+
+	_, err = PopulateAndSort(use1, view, use2, qualifiedTable)
+	var cycle *CycleError
+	assert.ErrorAs(t, err, &cycle)
+}
+
+func tableLines(name string, columns ...string) []string {
+	lines := []string{
+		"CreateQuery  " + name + " (children 2)",
+		" Identifier " + name,
+		" Columns definition (children 1)",
+		"  ExpressionList (children " + fmt.Sprint(len(columns)) + ")",
+	}
+	for _, column := range columns {
+		lines = append(lines, "   ColumnDeclaration "+column+" (children 1)", "    DataType UInt64")
+	}
+
+	return lines
+}
+
+func alterColumnLines(table string, command string, column string) []string {
+	lines := []string{
+		"AlterQuery  " + table + " (children 1)",
+		" ExpressionList (children 1)",
+		"  AlterCommand " + command + " (children 1)",
+	}
+	if command == "ADD_COLUMN" {
+		return append(lines, "   ColumnDeclaration "+column+" (children 1)", "    DataType UInt64")
+	}
+
+	return append(lines, "   Identifier "+column)
+}
+
+func TestGraphColumns(t *testing.T) {
+	users, _ := NewFromExplainLines("create table users (id UInt64, name UInt64)", tableLines("users", "id", "name"))
+	events, _ := NewFromExplainLines("create table events (id UInt64)", tableLines("events", "id"))
+	addKind, _ := NewFromExplainLines("alter table events add column kind UInt64", alterColumnLines("events", "ADD_COLUMN", "kind"))
+	addName, _ := NewFromExplainLines("alter table events add column name UInt64", alterColumnLines("events", "ADD_COLUMN", "name"))
+	query, _ := NewFromExplainLines("select u.name, e.kind from users as u join events as e using id", []string{
+		"SelectWithUnionQuery (children 1)",
+		" ExpressionList (children 1)",
+		"  SelectQuery (children 2)",
+		"   ExpressionList (children 2)",
+		"    Identifier u.name",
+		"    Identifier e.kind",
+		"   TablesInSelectQuery (children 2)",
+		"    TablesInSelectQueryElement (children 1)",
+		"     TableExpression (children 1)",
+		"      TableIdentifier users (alias u)",
+		"    TablesInSelectQueryElement (children 2)",
+		"     TableJoin (children 1)",
+		"      ExpressionList (children 1)",
+		"       Identifier id",
+		"     TableExpression (children 1)",
+		"      TableIdentifier events (alias e)",
+	})
+	dropName, _ := NewFromExplainLines("alter table events drop column name", alterColumnLines("events", "DROP_COLUMN", "name"))
+
+	graph := NewGraph(users, events, addKind, addName, query, dropName)
+
+	assert.Equal(t, []*Ast{users, events, addKind}, graph.Parents(query), "u.name is the users column, not the one added to events")
+	assert.Equal(t, []Reason{
+		{Rule: RuleTable, Identifiers: []string{"users"}},
+		{Rule: RuleColumnSelect, Identifiers: []string{"users.id", "users.name"}},
+	}, graph.Why(users, query)[0].Reasons)
+	assert.Equal(t, []Reason{{Rule: RuleColumnSelect, Identifiers: []string{"events.kind"}}}, graph.Why(addKind, query)[0].Reasons)
+
+	assert.Equal(t, []*Ast{events, addName}, graph.Parents(dropName), "dropping events.name doesn't wait for selects of users.name")
+}
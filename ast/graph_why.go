@@ -0,0 +1,81 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Why returns the shortest chain of edges that makes child run after parent, starting
+// at parent, or nil if child doesn't depend on it.
+func (g *Graph) Why(parent *Ast, child *Ast) []Edge {
+	edges := g.Edges()
+	from := map[*Ast]int{}
+	queue := []*Ast{parent}
+
+	for len(queue) > 0 && queue[0] != child {
+		ast := queue[0]
+		queue = queue[1:]
+
+		for _, next := range g.children[ast] {
+			if _, seen := from[next]; !seen && next != parent {
+				from[next] = g.edgeAt[[2]*Ast{ast, next}]
+				queue = append(queue, next)
+			}
+		}
+	}
+
+	if _, found := from[child]; !found {
+		return nil
+	}
+
+	var path []Edge
+	for ast := child; ast != parent; {
+		edge := edges[from[ast]]
+		path = append([]Edge{edge}, path...)
+		ast = edge.Parent
+	}
+
+	return path
+}
+
+// FormatWhy describes a chain of edges from Why, with a line for each edge and the
+// reasons under it, e.g.
+//
+//	CREATE TABLE t1 -> CREATE VIEW v1
+//	  table t1: table or view created, then referenced
+func FormatWhy(path []Edge) string {
+	if len(path) == 0 {
+		return "no dependency\n"
+	}
+
+	var sb strings.Builder
+
+	for _, edge := range path {
+		fmt.Fprintf(&sb, "%s -> %s\n", describeNode(edge.Parent), describeNode(edge.Child))
+
+		for _, reason := range edge.Reasons {
+			fmt.Fprintf(&sb, "  %s: %s\n", reason, ruleDescriptions[reason.Rule])
+		}
+	}
+
+	return sb.String()
+}
+
+// describeNode labels a statement with its source file, if known.
+func describeNode(a *Ast) string {
+	if a.SourceFile != "" {
+		return StatementLabel(a) + " (" + a.SourceFile + ")"
+	}
+
+	return StatementLabel(a)
+}
+
+// edgeReasons renders an edge's reasons on one line, e.g. "table t1; column_select a".
+func edgeReasons(edge Edge) string {
+	reasons := make([]string, len(edge.Reasons))
+	for i, reason := range edge.Reasons {
+		reasons[i] = reason.String()
+	}
+
+	return strings.Join(reasons, "; ")
+}
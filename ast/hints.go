@@ -0,0 +1,1346 @@
+package ast
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// explain ast leaves out some of what's needed to turn a tree back into SQL: join kinds,
+// ORDER BY directions, DISTINCT, UNION modes, SETTINGS values, index names and which
+// clause an expression belongs to. Like addMaterializedViewToNode, applySourceHints
+// recovers these from the source query when the tree is parsed and stores them in
+// AstNode.Hints.
+//
+// Hints only hold keywords and the names and values explain ast drops. Expressions
+// always come from the tree, so the source query is only scanned for keywords, never
+// parsed. Each kind of construct is matched to its nodes in the order they appear and
+// has to agree with the node it lands on, e.g. a join with ON must land on a TableJoin
+// with children. When a kind can't be matched that way none of its hints are recorded,
+// and a HintMismatchError is reported in their place.
+
+const (
+	// SelectQuery, Storage and ColumnDeclaration: clause keywords present, e.g.
+	// "SELECT,FROM,WHERE,LIMIT" or "ENGINE,ORDER BY,SETTINGS".
+	hintClauses = "clauses"
+	// SelectQuery: "DISTINCT" when present.
+	hintDistinct = "distinct"
+	// SelectQuery: WITH TOTALS, WITH ROLLUP or WITH CUBE.
+	hintGroupByModifier = "group_by_modifier"
+	// SelectQuery: WITH TIES.
+	hintLimitModifier = "limit_modifier"
+	// SelectQuery: the set operator following the query, e.g. "UNION DISTINCT".
+	hintSetOperator = "set_operator"
+	// TableJoin and ArrayJoin: the join keywords, e.g. "LEFT OUTER JOIN" or ",".
+	hintJoin = "join"
+	// OrderByElement: the keywords after the expression, e.g. "DESC NULLS FIRST" or
+	// "WITH FILL FROM STEP". Each keyword in orderByOperands is followed by the next child.
+	hintOrderByModifiers = "order_by_modifiers"
+	// Set: the setting changes, e.g. "max_threads = 1, max_memory_usage = 100".
+	hintSettings = "settings"
+	// TableIdentifier: "FINAL" when present.
+	hintFinal = "final"
+	// CreateQuery and CreateFunctionQuery: the keywords before the name, e.g.
+	// "CREATE MATERIALIZED VIEW IF NOT EXISTS".
+	hintCreate = "create"
+	// CreateQuery: "POPULATE" when present.
+	hintPopulate = "populate"
+	// ColumnDeclaration: DEFAULT, MATERIALIZED, ALIAS or EPHEMERAL.
+	hintDefaultKind = "default_kind"
+	// ColumnDeclaration: NULL or NOT NULL.
+	hintNullModifier = "null_modifier"
+	// Index and Constraint: the declared name.
+	hintName = "name"
+	// Index: the GRANULARITY value.
+	hintGranularity = "granularity"
+	// Constraint: CHECK or ASSUME.
+	hintConstraintKind = "constraint_kind"
+	// TTLElement: the keywords after the expression, e.g. "DELETE WHERE" or "TO DISK".
+	// Each keyword in ttlOperands is followed by the next child.
+	hintTTLAction = "ttl_action"
+	// TTLElement: the quoted disk or volume of a TO DISK or TO VOLUME action.
+	hintTTLDestination = "ttl_destination"
+	// AlterCommand: IF EXISTS or IF NOT EXISTS.
+	hintIfExists = "if_exists"
+	// AlterCommand: "FIRST" when a column is added or moved first.
+	hintFirst = "first"
+	// AlterCommand: the keywords of a DROP, CLEAR or DETACH command, e.g. "CLEAR COLUMN"
+	// or "DETACH PARTITION", which explain ast reports as DROP_ commands alike.
+	hintDropCommand = "drop_command"
+	// Root: "true" when the statement has a treehouse:allow-lossy comment.
+	hintAllowLossy = "allow_lossy"
+)
+
+// Keywords of an ORDER BY element or TTL element that are followed by one of its children.
+var (
+	orderByOperands = map[string]bool{"COLLATE": true, "FROM": true, "TO": true, "STEP": true, "STALENESS": true}
+	ttlOperands     = map[string]bool{"WHERE": true, "RECOMPRESS": true}
+)
+
+type sqlTokenKind int
+
+const (
+	tokenWord sqlTokenKind = iota
+	tokenQuotedIdentifier
+	tokenString
+	tokenNumber
+	tokenPunctuation
+)
+
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+	// upper is the upper cased text of words, for keyword comparisons.
+	upper string
+	// depth is the bracket nesting depth, with brackets at the depth of what surrounds them.
+	depth int
+}
+
+func (t sqlToken) is(words ...string) bool {
+	if t.kind != tokenWord {
+		return false
+	}
+
+	for _, word := range words {
+		if t.upper == word {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t sqlToken) isPunctuation(text string) bool {
+	return t.kind == tokenPunctuation && t.text == text
+}
+
+func (t sqlToken) isName() bool {
+	return t.kind == tokenWord || t.kind == tokenQuotedIdentifier
+}
+
+// tokenizeSQL splits a query into words, quoted names, strings, numbers and single
+// punctuation characters, dropping whitespace and comments.
+func tokenizeSQL(query string) []sqlToken {
+	return scanSQL(query, nil)
+}
+
+// scanSQL is tokenizeSQL, passing the text of each comment to onComment if it's set.
+func scanSQL(query string, onComment func(comment string)) []sqlToken {
+	var tokens []sqlToken
+	depth := 0
+
+	isWordByte := func(c byte) bool {
+		return c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+	}
+
+	readQuoted := func(i int) int {
+		quote := query[i]
+		i++
+		for i < len(query) {
+			switch {
+			case query[i] == '\\':
+				i += 2
+			case query[i] == quote && i+1 < len(query) && query[i+1] == quote:
+				i += 2
+			case query[i] == quote:
+				return i + 1
+			default:
+				i++
+			}
+		}
+		return len(query)
+	}
+
+	for i := 0; i < len(query); {
+		c := query[i]
+		start := i
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case strings.HasPrefix(query[i:], "--") || c == '#':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			if onComment != nil {
+				onComment(query[start:i])
+			}
+			continue
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end == -1 {
+				i = len(query)
+			} else {
+				i += end + 4
+			}
+			if onComment != nil {
+				onComment(query[start:i])
+			}
+			continue
+		case c == '\'':
+			i = readQuoted(i)
+			tokens = append(tokens, sqlToken{kind: tokenString, text: query[start:i], depth: depth})
+		case c == '`' || c == '"':
+			i = readQuoted(i)
+			tokens = append(tokens, sqlToken{kind: tokenQuotedIdentifier, text: query[start:i], depth: depth})
+		case c >= '0' && c <= '9':
+			for i < len(query) && (isWordByte(query[i]) || query[i] == '.' ||
+				(query[i] == '-' || query[i] == '+') && (query[i-1] == 'e' || query[i-1] == 'E')) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{kind: tokenNumber, text: query[start:i], depth: depth})
+		case isWordByte(c):
+			for i < len(query) && isWordByte(query[i]) {
+				i++
+			}
+			text := query[start:i]
+			tokens = append(tokens, sqlToken{kind: tokenWord, text: text, upper: strings.ToUpper(text), depth: depth})
+		default:
+			i++
+
+			switch c {
+			case '(', '[', '{':
+				tokens = append(tokens, sqlToken{kind: tokenPunctuation, text: query[start:i], depth: depth})
+				depth++
+			case ')', ']', '}':
+				depth--
+				tokens = append(tokens, sqlToken{kind: tokenPunctuation, text: query[start:i], depth: depth})
+			default:
+				tokens = append(tokens, sqlToken{kind: tokenPunctuation, text: query[start:i], depth: depth})
+			}
+		}
+	}
+
+	return tokens
+}
+
+// splitTokens splits tokens on commas at depth.
+func splitTokens(tokens []sqlToken, depth int) [][]sqlToken {
+	var elements [][]sqlToken
+	start := 0
+
+	for i, token := range tokens {
+		if token.depth == depth && token.isPunctuation(",") {
+			elements = append(elements, tokens[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(elements, tokens[start:])
+}
+
+// sourceConstruct is a construct found in the source query: the hints for the node it
+// belongs to, and a check that a node is the one it was written as.
+type sourceConstruct struct {
+	hints   map[string]string
+	matches func(node *AstNode) bool
+	// position orders constructs that aren't matched in the order they're written.
+	position int
+}
+
+// sourceTable is a table reference written before FINAL.
+type sourceTable struct {
+	database, name, alias string
+}
+
+// sourceQueryHints holds the constructs found in the source query, in the order
+// they'll be matched against nodes.
+type sourceQueryHints struct {
+	tokens   []sqlToken
+	comments []string
+
+	selects       []sourceConstruct
+	joins         []sourceConstruct
+	arrayJoins    []sourceConstruct
+	orderBys      []sourceConstruct
+	settings      []sourceConstruct
+	columns       []sourceConstruct
+	indices       []sourceConstruct
+	constraints   []sourceConstruct
+	storages      []sourceConstruct
+	ttlElements   []sourceConstruct
+	alterCommands []sourceConstruct
+	finals        []sourceTable
+
+	create   string
+	populate bool
+}
+
+// Words that may precede JOIN as part of the join kind.
+var joinModifiers = map[string]bool{
+	"GLOBAL": true, "LOCAL": true, "ANY": true, "ALL": true, "ASOF": true, "SEMI": true, "ANTI": true,
+	"LEFT": true, "RIGHT": true, "FULL": true, "INNER": true, "OUTER": true, "CROSS": true, "PASTE": true,
+	"ARRAY": true,
+}
+
+// Words that end a clause of a select query.
+var clauseKeywords = map[string]bool{
+	"FROM": true, "PREWHERE": true, "WHERE": true, "GROUP": true, "HAVING": true, "WINDOW": true,
+	"QUALIFY": true, "ORDER": true, "LIMIT": true, "OFFSET": true, "SETTINGS": true, "UNION": true,
+	"EXCEPT": true, "INTERSECT": true, "FORMAT": true, "INTO": true, "ON": true, "USING": true,
+	"JOIN": true, "INTERPOLATE": true, "ROWS": true, "RANGE": true, "GROUPS": true, "FINAL": true,
+	"SAMPLE": true, "AS": true,
+}
+
+// Words that end the FROM clause of a select query.
+var fromClauseEnd = map[string]bool{
+	"PREWHERE": true, "WHERE": true, "GROUP": true, "HAVING": true, "WINDOW": true, "QUALIFY": true,
+	"ORDER": true, "LIMIT": true, "OFFSET": true, "SETTINGS": true, "UNION": true, "EXCEPT": true,
+	"INTERSECT": true, "FORMAT": true, "INTO": true,
+}
+
+// Words following WITH that make it a modifier rather than the start of a query.
+var withModifiers = map[string]bool{
+	"TOTALS": true, "TIES": true, "FILL": true, "ROLLUP": true, "CUBE": true, "CHECK": true, "NAME": true,
+}
+
+func extractSourceHints(query string) sourceQueryHints {
+	h := sourceQueryHints{}
+	h.tokens = scanSQL(query, func(comment string) { h.comments = append(h.comments, comment) })
+
+	h.findSelects()
+	h.findOrderBys()
+	h.findSettings()
+	h.findFinals()
+	h.findDDL()
+
+	// A TableJoin is visited after the table expression it joins, which may hold joins of
+	// its own, so joins are matched in the order their table expressions end.
+	sort.SliceStable(h.joins, func(i, j int) bool { return h.joins[i].position < h.joins[j].position })
+	sort.SliceStable(h.arrayJoins, func(i, j int) bool { return h.arrayJoins[i].position < h.arrayJoins[j].position })
+
+	return h
+}
+
+type selectStart struct {
+	start       int
+	selectIndex int
+}
+
+func (h *sourceQueryHints) findSelects() {
+	tokens := h.tokens
+	pendingWith := map[int]int{}
+	var starts []selectStart
+
+	for i, token := range tokens {
+		switch {
+		case token.is("WITH") && (i+1 >= len(tokens) || !withModifiers[tokens[i+1].upper]):
+			if _, ok := pendingWith[token.depth]; !ok {
+				pendingWith[token.depth] = i
+			}
+		case token.is("SELECT"):
+			start := i
+			if withIndex, ok := pendingWith[token.depth]; ok {
+				start = withIndex
+				delete(pendingWith, token.depth)
+			}
+			starts = append(starts, selectStart{start: start, selectIndex: i})
+		}
+	}
+
+	sort.SliceStable(starts, func(i, j int) bool { return starts[i].start < starts[j].start })
+
+	for _, start := range starts {
+		h.selects = append(h.selects, h.selectConstruct(start))
+	}
+}
+
+func (h *sourceQueryHints) selectConstruct(start selectStart) sourceConstruct {
+	tokens := h.tokens
+	depth := tokens[start.selectIndex].depth
+	hints := map[string]string{}
+
+	clauses := []string{}
+	if start.start != start.selectIndex {
+		clauses = append(clauses, "WITH")
+	}
+	clauses = append(clauses, "SELECT")
+
+	distinctOn := false
+	i := start.selectIndex + 1
+	if i < len(tokens) && tokens[i].is("DISTINCT") {
+		if i+1 < len(tokens) && tokens[i+1].is("ON") {
+			clauses = append(clauses, "LIMIT BY")
+			distinctOn = true
+		} else {
+			hints[hintDistinct] = "DISTINCT"
+		}
+	}
+
+	for ; i < len(tokens); i++ {
+		token := tokens[i]
+
+		if token.depth < depth || token.depth == depth && token.isPunctuation(";") {
+			break
+		}
+
+		if token.depth != depth || token.kind != tokenWord {
+			continue
+		}
+
+		next := ""
+		if i+1 < len(tokens) {
+			next = tokens[i+1].upper
+		}
+
+		switch {
+		case token.is("UNION", "EXCEPT", "INTERSECT"):
+			operator := token.upper
+			if next == "ALL" || next == "DISTINCT" {
+				operator += " " + next
+			}
+			hints[hintSetOperator] = operator
+		// FROM is also a WITH FILL keyword, so it only starts a clause straight after the
+		// select list, which DISTINCT ON's LIMIT BY stands in for.
+		case token.is("FROM") && (clauses[len(clauses)-1] == "SELECT" || clauses[len(clauses)-1] == "LIMIT BY" && distinctOn):
+			clauses = append(clauses, "FROM")
+			h.findJoins(i)
+		case token.is("PREWHERE", "WHERE", "HAVING", "WINDOW", "QUALIFY", "SETTINGS"):
+			clauses = append(clauses, token.upper)
+		case token.is("GROUP", "ORDER") && next == "BY":
+			clauses = append(clauses, token.upper+" BY")
+		case token.is("LIMIT"):
+			clauses = append(clauses, h.limitClause(i))
+		case token.is("WITH") && (next == "TOTALS" || next == "ROLLUP" || next == "CUBE"):
+			hints[hintGroupByModifier] = "WITH " + next
+		case token.is("WITH") && next == "TIES":
+			hints[hintLimitModifier] = "WITH TIES"
+		}
+
+		if _, ok := hints[hintSetOperator]; ok {
+			break
+		}
+	}
+
+	hints[hintClauses] = strings.Join(clauses, ",")
+
+	return sourceConstruct{hints: hints, matches: func(node *AstNode) bool {
+		_, ok := classifySelectChildrenWithHint(node.explainChildren(), clauses)
+		return ok
+	}}
+}
+
+// limitClause tells LIMIT n BY apart from a plain LIMIT.
+func (h *sourceQueryHints) limitClause(limitIndex int) string {
+	depth := h.tokens[limitIndex].depth
+
+	for _, token := range h.tokens[limitIndex+1:] {
+		if token.depth < depth || token.depth == depth && (token.isPunctuation(";") || token.kind == tokenWord && clauseKeywords[token.upper]) {
+			break
+		}
+
+		if token.depth == depth && token.is("BY") {
+			return "LIMIT BY"
+		}
+	}
+
+	return "LIMIT"
+}
+
+// findJoins reads the joins of the FROM clause starting at from: JOINs, ARRAY JOINs and
+// the commas between table expressions, which explain ast reports as TableJoins too.
+func (h *sourceQueryHints) findJoins(from int) {
+	tokens := h.tokens
+	depth := tokens[from].depth
+	inArrayJoin := false
+
+	// pending is the join whose table expression hasn't ended yet.
+	var pending *sourceConstruct
+	constrained := false
+	end := func(i int) {
+		if pending == nil {
+			return
+		}
+		hasChildren := constrained
+		pending.position = i
+		pending.matches = func(node *AstNode) bool { return len(node.explainChildren()) > 0 == hasChildren }
+		h.joins = append(h.joins, *pending)
+		pending = nil
+	}
+
+	i := from + 1
+	for ; i < len(tokens); i++ {
+		token := tokens[i]
+		if token.depth > depth {
+			continue
+		}
+
+		if token.depth < depth || token.isPunctuation(";") || token.kind == tokenWord && fromClauseEnd[token.upper] {
+			break
+		}
+
+		switch {
+		case token.isPunctuation(","):
+			end(i)
+			if !inArrayJoin {
+				pending = &sourceConstruct{hints: map[string]string{hintJoin: ","}}
+				constrained = false
+			}
+		case token.is("ON", "USING"):
+			if pending != nil {
+				constrained = true
+			}
+			end(i)
+		case token.is("JOIN") || token.kind == tokenWord && joinModifiers[token.upper]:
+			j := i
+			for j < len(tokens) && tokens[j].depth == depth && tokens[j].kind == tokenWord && joinModifiers[tokens[j].upper] {
+				j++
+			}
+
+			if j >= len(tokens) || !tokens[j].is("JOIN") {
+				continue
+			}
+
+			end(i)
+			words := make([]string, 0, j-i+1)
+			for _, word := range tokens[i : j+1] {
+				words = append(words, word.upper)
+			}
+			kind := strings.Join(words, " ")
+
+			inArrayJoin = strings.Contains(kind, "ARRAY")
+			if inArrayJoin {
+				h.arrayJoins = append(h.arrayJoins, sourceConstruct{hints: map[string]string{hintJoin: kind}, position: i})
+			} else {
+				pending = &sourceConstruct{hints: map[string]string{hintJoin: kind}}
+				constrained = false
+			}
+			i = j
+		}
+	}
+
+	end(i)
+}
+
+func (h *sourceQueryHints) findOrderBys() {
+	tokens := h.tokens
+	engineDepths := map[int]bool{}
+
+	for i, token := range tokens {
+		switch {
+		case token.is("ENGINE"):
+			engineDepths[token.depth] = true
+		case token.is("SELECT"):
+			delete(engineDepths, token.depth)
+		}
+
+		if !token.is("ORDER") || i+1 >= len(tokens) || !tokens[i+1].is("BY") {
+			continue
+		}
+
+		// Storage and ALTER ... MODIFY ORDER BY keys aren't OrderByElements.
+		if engineDepths[token.depth] || i > 0 && tokens[i-1].is("MODIFY") {
+			continue
+		}
+
+		depth := token.depth
+		var element []sqlToken
+
+		for j := i + 2; j < len(tokens); j++ {
+			next := tokens[j]
+
+			if next.depth < depth || next.depth == depth && (next.isPunctuation(";") ||
+				next.kind == tokenWord && clauseKeywords[next.upper] && !next.is("FROM", "AS")) {
+				break
+			}
+
+			if next.depth == depth && next.isPunctuation(",") {
+				h.orderBys = append(h.orderBys, orderByConstruct(element, depth))
+				element = nil
+				continue
+			}
+
+			element = append(element, next)
+		}
+
+		if len(element) > 0 {
+			h.orderBys = append(h.orderBys, orderByConstruct(element, depth))
+		}
+	}
+}
+
+// Keywords that may follow the expression of an ORDER BY element.
+var orderByKeywords = map[string]bool{
+	"ASC": true, "DESC": true, "ASCENDING": true, "DESCENDING": true, "NULLS": true, "FIRST": true,
+	"LAST": true, "COLLATE": true, "WITH": true, "FILL": true, "FROM": true, "TO": true, "STEP": true,
+	"STALENESS": true,
+}
+
+func orderByConstruct(element []sqlToken, depth int) sourceConstruct {
+	var keywords []string
+	operands := 0
+
+	for _, token := range element {
+		if token.depth != depth || token.kind != tokenWord {
+			continue
+		}
+
+		if len(keywords) == 0 && !token.is("ASC", "DESC", "ASCENDING", "DESCENDING", "NULLS", "COLLATE", "WITH") {
+			continue
+		}
+
+		if orderByKeywords[token.upper] {
+			keywords = append(keywords, token.upper)
+			if orderByOperands[token.upper] {
+				operands++
+			}
+		}
+	}
+
+	hints := map[string]string{}
+	if len(keywords) > 0 {
+		hints[hintOrderByModifiers] = strings.Join(keywords, " ")
+	}
+
+	return sourceConstruct{hints: hints, matches: func(node *AstNode) bool {
+		return len(node.explainChildren()) == operands+1
+	}}
+}
+
+func (h *sourceQueryHints) findSettings() {
+	tokens := h.tokens
+
+	for i, token := range tokens {
+		if !token.is("SETTINGS") && !(i == 0 && token.is("SET")) && !(i > 0 && token.is("SETTING") && tokens[i-1].is("MODIFY")) {
+			continue
+		}
+
+		j := i + 1
+		// Column settings are written in brackets.
+		if j < len(tokens) && tokens[j].isPunctuation("(") {
+			j++
+		}
+
+		changes, ok := readSettingChanges(tokens[j:])
+		if !ok {
+			h.settings = append(h.settings, sourceConstruct{matches: func(*AstNode) bool { return false }})
+			continue
+		}
+
+		h.settings = append(h.settings, sourceConstruct{hints: map[string]string{hintSettings: changes}})
+	}
+}
+
+// readSettingChanges reads "name = value" changes from the start of tokens. Values have
+// to be a single string, number or word, or a negative number, since they're copied
+// into the hint as written.
+func readSettingChanges(tokens []sqlToken) (string, bool) {
+	var changes []string
+
+	for i := 0; ; i++ {
+		if i+2 >= len(tokens) || !tokens[i].isName() || !tokens[i+1].isPunctuation("=") {
+			return "", false
+		}
+
+		name := tokens[i].text
+		i += 2
+
+		value := tokens[i].text
+		if tokens[i].isPunctuation("-") && i+1 < len(tokens) && tokens[i+1].kind == tokenNumber {
+			i++
+			value += tokens[i].text
+		} else if tokens[i].kind == tokenPunctuation || tokens[i].kind == tokenQuotedIdentifier {
+			return "", false
+		}
+
+		if i+1 < len(tokens) && tokens[i+1].isPunctuation("(") {
+			return "", false
+		}
+
+		changes = append(changes, name+" = "+value)
+
+		// A comma may also end the SETTINGS clause, as in an ALTER command list.
+		if i+3 >= len(tokens) || !tokens[i+1].isPunctuation(",") || !tokens[i+3].isPunctuation("=") {
+			return strings.Join(changes, ", "), true
+		}
+		i++
+	}
+}
+
+type setting struct {
+	name  string
+	value string
+}
+
+// settingChanges splits a SETTINGS hint into its changes.
+func settingChanges(hint string) []setting {
+	var settings []setting
+
+	for _, element := range splitTokens(tokenizeSQL(hint), 0) {
+		if len(element) < 3 {
+			continue
+		}
+
+		value := ""
+		for _, token := range element[2:] {
+			value += token.text
+		}
+		settings = append(settings, setting{name: element[0].text, value: value})
+	}
+
+	return settings
+}
+
+// settingsHint writes settings back into a SETTINGS hint.
+func settingsHint(settings []setting) string {
+	changes := make([]string, len(settings))
+	for i, s := range settings {
+		changes[i] = s.name + " = " + s.value
+	}
+
+	return strings.Join(changes, ", ")
+}
+
+func (h *sourceQueryHints) findFinals() {
+	tokens := h.tokens
+	if len(tokens) > 0 && tokens[0].is("OPTIMIZE") {
+		return
+	}
+
+	for i, token := range tokens {
+		if !token.is("FINAL") {
+			continue
+		}
+
+		// FINAL follows the table and its alias: [db.]table [[AS] alias] FINAL.
+		var table sourceTable
+		j := i - 1
+		if j >= 1 && tokens[j].isName() && (tokens[j-1].is("AS") || tokens[j-1].isName() && !tokens[j-1].is("FROM", "JOIN", "TABLE")) {
+			table.alias = unquoteIdentifierToken(tokens[j])
+			j--
+			if tokens[j].is("AS") {
+				j--
+			}
+		}
+
+		if j >= 0 && tokens[j].isName() {
+			table.name = unquoteIdentifierToken(tokens[j])
+			if j >= 2 && tokens[j-1].isPunctuation(".") && tokens[j-2].isName() {
+				table.database = unquoteIdentifierToken(tokens[j-2])
+			}
+		}
+
+		h.finals = append(h.finals, table)
+	}
+}
+
+func unquoteIdentifierToken(token sqlToken) string {
+	if token.kind != tokenQuotedIdentifier {
+		return token.text
+	}
+
+	parts, err := splitIdentifier(token.text)
+	if err != nil || len(parts) != 1 {
+		return token.text
+	}
+
+	return parts[0].Name
+}
+
+// readName reads a possibly dotted name from the start of tokens, returning it unquoted
+// along with what follows.
+func readName(tokens []sqlToken) (string, []sqlToken) {
+	var parts []string
+
+	for len(tokens) > 0 && tokens[0].isName() {
+		parts = append(parts, unquoteIdentifierToken(tokens[0]))
+		tokens = tokens[1:]
+
+		if len(tokens) < 2 || !tokens[0].isPunctuation(".") {
+			break
+		}
+		tokens = tokens[1:]
+	}
+
+	return strings.Join(parts, "."), tokens
+}
+
+// Words that may come between CREATE and the name of what's being created.
+var createWords = map[string]bool{
+	"CREATE": true, "ATTACH": true, "REPLACE": true, "OR": true, "TEMPORARY": true, "TABLE": true,
+	"VIEW": true, "MATERIALIZED": true, "LIVE": true, "WINDOW": true, "DICTIONARY": true,
+	"DATABASE": true, "FUNCTION": true, "IF": true, "NOT": true, "EXISTS": true,
+}
+
+// Words that start an ALTER command.
+var alterCommandWords = map[string]bool{
+	"ADD": true, "DROP": true, "MODIFY": true, "RENAME": true, "COMMENT": true, "CLEAR": true,
+	"MATERIALIZE": true, "DELETE": true, "UPDATE": true, "ATTACH": true, "DETACH": true,
+	"FREEZE": true, "UNFREEZE": true, "REPLACE": true, "MOVE": true, "FETCH": true, "REMOVE": true,
+	"RESET": true, "APPLY": true,
+}
+
+// Words naming what a DROP, CLEAR or DETACH command acts on.
+var dropCommandObjects = map[string]bool{
+	"COLUMN": true, "INDEX": true, "PROJECTION": true, "CONSTRAINT": true, "PARTITION": true,
+	"PART": true, "STATISTICS": true, "STATISTIC": true,
+}
+
+// Words that start a clause of a storage definition.
+var storageClauseWords = map[string]bool{
+	"ENGINE": true, "PARTITION": true, "PRIMARY": true, "ORDER": true, "SAMPLE": true, "TTL": true, "SETTINGS": true,
+}
+
+func (h *sourceQueryHints) findDDL() {
+	tokens := h.tokens
+	if len(tokens) == 0 {
+		return
+	}
+
+	switch {
+	case tokens[0].is("CREATE", "ATTACH", "REPLACE"):
+		var words []string
+		i := 0
+		for i < len(tokens) && tokens[i].kind == tokenWord && createWords[tokens[i].upper] {
+			words = append(words, tokens[i].upper)
+			i++
+		}
+		h.create = strings.Join(words, " ")
+		h.findColumnList(i)
+	case tokens[0].is("ALTER"):
+		h.findAlterCommands()
+	}
+
+	for i, token := range tokens {
+		if token.depth != 0 {
+			continue
+		}
+
+		switch {
+		case token.is("POPULATE"):
+			h.populate = true
+		case token.is("ENGINE"):
+			h.findStorage(i)
+		}
+	}
+}
+
+// findColumnList reads the parenthesised column list of a CREATE statement.
+func (h *sourceQueryHints) findColumnList(start int) {
+	tokens := h.tokens
+	open := -1
+
+	for i := start; i < len(tokens) && tokens[i].depth == 0; i++ {
+		if tokens[i].is("ENGINE", "AS", "SELECT", "COMMENT", "EMPTY") {
+			return
+		}
+
+		if tokens[i].isPunctuation("(") {
+			open = i
+			break
+		}
+	}
+
+	if open == -1 {
+		return
+	}
+
+	end := open + 1
+	for end < len(tokens) && tokens[end].depth > 0 {
+		end++
+	}
+
+	for _, element := range splitTokens(tokens[open+1:end], 1) {
+		if len(element) == 0 {
+			continue
+		}
+
+		switch {
+		case element[0].is("INDEX"):
+			h.indices = append(h.indices, namedConstruct(indexHints(element[1:])))
+		case element[0].is("CONSTRAINT"):
+			h.constraints = append(h.constraints, namedConstruct(constraintHints(element[1:])))
+		case element[0].is("PROJECTION", "PRIMARY"):
+		default:
+			h.columns = append(h.columns, columnConstruct(element))
+		}
+	}
+}
+
+// skipIfExists skips an IF EXISTS or IF NOT EXISTS, returning it along with what follows.
+func skipIfExists(tokens []sqlToken) (string, []sqlToken) {
+	switch {
+	case len(tokens) >= 3 && tokens[0].is("IF") && tokens[1].is("NOT") && tokens[2].is("EXISTS"):
+		return "IF NOT EXISTS", tokens[3:]
+	case len(tokens) >= 2 && tokens[0].is("IF") && tokens[1].is("EXISTS"):
+		return "IF EXISTS", tokens[2:]
+	}
+
+	return "", tokens
+}
+
+// columnConstruct reads a column declaration, which has to land on the ColumnDeclaration
+// of the same name with a child for each of its clauses.
+func columnConstruct(element []sqlToken) sourceConstruct {
+	hints := map[string]string{}
+	if len(element) == 0 {
+		return sourceConstruct{hints: hints, matches: func(*AstNode) bool { return false }}
+	}
+
+	name, rest := readName(element)
+
+	depth := element[0].depth
+	sawClause := false
+	var clauses []string
+
+	for i, token := range rest {
+		if token.depth != depth {
+			continue
+		}
+
+		switch {
+		case token.is("DEFAULT", "MATERIALIZED", "ALIAS", "EPHEMERAL") && !sawClause:
+			hints[hintDefaultKind] = token.upper
+			clauses = append(clauses, "DEFAULT")
+			sawClause = true
+		case token.is("COMMENT", "CODEC", "TTL"):
+			clauses = append(clauses, token.upper)
+			sawClause = true
+		case token.is("SETTINGS", "STATISTICS"):
+			sawClause = true
+		case token.is("NULL") && !sawClause:
+			if i > 0 && rest[i-1].is("NOT") {
+				hints[hintNullModifier] = "NOT NULL"
+			} else {
+				hints[hintNullModifier] = "NULL"
+			}
+		}
+	}
+
+	hints[hintClauses] = strings.Join(clauses, ",")
+
+	return sourceConstruct{hints: hints, matches: func(node *AstNode) bool {
+		children := node.explainChildren()
+		if len(children) > 0 && children[0].Type == "DataType" {
+			children = children[1:]
+		}
+
+		return node.Value == name && len(children) == len(clauses)
+	}}
+}
+
+// namedConstruct checks an index or constraint against the name explain ast gives its
+// node, if it gives one.
+func namedConstruct(hints map[string]string) sourceConstruct {
+	return sourceConstruct{hints: hints, matches: func(node *AstNode) bool {
+		return node.Value == "" || node.Value == hints[hintName]
+	}}
+}
+
+func indexHints(element []sqlToken) map[string]string {
+	hints := map[string]string{}
+	if len(element) == 0 {
+		return hints
+	}
+
+	hints[hintName] = unquoteIdentifierToken(element[0])
+
+	for i, token := range element {
+		if token.depth == element[0].depth && token.is("GRANULARITY") && i+1 < len(element) {
+			hints[hintGranularity] = element[i+1].text
+		}
+	}
+
+	return hints
+}
+
+func constraintHints(element []sqlToken) map[string]string {
+	hints := map[string]string{}
+
+	if len(element) > 0 {
+		hints[hintName] = unquoteIdentifierToken(element[0])
+	}
+
+	if len(element) > 1 && element[1].is("CHECK", "ASSUME") {
+		hints[hintConstraintKind] = element[1].upper
+	}
+
+	return hints
+}
+
+func (h *sourceQueryHints) findAlterCommands() {
+	tokens := h.tokens
+
+	start := -1
+	for i := 2; i < len(tokens); i++ {
+		if tokens[i].depth == 0 && tokens[i].kind == tokenWord && alterCommandWords[tokens[i].upper] &&
+			!tokens[i-1].isPunctuation(".") && !tokens[i-1].is("TABLE") {
+			start = i
+			break
+		}
+	}
+
+	if start == -1 {
+		return
+	}
+
+	end := len(tokens)
+	for i := start; i < len(tokens); i++ {
+		if tokens[i].depth == 0 && (tokens[i].isPunctuation(";") || tokens[i].is("SETTINGS")) {
+			end = i
+			break
+		}
+	}
+
+	for _, command := range splitTokens(tokens[start:end], 0) {
+		hints := map[string]string{}
+		h.alterCommands = append(h.alterCommands, alterCommandConstruct(command, hints))
+
+		if len(command) < 2 {
+			continue
+		}
+
+		if last := command[len(command)-1]; last.is("FIRST") {
+			hints[hintFirst] = "FIRST"
+			command = command[:len(command)-1]
+		}
+
+		if command[0].is("DROP", "CLEAR", "DETACH") {
+			hints[hintDropCommand] = dropCommand(command)
+		}
+
+		words := command[0].upper + " " + command[1].upper
+		ifExists, rest := skipIfExists(command[2:])
+		if ifExists != "" {
+			hints[hintIfExists] = ifExists
+		}
+
+		switch words {
+		case "ADD COLUMN", "MODIFY COLUMN":
+			// MODIFY COLUMN ... REMOVE takes its clause keyword off the column.
+			for i, token := range rest {
+				if token.depth == 0 && token.is("AFTER", "REMOVE") {
+					rest = rest[:i]
+					break
+				}
+			}
+			h.columns = append(h.columns, columnConstruct(rest))
+		case "ADD INDEX":
+			h.indices = append(h.indices, namedConstruct(indexHints(rest)))
+		case "ADD CONSTRAINT":
+			h.constraints = append(h.constraints, namedConstruct(constraintHints(rest)))
+		case "MODIFY TTL":
+			h.findTTLElements(command[2:])
+		}
+	}
+}
+
+// alterCommandConstruct checks a command against the kind explain ast reports for it,
+// e.g. MODIFY COLUMN against MODIFY_COLUMN. CLEAR and DETACH are reported as DROP_ kinds.
+func alterCommandConstruct(command []sqlToken, hints map[string]string) sourceConstruct {
+	return sourceConstruct{hints: hints, matches: func(node *AstNode) bool {
+		if len(command) == 0 {
+			return false
+		}
+
+		if strings.HasPrefix(node.Value, "DROP_") {
+			return command[0].is("DROP", "CLEAR", "DETACH")
+		}
+
+		return strings.HasPrefix(node.Value, command[0].upper)
+	}}
+}
+
+// dropCommand returns the keywords starting a DROP, CLEAR or DETACH command, e.g.
+// "DROP DETACHED PARTITION".
+func dropCommand(command []sqlToken) string {
+	words := []string{command[0].upper}
+	rest := command[1:]
+
+	if len(rest) > 0 && rest[0].is("DETACHED") {
+		words = append(words, rest[0].upper)
+		rest = rest[1:]
+	}
+
+	if len(rest) > 0 && rest[0].kind == tokenWord && dropCommandObjects[rest[0].upper] {
+		words = append(words, rest[0].upper)
+	}
+
+	return strings.Join(words, " ")
+}
+
+// findStorage reads the clauses of the storage definition starting at ENGINE.
+func (h *sourceQueryHints) findStorage(engine int) {
+	tokens := h.tokens
+	clauses := []string{"ENGINE"}
+	keys := 0
+	ttlStart := -1
+
+	finishTTL := func(end int) {
+		if ttlStart != -1 {
+			h.findTTLElements(tokens[ttlStart:end])
+			ttlStart = -1
+		}
+	}
+
+	i := engine + 1
+	for ; i < len(tokens); i++ {
+		token := tokens[i]
+		if token.depth != 0 {
+			continue
+		}
+
+		if token.isPunctuation(";") || token.is("AS", "POPULATE", "COMMENT", "EMPTY") {
+			break
+		}
+
+		if token.kind != tokenWord || !storageClauseWords[token.upper] || token.is("ENGINE") {
+			continue
+		}
+
+		next := ""
+		if i+1 < len(tokens) {
+			next = tokens[i+1].upper
+		}
+
+		switch {
+		case token.is("TTL", "SETTINGS"):
+			finishTTL(i)
+			clauses = append(clauses, token.upper)
+			if token.is("TTL") {
+				ttlStart = i + 1
+			}
+		case next == "BY" || token.is("PRIMARY") && next == "KEY":
+			finishTTL(i)
+			clauses = append(clauses, token.upper+" "+next)
+			keys++
+		}
+	}
+
+	finishTTL(i)
+
+	hint := strings.Join(clauses, ",")
+	h.storages = append(h.storages, sourceConstruct{hints: map[string]string{hintClauses: hint}, matches: func(node *AstNode) bool {
+		clauses, expressions := storageChildren(node)
+		return len(expressions) == keys &&
+			(clauses.ttl != nil) == strings.Contains(hint, "TTL") &&
+			(clauses.settings != nil) == strings.Contains(hint, "SETTINGS")
+	}})
+}
+
+// Keywords that may follow the expression of a TTL element.
+var ttlKeywords = map[string]bool{
+	"DELETE": true, "TO": true, "DISK": true, "VOLUME": true, "RECOMPRESS": true, "WHERE": true,
+	"GROUP": true, "BY": true, "SET": true,
+}
+
+func (h *sourceQueryHints) findTTLElements(tokens []sqlToken) {
+	if len(tokens) == 0 {
+		return
+	}
+
+	depth := tokens[0].depth
+
+	for _, element := range splitTokens(tokens, depth) {
+		hints := map[string]string{}
+		var keywords []string
+		operands := 0
+
+		for i, token := range element {
+			if i == 0 || token.depth != depth || token.kind != tokenWord {
+				continue
+			}
+
+			if len(keywords) == 0 && !token.is("DELETE", "TO", "RECOMPRESS", "GROUP", "WHERE") {
+				continue
+			}
+
+			if ttlKeywords[token.upper] {
+				keywords = append(keywords, token.upper)
+				if ttlOperands[token.upper] {
+					operands++
+				}
+			}
+
+			if token.is("DISK", "VOLUME") && i+1 < len(element) && element[i+1].kind == tokenString {
+				hints[hintTTLDestination] = element[i+1].text
+			}
+		}
+
+		if len(keywords) > 0 {
+			hints[hintTTLAction] = strings.Join(keywords, " ")
+		}
+
+		grouped := strings.Contains(hints[hintTTLAction], "GROUP BY")
+		h.ttlElements = append(h.ttlElements, sourceConstruct{hints: hints, matches: func(node *AstNode) bool {
+			// GROUP BY keys and SET assignments aren't counted, so these can't be checked.
+			return grouped || len(node.explainChildren()) == operands+1
+		}})
+	}
+}
+
+func (n *AstNode) setHint(key string, value string) {
+	if n.Hints == nil {
+		n.Hints = map[string]string{}
+	}
+
+	n.Hints[key] = value
+}
+
+func nodesOfTypes(root *AstNode, types ...string) []*AstNode {
+	var nodes []*AstNode
+
+	root.Walk(func(node *AstNode) {
+		for _, nodeType := range types {
+			if node.Type == nodeType {
+				nodes = append(nodes, node)
+				return
+			}
+		}
+	})
+
+	return nodes
+}
+
+// allowLossyRegex matches a comment starting with the AllowLossyAnnotation.
+var allowLossyRegex = regexp.MustCompile(`^(--|#|/\*)\s*` + regexp.QuoteMeta(AllowLossyAnnotation) + `\b`)
+
+// applySourceHints records what explain ast leaves out of the tree from the source
+// query. Nodes matched to a construct always get a Hints map, even an empty one, so a
+// nil Hints means the node's hints weren't recovered.
+func applySourceHints(root *AstNode, sourceQuery string) []error {
+	if strings.TrimSpace(sourceQuery) == "" {
+		return nil
+	}
+
+	h := extractSourceHints(sourceQuery)
+	var mismatches []error
+
+	apply := func(nodeType string, constructs []sourceConstruct) {
+		nodes := nodesOfTypes(root, nodeType)
+		if len(nodes) != len(constructs) {
+			mismatches = append(mismatches, &HintMismatchError{Query: sourceQuery, NodeType: nodeType, Nodes: len(nodes), Found: len(constructs)})
+			return
+		}
+
+		for i, node := range nodes {
+			if constructs[i].matches != nil && !constructs[i].matches(node) {
+				mismatches = append(mismatches, &HintMismatchError{Query: sourceQuery, NodeType: nodeType, Nodes: len(nodes), Found: len(constructs), Line: node.LineNumber})
+				return
+			}
+		}
+
+		for i, node := range nodes {
+			if node.Hints == nil {
+				node.Hints = map[string]string{}
+			}
+			for key, value := range constructs[i].hints {
+				node.Hints[key] = value
+			}
+		}
+	}
+
+	// Only real comments count, not the annotation quoted in a string literal.
+	for _, comment := range h.comments {
+		if allowLossyRegex.MatchString(comment) {
+			root.setHint(hintAllowLossy, "true")
+		}
+	}
+
+	if h.create != "" && (root.Type == "CreateQuery" || root.Type == "CreateFunctionQuery") {
+		root.setHint(hintCreate, h.create)
+
+		if h.populate {
+			root.setHint(hintPopulate, "POPULATE")
+		}
+	}
+
+	apply("SelectQuery", h.selects)
+	apply("TableJoin", h.joins)
+	apply("ArrayJoin", h.arrayJoins)
+	apply("OrderByElement", h.orderBys)
+	apply("Set", h.settings)
+	apply("ColumnDeclaration", h.columns)
+	apply("Index", h.indices)
+	apply("Constraint", h.constraints)
+	apply("Storage", h.storages)
+	apply("TTLElement", h.ttlElements)
+	apply("AlterCommand", h.alterCommands)
+
+	if err := h.applyFinals(root, sourceQuery); err != nil {
+		mismatches = append(mismatches, err)
+	}
+
+	return mismatches
+}
+
+// applyFinals marks the table each FINAL was written after, which has to be a
+// TableIdentifier with the same name, database and alias.
+func (h *sourceQueryHints) applyFinals(root *AstNode, sourceQuery string) error {
+	tables := nodesOfTypes(root, "TableIdentifier")
+	var finals []*AstNode
+
+	for _, final := range h.finals {
+		var match *AstNode
+		for _, table := range tables {
+			if table.Value == final.name && table.ValueQualifier == final.database && table.Alias == final.alias &&
+				table.Hints[hintFinal] == "" && !containsNode(finals, table) {
+				match = table
+				break
+			}
+		}
+
+		if match == nil {
+			return &HintMismatchError{Query: sourceQuery, NodeType: "TableIdentifier", Nodes: len(finals), Found: len(h.finals)}
+		}
+		finals = append(finals, match)
+	}
+
+	for _, table := range finals {
+		table.setHint(hintFinal, "FINAL")
+	}
+
+	return nil
+}
+
+func containsNode(nodes []*AstNode, node *AstNode) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HintMismatchError reports source query constructs that couldn't be matched to the
+// nodes of the tree they belong to, so hints of that kind were left out.
+type HintMismatchError struct {
+	Query    string
+	NodeType string
+	// Nodes is how many nodes of NodeType the tree has.
+	Nodes int
+	// Found is how many matching constructs were found in the source query.
+	Found int
+	// Line is the line of the first node that didn't agree with its construct, or 0
+	// when the counts differ.
+	Line int
+}
+
+func (e *HintMismatchError) Error() string {
+	if e.Line != 0 {
+		return fmt.Sprintf("source query hints don't match the %s node on line %d in query: %s", e.NodeType, e.Line, e.Query)
+	}
+
+	return fmt.Sprintf("could not match source query hints to %d %s nodes, found %d in query: %s", e.Nodes, e.NodeType, e.Found, e.Query)
+}
+
+// treeHints is the source query a tree was parsed from, kept on its root.
+type treeHints struct {
+	query string
+	// mismatches holds the kinds of hint that couldn't be matched to the tree.
+	mismatches []error
+}
+
+// sourceHints returns the source query hints of n's tree, or nil if it wasn't parsed
+// from a source query.
+func (n *AstNode) sourceHints() *treeHints {
+	root := n
+	for root.Parent != nil {
+		root = root.Parent
+	}
+
+	return root.hintSource
+}
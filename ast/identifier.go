@@ -0,0 +1,157 @@
+package ast
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// IdentifierPart is one dot separated component of an identifier.
+type IdentifierPart struct {
+	// Name is the unquoted, unescaped part.
+	Name string
+	// Quote is the quote character the part was wrapped in (` or "), or 0 if it was bare.
+	Quote byte
+}
+
+// IdentifierPath is the fully resolved form of a dotted identifier such as
+// db.table.column.subcolumn. Which fields are filled in depends on the node type:
+// table level nodes only ever have a Database and Table.
+type IdentifierPath struct {
+	Database   string
+	Table      string
+	Column     string
+	Subcolumns []string
+	// Parts are the components as they appeared, including their quoting.
+	Parts []IdentifierPart
+}
+
+// String renders the path back out, preserving original quoting and quoting any
+// part that couldn't be written bare.
+func (p IdentifierPath) String() string {
+	rendered := make([]string, len(p.Parts))
+
+	for i, part := range p.Parts {
+		switch {
+		case part.Quote != 0:
+			rendered[i] = quoteWith(part.Name, part.Quote)
+		case i > 0 && numericPartRegex.MatchString(part.Name):
+			rendered[i] = part.Name
+		default:
+			rendered[i] = QuoteIdentifier(part.Name)
+		}
+	}
+
+	return strings.Join(rendered, ".")
+}
+
+var bareIdentifierRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+var numericPartRegex = regexp.MustCompile(`^[0-9]+$`)
+
+// QuoteIdentifier backquotes name if it can't be written as a bare identifier.
+func QuoteIdentifier(name string) string {
+	if bareIdentifierRegex.MatchString(name) {
+		return name
+	}
+
+	return quoteWith(name, '`')
+}
+
+func quoteWith(name string, quote byte) string {
+	escaped := strings.ReplaceAll(name, `\`, `\\`)
+	escaped = strings.ReplaceAll(escaped, string(quote), `\`+string(quote))
+
+	return string(quote) + escaped + string(quote)
+}
+
+// splitIdentifier splits value on dots that aren't inside backquotes or double quotes.
+func splitIdentifier(value string) ([]IdentifierPart, error) {
+	var parts []IdentifierPart
+	var current strings.Builder
+	var quote byte
+	var partQuote byte
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+
+		switch {
+		case quote != 0 && c == '\\' && i+1 < len(value):
+			i++
+			current.WriteByte(value[i])
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteByte(c)
+		case (c == '`' || c == '"') && current.Len() == 0:
+			quote = c
+			partQuote = c
+		case c == '.':
+			parts = append(parts, IdentifierPart{Name: current.String(), Quote: partQuote})
+			current.Reset()
+			partQuote = 0
+		default:
+			current.WriteByte(c)
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quoted identifier %q", value)
+	}
+
+	return append(parts, IdentifierPart{Name: current.String(), Quote: partQuote}), nil
+}
+
+// Node types whose value names a table rather than a column.
+var tableLevelTypes = map[string]bool{
+	"TableIdentifier": true,
+	"CreateQuery":     true,
+	"AlterQuery":      true,
+	"DropQuery":       true,
+	"TruncateQuery":   true,
+}
+
+func newIdentifierPath(nodeType string, parts []IdentifierPart) IdentifierPath {
+	path := IdentifierPath{Parts: parts}
+	names := make([]string, len(parts))
+	for i, part := range parts {
+		names[i] = part.Name
+	}
+
+	if tableLevelTypes[nodeType] {
+		path.Table = names[len(names)-1]
+		if len(names) > 1 {
+			path.Database = strings.Join(names[:len(names)-1], ".")
+		}
+
+		return path
+	}
+
+	if nodeType == "ColumnDeclaration" {
+		path.Column = names[0]
+		path.Subcolumns = names[1:]
+
+		return path
+	}
+
+	// Trailing numeric parts are tuple element access, e.g. t.1
+	end := len(names)
+	for end > 1 && numericPartRegex.MatchString(names[end-1]) && parts[end-1].Quote == 0 {
+		end--
+	}
+
+	switch {
+	case end == 1:
+		path.Column = names[0]
+	case end == 2:
+		path.Table, path.Column = names[0], names[1]
+	default:
+		path.Database, path.Table, path.Column = names[0], names[1], names[2]
+		end = 3
+	}
+
+	if end < len(names) {
+		path.Subcolumns = names[end:]
+	}
+
+	return path
+}
@@ -0,0 +1,79 @@
+package ast
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func identifierNode(t *testing.T, line string) *AstNode {
+	root, err := Parse("", []string{line})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return root
+}
+
+func TestIdentifierPaths(t *testing.T) {
+	cases := []struct {
+		line      string
+		value     string
+		qualifier string
+		path      IdentifierPath
+	}{
+		{"Identifier z", "z", "", IdentifierPath{Column: "z"}},
+		{"Identifier t.z", "z", "t", IdentifierPath{Table: "t", Column: "z"}},
+		{"Identifier db.t.z", "z", "t", IdentifierPath{Database: "db", Table: "t", Column: "z"}},
+		{"Identifier db.t.z.sub", "z", "t", IdentifierPath{Database: "db", Table: "t", Column: "z", Subcolumns: []string{"sub"}}},
+		{"Identifier t.1", "t", "", IdentifierPath{Column: "t", Subcolumns: []string{"1"}}},
+		{"Identifier `a.b`", "a.b", "", IdentifierPath{Column: "a.b"}},
+		{"Identifier `my db`.`t\\`x`.c", "c", "t`x", IdentifierPath{Database: "my db", Table: "t`x", Column: "c"}},
+		{"TableIdentifier db.t", "t", "db", IdentifierPath{Database: "db", Table: "t"}},
+		{"ColumnDeclaration n.a", "n.a", "", IdentifierPath{Column: "n", Subcolumns: []string{"a"}}},
+	}
+
+	for _, c := range cases {
+		node := identifierNode(t, c.line)
+
+		assert.Equal(t, c.value, node.Value, c.line)
+		assert.Equal(t, c.qualifier, node.ValueQualifier, c.line)
+
+		path := node.Path
+		path.Parts = nil
+		assert.Equal(t, c.path, path, c.line)
+	}
+}
+
+func TestCreateQueryDatabasePath(t *testing.T) {
+	root, err := Parse("", []string{
+		"CreateQuery db t1 (children 2)",
+		" Identifier db",
+		" Identifier t1",
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "t1", root.Value)
+	assert.Equal(t, "db", root.ValueQualifier)
+	assert.Equal(t, "db", root.Path.Database)
+	assert.Equal(t, "db.t1", root.Path.String())
+}
+
+func TestIdentifierPathString(t *testing.T) {
+	cases := map[string]string{
+		"Identifier db.t.z":          "db.t.z",
+		"Identifier t.1":             "t.1",
+		"Identifier `a.b`":           "`a.b`",
+		"Identifier `plain`.x":       "`plain`.x",
+		"Identifier `t\\`x`.c":       "`t\\`x`.c",
+		`Identifier "quoted col".x`:  `"quoted col".x`,
+		"TableIdentifier `my db`.t1": "`my db`.t1",
+	}
+
+	for line, expected := range cases {
+		assert.Equal(t, expected, identifierNode(t, line).Path.String(), line)
+	}
+
+	assert.Equal(t, "`has space`", QuoteIdentifier("has space"))
+	assert.Equal(t, "bare_name1", QuoteIdentifier("bare_name1"))
+}
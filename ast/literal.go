@@ -0,0 +1,296 @@
+package ast
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Tuple is a decoded Tuple_ literal. It's a distinct type so tuples can be told apart from arrays.
+type Tuple []interface{}
+
+type literalKind int
+
+const (
+	literalScalar literalKind = iota
+	literalString
+	literalNull
+	literalArray
+	literalTuple
+	literalMap
+)
+
+// literal is the parsed form of a Literal node value as dumped by explain ast,
+// e.g. UInt64_3, 'abc', Array_[UInt64_1, UInt64_2] or Tuple_(UInt64_5, 'maximus').
+type literal struct {
+	kind literalKind
+	// ClickHouse type name for scalars such as UInt64 or Float64.
+	typeName string
+	// Unquoted payload for scalars and strings.
+	value    string
+	elements []literal
+}
+
+type literalParser struct {
+	input string
+	pos   int
+}
+
+func parseLiteral(value string) (literal, error) {
+	p := &literalParser{input: value}
+
+	lit, err := p.parse()
+	if err != nil {
+		return literal{}, err
+	}
+
+	if p.pos != len(p.input) {
+		return literal{}, fmt.Errorf("unexpected trailing input %q in literal %q", p.input[p.pos:], value)
+	}
+
+	return lit, nil
+}
+
+func (p *literalParser) peek() byte {
+	if p.pos >= len(p.input) {
+		return 0
+	}
+
+	return p.input[p.pos]
+}
+
+func (p *literalParser) parse() (literal, error) {
+	rest := p.input[p.pos:]
+
+	switch {
+	case strings.HasPrefix(rest, "'"):
+		str, err := p.parseQuoted()
+		return literal{kind: literalString, value: str}, err
+	case strings.HasPrefix(rest, "NULL"):
+		p.pos += len("NULL")
+		return literal{kind: literalNull}, nil
+	case strings.HasPrefix(rest, "Array_["):
+		p.pos += len("Array_[")
+		elements, err := p.parseElements(']')
+		return literal{kind: literalArray, elements: elements}, err
+	case strings.HasPrefix(rest, "Tuple_("):
+		p.pos += len("Tuple_(")
+		elements, err := p.parseElements(')')
+		return literal{kind: literalTuple, elements: elements}, err
+	case strings.HasPrefix(rest, "Map_("):
+		p.pos += len("Map_(")
+		elements, err := p.parseElements(')')
+		return literal{kind: literalMap, elements: elements}, err
+	}
+
+	separator := strings.IndexByte(rest, '_')
+	if separator <= 0 {
+		return literal{}, fmt.Errorf("unrecognised literal %q", rest)
+	}
+
+	lit := literal{kind: literalScalar, typeName: rest[:separator]}
+	p.pos += separator + 1
+
+	if p.peek() == '\'' {
+		str, err := p.parseQuoted()
+		lit.value = str
+		return lit, err
+	}
+
+	start := p.pos
+	for p.pos < len(p.input) && !strings.ContainsRune(",])", rune(p.input[p.pos])) {
+		p.pos++
+	}
+	lit.value = p.input[start:p.pos]
+
+	return lit, nil
+}
+
+func (p *literalParser) parseElements(closing byte) ([]literal, error) {
+	elements := []literal{}
+
+	if p.peek() == closing {
+		p.pos++
+		return elements, nil
+	}
+
+	for {
+		element, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+
+		switch p.peek() {
+		case closing:
+			p.pos++
+			return elements, nil
+		case ',':
+			p.pos++
+			for p.peek() == ' ' {
+				p.pos++
+			}
+		default:
+			return nil, fmt.Errorf("expected ',' or '%c' at offset %d in literal %q", closing, p.pos, p.input)
+		}
+	}
+}
+
+// parseQuoted reads a single quoted string using ClickHouse's backslash escaping.
+func (p *literalParser) parseQuoted() (string, error) {
+	var sb strings.Builder
+	p.pos++
+
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		p.pos++
+
+		switch c {
+		case '\'':
+			return sb.String(), nil
+		case '\\':
+			if p.pos >= len(p.input) {
+				return "", fmt.Errorf("unterminated escape in literal %q", p.input)
+			}
+
+			escaped := p.input[p.pos]
+			p.pos++
+
+			switch escaped {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case '0':
+				sb.WriteByte(0)
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'x':
+				if p.pos+2 > len(p.input) {
+					return "", fmt.Errorf("short hex escape in literal %q", p.input)
+				}
+
+				b, err := strconv.ParseUint(p.input[p.pos:p.pos+2], 16, 8)
+				if err != nil {
+					return "", fmt.Errorf("bad hex escape in literal %q: %w", p.input, err)
+				}
+				sb.WriteByte(byte(b))
+				p.pos += 2
+			default:
+				sb.WriteByte(escaped)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	return "", fmt.Errorf("unterminated string in literal %q", p.input)
+}
+
+// goValue converts the literal into the Go values documented on LiteralValue.
+func (l literal) goValue() (interface{}, error) {
+	switch l.kind {
+	case literalString:
+		return l.value, nil
+	case literalNull:
+		return nil, nil
+	case literalArray, literalTuple:
+		values := make([]interface{}, len(l.elements))
+
+		for i, element := range l.elements {
+			value, err := element.goValue()
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+
+		if l.kind == literalTuple {
+			return Tuple(values), nil
+		}
+
+		return values, nil
+	case literalMap:
+		values := make(map[interface{}]interface{}, len(l.elements))
+
+		for _, element := range l.elements {
+			if element.kind != literalTuple || len(element.elements) != 2 {
+				return nil, fmt.Errorf("map literal entries must be key/value tuples")
+			}
+
+			key, err := element.elements[0].goValue()
+			if err != nil {
+				return nil, err
+			}
+
+			switch key.(type) {
+			case []interface{}, Tuple, map[interface{}]interface{}:
+				return nil, fmt.Errorf("unsupported map literal key %v", key)
+			}
+
+			value, err := element.elements[1].goValue()
+			if err != nil {
+				return nil, err
+			}
+			values[key] = value
+		}
+
+		return values, nil
+	}
+
+	return l.scalarValue()
+}
+
+func (l literal) scalarValue() (interface{}, error) {
+	switch l.typeName {
+	case "UInt8", "UInt16", "UInt32", "UInt64":
+		return strconv.ParseUint(l.value, 10, 64)
+	case "Int8", "Int16", "Int32", "Int64":
+		return strconv.ParseInt(l.value, 10, 64)
+	case "UInt128", "UInt256", "Int128", "Int256":
+		value, ok := new(big.Int).SetString(l.value, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid %s literal %q", l.typeName, l.value)
+		}
+		return value, nil
+	case "Float32", "Float64":
+		switch l.value {
+		case "inf", "+inf":
+			return math.Inf(1), nil
+		case "-inf":
+			return math.Inf(-1), nil
+		case "nan", "-nan":
+			return math.NaN(), nil
+		}
+		return strconv.ParseFloat(l.value, 64)
+	case "Bool":
+		return l.value == "1" || l.value == "true", nil
+	}
+
+	// Decimals, UUIDs, IPs and anything newer are returned as their textual payload
+	// so no precision is lost.
+	return l.value, nil
+}
+
+// LiteralValue decodes the value of a Literal node into a Go value:
+// uint64/int64 for integers (*big.Int beyond 64 bits), float64, bool, string,
+// nil for NULL, []interface{} for arrays, Tuple for tuples and
+// map[interface{}]interface{} for maps.
+func (n *AstNode) LiteralValue() (interface{}, error) {
+	if n.Type != "Literal" {
+		return nil, fmt.Errorf("%s node is not a Literal", n.Type)
+	}
+
+	lit, err := parseLiteral(n.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	return lit.goValue()
+}
@@ -0,0 +1,66 @@
+package ast
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func literalNode(t *testing.T, line string) *AstNode {
+	root, err := Parse("", []string{line})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return root
+}
+
+func TestLiteralValue(t *testing.T) {
+	huge, _ := new(big.Int).SetString("170141183460469231731687303715884105727", 10)
+
+	cases := []struct {
+		line     string
+		expected interface{}
+	}{
+		{"Literal UInt64_3", uint64(3)},
+		{"Literal Int64_-3", int64(-3)},
+		{"Literal Float64_1.5", 1.5},
+		{"Literal Bool_1", true},
+		{"Literal Bool_0", false},
+		{"Literal NULL", nil},
+		{"Literal ' '", " "},
+		{"Literal 'a literal with spaces'", "a literal with spaces"},
+		{`Literal 'it\'s a.b'`, "it's a.b"},
+		{"Literal Int128_170141183460469231731687303715884105727", huge},
+		{"Literal Array_['an', 'array', 'literal']", []interface{}{"an", "array", "literal"}},
+		{"Literal Array_[UInt64_1, UInt64_2]", []interface{}{uint64(1), uint64(2)}},
+		{"Literal Array_[]", []interface{}{}},
+		{"Literal Tuple_(UInt64_5, 'maximus', 'jebediah')", Tuple{uint64(5), "maximus", "jebediah"}},
+		{"Literal Tuple_('a b', Array_[Tuple_(UInt64_1, NULL)])", Tuple{"a b", []interface{}{Tuple{uint64(1), nil}}}},
+		{"Literal Map_(Tuple_('a', UInt64_1), Tuple_('b', UInt64_2))", map[interface{}]interface{}{"a": uint64(1), "b": uint64(2)}},
+		{"Literal Decimal64_'1.50'", "1.50"},
+	}
+
+	for _, c := range cases {
+		value, err := literalNode(t, c.line).LiteralValue()
+
+		assert.NoError(t, err, c.line)
+		assert.Equal(t, c.expected, value, c.line)
+	}
+}
+
+func TestLiteralWithAlias(t *testing.T) {
+	node := literalNode(t, "Literal Array_[UInt64_1, UInt64_2] (alias x)")
+
+	assert.Equal(t, "Array_[UInt64_1, UInt64_2]", node.Value)
+	assert.Equal(t, "x", node.Alias)
+}
+
+func TestLiteralValueErrors(t *testing.T) {
+	_, err := literalNode(t, "Identifier z").LiteralValue()
+	assert.Error(t, err)
+
+	_, err = literalNode(t, "Literal Array_[UInt64_1").LiteralValue()
+	assert.Error(t, err)
+}
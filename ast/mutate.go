@@ -0,0 +1,150 @@
+package ast
+
+import "fmt"
+
+// Tree mutations. These keep Parent links, indentation, "(children N)" counts,
+// RawLine, Meta and hashes consistent, which editing Parent and Children directly doesn't.
+
+// InsertChild inserts child at index among n's children, detaching it from any
+// tree it's currently part of.
+func (n *AstNode) InsertChild(index int, child *AstNode) error {
+	if index < 0 || index > len(n.Children) {
+		return fmt.Errorf("child index %d out of range for %s node with %d children", index, n.Type, len(n.Children))
+	}
+
+	for ancestor := n; ancestor != nil; ancestor = ancestor.Parent {
+		if ancestor == child {
+			return fmt.Errorf("cannot insert %s node beneath itself", child.Type)
+		}
+	}
+
+	if child.Parent != nil {
+		if child.Parent == n && siblingIndex(child) < index {
+			index--
+		}
+		child.Detach()
+	}
+
+	n.Children = append(n.Children, nil)
+	copy(n.Children[index+1:], n.Children[index:])
+	n.Children[index] = child
+	child.Parent = n
+
+	child.reindent(n.Indent + 1)
+	n.childrenChanged(child)
+
+	return nil
+}
+
+// AppendChild adds child as n's last child.
+func (n *AstNode) AppendChild(child *AstNode) error {
+	return n.InsertChild(len(n.Children), child)
+}
+
+// Detach removes n from its parent and returns it as the root of its own tree,
+// ready to be inserted elsewhere.
+func (n *AstNode) Detach() *AstNode {
+	parent := n.Parent
+
+	if parent != nil {
+		index := siblingIndex(n)
+		parent.Children = append(parent.Children[:index], parent.Children[index+1:]...)
+		n.Parent = nil
+		parent.childrenChanged(n)
+	}
+
+	n.reindent(0)
+
+	return n
+}
+
+// Remove deletes n from its tree.
+func (n *AstNode) Remove() error {
+	if n.Parent == nil {
+		return fmt.Errorf("cannot remove root %s node", n.Type)
+	}
+
+	n.Detach()
+
+	return nil
+}
+
+// ReplaceWith puts replacement in n's place and detaches n.
+func (n *AstNode) ReplaceWith(replacement *AstNode) error {
+	if n.Parent == nil {
+		return fmt.Errorf("cannot replace root %s node", n.Type)
+	}
+
+	if replacement == n {
+		return nil
+	}
+
+	parent := n.Parent
+	if err := parent.InsertChild(siblingIndex(n), replacement); err != nil {
+		return err
+	}
+
+	n.Detach()
+
+	return nil
+}
+
+// Clone returns a deep copy of n's subtree as the root of a new tree.
+func (n *AstNode) Clone() *AstNode {
+	clone := n.cloneSubtree(nil)
+	clone.reindent(0)
+
+	return clone
+}
+
+func (n *AstNode) cloneSubtree(parent *AstNode) *AstNode {
+	clone := *n
+	clone.Parent = parent
+	clone.Annotations = append([]MetaAnnotation(nil), n.Annotations...)
+	clone.Path.Parts = append([]IdentifierPart(nil), n.Path.Parts...)
+	clone.Path.Subcolumns = append([]string(nil), n.Path.Subcolumns...)
+
+	if n.Hints != nil {
+		clone.Hints = make(map[string]string, len(n.Hints))
+		for key, value := range n.Hints {
+			clone.Hints[key] = value
+		}
+	}
+
+	clone.Children = make([]*AstNode, len(n.Children))
+
+	for i, child := range n.Children {
+		clone.Children[i] = child.cloneSubtree(&clone)
+	}
+
+	return &clone
+}
+
+// reindent shifts the subtree so n sits at indent, refreshing each line.
+func (n *AstNode) reindent(indent int) {
+	if n.Indent == indent {
+		return
+	}
+
+	n.Walk(func(node *AstNode) {
+		if node.Parent == nil || node == n {
+			node.Indent = indent
+		} else {
+			node.Indent = node.Parent.Indent + 1
+		}
+		node.refreshLine()
+	})
+}
+
+// childrenChanged refreshes n after child was added to or removed from it.
+func (n *AstNode) childrenChanged(child *AstNode) {
+	if !child.Synthetic {
+		n.refreshLine()
+	}
+
+	if child.Parent == n {
+		child.UpdateHash()
+	} else {
+		n.updateHashUpwards()
+	}
+}
@@ -0,0 +1,106 @@
+package ast
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func selectListOf(root *AstNode) *AstNode {
+	return root.Children[0].Children[0].Children[0]
+}
+
+func TestInsertChild(t *testing.T) {
+	root, err := Parse("", astLines())
+	assert.NoError(t, err)
+
+	selectList := selectListOf(root)
+	err = selectList.InsertChild(1, &AstNode{Type: "Identifier", Value: "added", Alias: "a"})
+	assert.NoError(t, err)
+
+	added := selectList.Children[1]
+	assert.Equal(t, selectList, added.Parent)
+	assert.Equal(t, 4, added.Indent)
+	assert.Equal(t, "    Identifier added (alias a)", added.RawLine)
+	assert.Equal(t, 4, selectList.DeclaredChildren)
+	assert.Equal(t, "   ExpressionList (children 4)", selectList.RawLine)
+	assert.Equal(t, "(children 4)", selectList.Meta)
+
+	lines := astLines()
+	lines[3] = "   ExpressionList (children 4)"
+	lines = append(lines[:5], append([]string{"    Identifier added (alias a)"}, lines[5:]...)...)
+	expected, err := Parse("", lines)
+	assert.NoError(t, err)
+	assert.Equal(t, expected.Hash, root.Hash)
+
+	assert.Error(t, selectList.InsertChild(10, &AstNode{Type: "Asterisk"}))
+	assert.Error(t, selectList.InsertChild(0, root))
+}
+
+func TestRemoveAndDetach(t *testing.T) {
+	root, err := Parse("", astLines())
+	assert.NoError(t, err)
+	original := root.Hash
+
+	selectList := selectListOf(root)
+	function := selectList.Children[2]
+
+	detached := function.Detach()
+	assert.Nil(t, detached.Parent)
+	assert.Equal(t, 0, detached.Indent)
+	assert.Equal(t, "Function z (alias r) (children 1)", detached.RawLine)
+	assert.Equal(t, " ExpressionList", detached.Children[0].RawLine)
+	assert.Equal(t, "   ExpressionList (children 2)", selectList.RawLine)
+	assert.NotEqual(t, original, root.Hash)
+
+	assert.NoError(t, selectList.AppendChild(detached))
+	assert.Equal(t, "    Function z (alias r) (children 1)", detached.RawLine)
+	assert.Equal(t, "     ExpressionList", detached.Children[0].RawLine)
+	assert.Equal(t, original, root.Hash)
+
+	assert.NoError(t, selectList.Children[0].Remove())
+	assert.Equal(t, 2, selectList.DeclaredChildren)
+	assert.Error(t, root.Remove())
+}
+
+func TestReplaceWithAndClone(t *testing.T) {
+	root, err := Parse("", astLines())
+	assert.NoError(t, err)
+
+	selectList := selectListOf(root)
+	identifier := selectList.Children[1]
+	clone := identifier.Clone()
+
+	assert.Equal(t, 0, clone.Indent)
+	assert.Equal(t, "Identifier z (alias n)", clone.RawLine)
+	assert.Equal(t, identifier.Hash, clone.Hash)
+
+	clone.Value = "y"
+	clone.UpdateHash()
+	assert.NoError(t, identifier.ReplaceWith(clone))
+
+	assert.Equal(t, clone, selectList.Children[1])
+	assert.Nil(t, identifier.Parent)
+	assert.Equal(t, "    Identifier y (alias n)", clone.RawLine)
+	assert.Equal(t, "z", identifier.Value)
+
+	fromScratch, err := Parse("", []string{
+		"ExpressionList (children 3)",
+		" Asterisk",
+		" Identifier y (alias n)",
+		" Function z (alias r) (children 1)",
+		"  ExpressionList",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, fromScratch.Hash, selectList.Hash)
+}
+
+func TestMaterializedViewToNodeIsSynthetic(t *testing.T) {
+	query := "CREATE MATERIALIZED ViEW \n my_table_or_view to some_table AS select * from z;"
+	root, err := Parse(query, createQueryAstLines())
+	assert.NoError(t, err)
+
+	assert.True(t, root.Children[0].Synthetic)
+	assert.Equal(t, "CreateQuery  my_table_or_view (children 2)", root.RawLine)
+	assert.Equal(t, 2, root.DeclaredChildren)
+}
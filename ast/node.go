@@ -1,6 +1,17 @@
 package ast
 
-// TODO: add hash
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"strconv"
+)
+
+// MetaAnnotation is a parenthesised "(key value)" annotation trailing an explain line.
+type MetaAnnotation struct {
+	Key   string
+	Value string
+}
+
 type AstNode struct {
 	RawLine string
 	Indent  int
@@ -8,10 +19,31 @@ type AstNode struct {
 	Value   string
 	// Think table name, database name, etc.
 	ValueQualifier string
-	Alias          string
-	Meta           string
-	// Hash int64 // hash of the node and
-	// children to quickly compare branches
+	// Path is the full identifier path for identifier and table level nodes.
+	Path  IdentifierPath
+	Alias string
+	// Meta is the raw parenthesised annotation text, e.g. "(alias x) (children 2)".
+	// Its alias and children count are parsed into Alias and DeclaredChildren.
+	Meta string
+	// Annotations holds any other parenthesised annotations in the order they appeared.
+	Annotations []MetaAnnotation
+	// DeclaredChildren is the N from "(children N)" in the explain output.
+	DeclaredChildren int
+	// LineNumber is the 1-based line in the explain output this node was parsed from.
+	LineNumber int
+	// Synthetic nodes aren't present in explain output. They're added to work around
+	// information explain ast leaves out and aren't counted as declared children.
+	Synthetic bool
+	// Hints holds details explain ast leaves out, such as join kinds and ORDER BY
+	// directions, recovered from the source query when the tree is parsed. They
+	// aren't serialized or hashed.
+	Hints map[string]string
+	// hintSource is set on the root of a tree parsed with a source query.
+	hintSource *treeHints
+	// Hash covers the node's type, value, qualifier, alias, the database and subcolumns
+	// of its Path and its children's hashes so identical branches can be found and
+	// compared quickly.
+	Hash     uint64
 	Parent   *AstNode
 	Children []*AstNode
 }
@@ -26,6 +58,87 @@ func (n *AstNode) Walk(cb func(node *AstNode)) {
 	}
 }
 
+// ComputeHash recomputes the hashes of the node's whole subtree.
+func (n *AstNode) ComputeHash() uint64 {
+	for _, child := range n.Children {
+		child.ComputeHash()
+	}
+
+	n.Hash = n.localHash()
+
+	return n.Hash
+}
+
+// UpdateHash recomputes the hashes of the node's subtree and of every ancestor,
+// which must be done after the tree is changed.
+func (n *AstNode) UpdateHash() {
+	n.ComputeHash()
+
+	if n.Parent != nil {
+		n.Parent.updateHashUpwards()
+	}
+}
+
+// updateHashUpwards rehashes n and its ancestors, assuming n's children are up to date.
+func (n *AstNode) updateHashUpwards() {
+	for node := n; node != nil; node = node.Parent {
+		node.Hash = node.localHash()
+	}
+}
+
+// localHash hashes the node's own fields together with its children's current hashes.
+func (n *AstNode) localHash() uint64 {
+	h := fnv.New64a()
+
+	// An identifier's database and tuple element or subcolumn parts are only in its Path.
+	fields := append([]string{n.Type, n.Value, n.ValueQualifier, n.Alias, n.Path.Database}, n.Path.Subcolumns...)
+
+	for _, field := range fields {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+
+	buf := make([]byte, 8)
+	for _, child := range n.Children {
+		binary.LittleEndian.PutUint64(buf, child.Hash)
+		h.Write(buf)
+	}
+
+	return h.Sum64()
+}
+
+// Annotation returns the value of a parenthesised meta annotation by key,
+// including "alias" and "children".
+func (n *AstNode) Annotation(key string) (string, bool) {
+	switch key {
+	case "alias":
+		return n.Alias, n.Alias != ""
+	case "children":
+		return strconv.Itoa(n.DeclaredChildren), n.DeclaredChildren > 0
+	}
+
+	for _, annotation := range n.Annotations {
+		if annotation.Key == key {
+			return annotation.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// explainChildren returns the children that appear in explain output.
+func (node *AstNode) explainChildren() []*AstNode {
+	var children []*AstNode
+
+	for _, child := range node.Children {
+		if !child.Synthetic {
+			children = append(children, child)
+		}
+	}
+
+	return children
+}
+
 func (node *AstNode) descendentOf(parentType string) bool {
 	return node.nearestParentOfType(parentType) != nil
 }
@@ -0,0 +1,68 @@
+package ast
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashIsStableAndStructural(t *testing.T) {
+	a, err := Parse("", astLines())
+	assert.NoError(t, err)
+	b, err := Parse("", astLines())
+	assert.NoError(t, err)
+
+	assert.NotZero(t, a.Hash)
+	assert.Equal(t, a.Hash, b.Hash)
+
+	selectList := a.Children[0].Children[0].Children[0]
+	assert.NotEqual(t, selectList.Children[1].Hash, selectList.Children[2].Hash)
+
+	c, err := Parse("", createQueryAstLines())
+	assert.NoError(t, err)
+	assert.NotEqual(t, a.Hash, c.Hash)
+}
+
+func TestHashCoversIdentifierPath(t *testing.T) {
+	hash := func(line string) uint64 {
+		root, err := Parse("", []string{line})
+		assert.NoError(t, err)
+		return root.Hash
+	}
+
+	assert.NotEqual(t, hash("Identifier db1.t.z"), hash("Identifier db2.t.z"))
+	assert.NotEqual(t, hash("Identifier tup.1"), hash("Identifier tup.2"))
+	assert.NotEqual(t, hash("Identifier tup"), hash("Identifier tup.1"))
+	assert.Equal(t, hash("Identifier `t`.z"), hash("Identifier t.z"), "quoting isn't hashed")
+}
+
+func TestUpdateHashPropagatesToAncestors(t *testing.T) {
+	root, err := Parse("", astLines())
+	assert.NoError(t, err)
+
+	original := root.Hash
+	identifier := root.Children[0].Children[0].Children[0].Children[1]
+	parentHash := identifier.Parent.Hash
+
+	identifier.Alias = "renamed"
+	identifier.UpdateHash()
+
+	assert.NotEqual(t, original, root.Hash)
+	assert.NotEqual(t, parentHash, identifier.Parent.Hash)
+
+	identifier.Alias = "n"
+	identifier.UpdateHash()
+
+	assert.Equal(t, original, root.Hash)
+}
+
+func TestIdenticalSubtrees(t *testing.T) {
+	a1, _ := NewFromExplainLines("view 1", createQueryAstLines())
+	a2, _ := NewFromExplainLines("view 2", createQueryAstLines())
+	a3, _ := NewFromExplainLines("select", astLines())
+
+	groups := IdenticalSubtrees("SelectWithUnionQuery", a1, a2, a3)
+
+	assert.Len(t, groups, 1)
+	assert.Equal(t, []*AstNode{a1.Root.Children[1], a2.Root.Children[1]}, groups[0])
+}
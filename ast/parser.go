@@ -1,20 +1,83 @@
 package ast
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
-var aliasRegex = regexp.MustCompile(`\(alias ([^)]+)\)`)
+// parseMetaAnnotations splits explain meta text such as "(alias x) (children 2)"
+// into its parenthesised key/value annotations. Quoted values may contain parentheses.
+func parseMetaAnnotations(meta string) []MetaAnnotation {
+	var annotations []MetaAnnotation
 
-func aliasFromMeta(meta string) string {
-	match := aliasRegex.FindStringSubmatch(meta)
+	i := 0
+	for i < len(meta) {
+		if meta[i] == ' ' {
+			i++
+			continue
+		}
 
-	if match != nil {
-		return match[1]
-	} else {
-		return ""
+		if meta[i] != '(' {
+			return annotations
+		}
+
+		depth := 0
+		var quote byte
+		end := -1
+
+		for j := i; j < len(meta) && end == -1; j++ {
+			c := meta[j]
+
+			switch {
+			case quote != 0:
+				if c == '\\' {
+					j++
+				} else if c == quote {
+					quote = 0
+				}
+			case c == '`' || c == '\'' || c == '"':
+				quote = c
+			case c == '(':
+				depth++
+			case c == ')':
+				depth--
+				if depth == 0 {
+					end = j
+				}
+			}
+		}
+
+		if end == -1 {
+			return annotations
+		}
+
+		key, value, _ := strings.Cut(meta[i+1:end], " ")
+		annotations = append(annotations, MetaAnnotation{Key: key, Value: value})
+		i = end + 1
+	}
+
+	return annotations
+}
+
+// setMeta stores the raw meta text and its structured alias, children count and
+// remaining annotations on node.
+func setMeta(meta string, node *AstNode) {
+	node.Meta = meta
+
+	for _, annotation := range parseMetaAnnotations(meta) {
+		switch annotation.Key {
+		case "alias":
+			node.Alias = annotation.Value
+		case "children":
+			node.DeclaredChildren, _ = strconv.Atoi(annotation.Value)
+		default:
+			node.Annotations = append(node.Annotations, annotation)
+		}
 	}
 }
 
@@ -28,19 +91,67 @@ var typeOnlyHandler = lineHandler{
 	MatchCallback: func(matches []string, node *AstNode) {},
 }
 
-var valueStringPattern = `([^ ]*(?:, .*\))?|[^ ]*'(?:.*)?'[^ ]?)`
+// The last alternative matches identifiers with quoted parts that may contain spaces,
+// such as `my db`.t ("BQ" stands in for a backquote, which raw strings can't hold).
+var valueStringPattern = strings.ReplaceAll(
+	`([^ ]*(?:, .*\))?|[^ ]*'(?:.*)?'[^ ]?|(?:[^ "BQ]|BQ(?:[^\\BQ]|\\.)*BQ|"(?:[^"\\]|\\.)*")+)`,
+	"BQ", "`")
+
+// Node types whose value is an identifier that may be qualified or quoted.
+var identifierValueTypes = map[string]bool{
+	"Identifier":        true,
+	"ColumnDeclaration": true,
+}
 
 func setValueAndQualifier(value string, node *AstNode) {
-	valueWithQualifier := strings.Split(value, ".")
+	node.Value = value
 
-	if len(valueWithQualifier) == 2 {
-		node.ValueQualifier = valueWithQualifier[0]
-		node.Value = valueWithQualifier[1]
-	} else {
-		node.Value = value
+	if !identifierValueTypes[node.Type] && !tableLevelTypes[node.Type] {
+		return
+	}
+
+	parts, err := splitIdentifier(value)
+	if err != nil {
+		return
+	}
+
+	node.Path = newIdentifierPath(node.Type, parts)
+
+	switch {
+	case tableLevelTypes[node.Type]:
+		node.Value = node.Path.Table
+		node.ValueQualifier = node.Path.Database
+	case node.Type == "ColumnDeclaration":
+		// Nested columns contain dots in their name, e.g. n.a
+		names := append([]string{node.Path.Column}, node.Path.Subcolumns...)
+		node.Value = strings.Join(names, ".")
+	default:
+		node.Value = node.Path.Column
+		node.ValueQualifier = node.Path.Table
 	}
 }
 
+func setDatabaseAndTable(database string, table string, node *AstNode) {
+	node.Value = table
+	node.ValueQualifier = database
+	node.Path = IdentifierPath{Database: database, Table: table}
+
+	if database != "" {
+		node.Path.Parts = append(node.Path.Parts, IdentifierPart{Name: database})
+	}
+	node.Path.Parts = append(node.Path.Parts, IdentifierPart{Name: table})
+}
+
+// Literal values can hold arbitrary strings, arrays and tuples so they're matched
+// up to an optional trailing alias rather than with valueStringPattern.
+var literalHandler = lineHandler{
+	Matcher: regexp.MustCompile(`^( *)(Literal) +(.*?)(?: +(\(alias [^()]+\)))?$`),
+	MatchCallback: func(matches []string, node *AstNode) {
+		node.Value = matches[3]
+		setMeta(matches[4], node)
+	},
+}
+
 var typeWithValueHandler = lineHandler{
 	Matcher: regexp.MustCompile(fmt.Sprintf("^( *)([^ ]+) +%s$", valueStringPattern)),
 	MatchCallback: func(matches []string, node *AstNode) {
@@ -49,20 +160,18 @@ var typeWithValueHandler = lineHandler{
 }
 
 var typeWithTwoValuesAndMetaHandler = lineHandler{
-	Matcher: regexp.MustCompile(fmt.Sprintf(`^( *)([^ ]+) +%s +%s +\((.+)\)$`, valueStringPattern, valueStringPattern)),
+	Matcher: regexp.MustCompile(fmt.Sprintf(`^( *)([^ ]+) +%s +%s +(\(.+\))$`, valueStringPattern, valueStringPattern)),
 	MatchCallback: func(matches []string, node *AstNode) {
-		node.Value = matches[4]
 		// I've only encountered this node type when there's a create table with a database name specified as a part of the table name.
-		node.ValueQualifier = matches[3]
-		node.Meta = matches[5]
+		setDatabaseAndTable(matches[3], matches[4], node)
+		setMeta(matches[5], node)
 	},
 }
 
 var typeWithMetaHandler = lineHandler{
-	Matcher: regexp.MustCompile(`^( *)([^ ]+) +\((.+)\)$`),
+	Matcher: regexp.MustCompile(`^( *)([^ ]+) +(\(.+\))$`),
 	MatchCallback: func(matches []string, node *AstNode) {
-		node.Meta = matches[3]
-		node.Alias = aliasFromMeta(matches[3])
+		setMeta(matches[3], node)
 	},
 }
 
@@ -70,12 +179,12 @@ var typeWithValueAndMetaHandler = lineHandler{
 	Matcher: regexp.MustCompile(fmt.Sprintf(`^( *)([^ ]+) +%s +(\(.+\))$`, valueStringPattern)),
 	MatchCallback: func(matches []string, node *AstNode) {
 		setValueAndQualifier(matches[3], node)
-		node.Meta = matches[4]
-		node.Alias = aliasFromMeta(matches[4])
+		setMeta(matches[4], node)
 	},
 }
 
 var allHandlers = []lineHandler{
+	literalHandler,
 	typeOnlyHandler,
 	typeWithMetaHandler,
 	typeWithValueAndMetaHandler,
@@ -100,88 +209,303 @@ func addMaterializedViewToNode(node *AstNode, sourceQuery string) {
 	lowerQuery := strings.ToLower(sourceQuery)
 	mvToTableMatch := materializedViewToTableRegex.FindStringSubmatch(lowerQuery)
 	if mvToTableMatch != nil {
-		node.Children = append(node.Children, &AstNode{
-			Type:  "MateralizedViewToTable",
-			Value: mvToTableMatch[1],
-			Children: []*AstNode{
-				{
-					Type:  "TableIdentifier",
-					Value: mvToTableMatch[1],
-				},
-			},
+		toNode := &AstNode{
+			Type:      "MateralizedViewToTable",
+			Value:     mvToTableMatch[1],
+			Synthetic: true,
+		}
+		toNode.AppendChild(&AstNode{
+			Type:      "TableIdentifier",
+			Value:     mvToTableMatch[1],
+			Synthetic: true,
 		})
+		node.InsertChild(0, toNode)
+	}
+}
+
+// ParseError describes an explain ast line that Parse could not place in the tree.
+type ParseError struct {
+	// Query is the statement whose explain output was being parsed.
+	Query string
+	// Line is the 1-based line number within the explain output.
+	Line    int
+	RawLine string
+	// ExpectedIndent is the deepest indentation that would have been accepted for this line.
+	ExpectedIndent int
+	// Patterns holds the line handler patterns that were tried.
+	Patterns []string
+	Reason   string
+}
+
+func (e *ParseError) Error() string {
+	msg := fmt.Sprintf("line %d: %s: %q (expected indent <= %d)", e.Line, e.Reason, e.RawLine, e.ExpectedIndent)
+
+	if e.Query != "" {
+		msg += " in query: " + e.Query
+	}
+
+	return msg
+}
+
+func handlerPatterns() []string {
+	patterns := make([]string, len(allHandlers))
+
+	for i, handler := range allHandlers {
+		patterns[i] = handler.Matcher.String()
+	}
+
+	return patterns
+}
+
+// ChildCountError reports a node whose "(children N)" annotation disagrees with
+// the number of children parsed beneath it, which usually means lines were misattached.
+type ChildCountError struct {
+	Query    string
+	Line     int
+	RawLine  string
+	Declared int
+	Actual   int
+}
+
+func (e *ChildCountError) Error() string {
+	msg := fmt.Sprintf("line %d: declared %d children but parsed %d: %q", e.Line, e.Declared, e.Actual, e.RawLine)
+
+	if e.Query != "" {
+		msg += " in query: " + e.Query
 	}
+
+	return msg
+}
+
+// ParseOptions controls how strictly explain output is validated.
+type ParseOptions struct {
+	// WarnOnChildCountMismatch reports ChildCountErrors to Warn instead of failing the parse.
+	WarnOnChildCountMismatch bool
+	// Warn receives non-fatal problems, including HintMismatchErrors for source query
+	// hints that couldn't be matched to the tree. They're dropped if it's nil.
+	Warn func(err error)
+}
+
+func (o ParseOptions) warn() func(err error) {
+	if o.Warn != nil {
+		return o.Warn
+	}
+
+	return func(err error) {}
 }
 
-func Parse(sourceQuery string, lines []string) (root *AstNode, err error) {
-	var previousLine *AstNode
+// parser builds an AstNode tree one explain line at a time.
+type parser struct {
+	options      ParseOptions
+	sourceQuery  string
+	root         *AstNode
+	previousLine *AstNode
+	lineNumber   int
+}
+
+func newParser(sourceQuery string, options ParseOptions) *parser {
+	return &parser{sourceQuery: sourceQuery, options: options}
+}
+
+func (p *parser) error(line string, reason string) *ParseError {
+	expectedIndent := 0
+	if p.previousLine != nil {
+		expectedIndent = p.previousLine.Indent + 1
+	}
+
+	return &ParseError{
+		Query:          p.sourceQuery,
+		Line:           p.lineNumber,
+		RawLine:        line,
+		ExpectedIndent: expectedIndent,
+		Patterns:       handlerPatterns(),
+		Reason:         reason,
+	}
+}
+
+// parseLine consumes the next line of explain output.
+func (p *parser) parseLine(line string) error {
+	p.lineNumber++
+
+	line = strings.TrimRight(line, "\r\n")
+
+	if line == "" || strings.HasPrefix(line, "Explain EXPLAIN AST ") {
+		return nil
+	}
+
+	var err error
 
 	handleMatch := func(r *regexp.Regexp, line string, cb func(matches []string, line *AstNode)) bool {
 		matches := r.FindStringSubmatch(line)
 
-		if matches != nil {
-			parsedLine := AstNode{RawLine: line}
-			parsedLine.Indent = len(matches[1])
-			parsedLine.Type = matches[2]
-			var previousParent *AstNode
+		if matches == nil {
+			return false
+		}
 
-			if previousLine != nil {
-				previousParent = previousLine.Parent
-			}
+		err = p.addNode(line, matches, cb)
 
-			cb(matches, &parsedLine)
-
-			if previousLine != nil {
-				if previousLine.Indent < parsedLine.Indent {
-					previousLine.Children = append(previousLine.Children, &parsedLine)
-					parsedLine.Parent = previousLine
-				} else if previousLine.Indent == parsedLine.Indent && previousParent != nil {
-					previousParent.Children = append(previousParent.Children, &parsedLine)
-					parsedLine.Parent = previousParent
-				} else if previousLine.Indent > parsedLine.Indent {
-					var previousParentParent *AstNode
-
-					if previousParent.Parent != nil {
-						previousParentParent = previousParent.Parent
-
-						for previousParentParent.Indent != parsedLine.Indent-1 {
-							previousParentParent = previousParentParent.Parent
-							if previousParentParent == nil {
-								panic("Could not find parent parent")
-							}
-						}
-
-						previousParentParent.Children = append(previousParentParent.Children, &parsedLine)
-						parsedLine.Parent = previousParentParent
-					}
-				}
-			} else {
-				root = &parsedLine
-			}
+		return true
+	}
 
-			if parsedLine.Type == "CreateQuery" {
-				addMaterializedViewToNode(&parsedLine, sourceQuery)
-			}
+	anyMatch := applyLineHandlers(line, handleMatch)
 
-			previousLine = &parsedLine
+	if !anyMatch {
+		return p.error(line, "no handler matched line")
+	}
 
-			return true
+	return err
+}
+
+func (p *parser) addNode(line string, matches []string, cb func(matches []string, line *AstNode)) error {
+	parsedLine := AstNode{RawLine: line, LineNumber: p.lineNumber}
+	parsedLine.Indent = len(matches[1])
+	parsedLine.Type = matches[2]
+
+	cb(matches, &parsedLine)
+
+	if p.previousLine == nil {
+		if parsedLine.Indent != 0 {
+			return p.error(line, "root node must not be indented")
 		}
 
-		return false
+		p.root = &parsedLine
+	} else if parsedLine.Indent == p.previousLine.Indent+1 {
+		p.previousLine.Children = append(p.previousLine.Children, &parsedLine)
+		parsedLine.Parent = p.previousLine
+	} else if parsedLine.Indent > p.previousLine.Indent {
+		return p.error(line, "indentation increased by more than one level")
+	} else {
+		parent := p.previousLine.Parent
+
+		for parent != nil && parent.Indent != parsedLine.Indent-1 {
+			parent = parent.Parent
+		}
+
+		if parent == nil {
+			return p.error(line, "could not find parent node")
+		}
+
+		parent.Children = append(parent.Children, &parsedLine)
+		parsedLine.Parent = parent
+	}
+
+	p.previousLine = &parsedLine
+
+	return nil
+}
+
+// finish validates the declared children counts of the parsed tree and returns its root.
+func (p *parser) finish() (*AstNode, error) {
+	if p.root == nil {
+		return nil, nil
+	}
+
+	p.root.Walk(func(node *AstNode) {
+		if node.Type == "CreateQuery" && !node.Synthetic {
+			addMaterializedViewToNode(node, p.sourceQuery)
+		}
+	})
+
+	if strings.TrimSpace(p.sourceQuery) != "" {
+		hints := &treeHints{query: p.sourceQuery, mismatches: applySourceHints(p.root, p.sourceQuery)}
+		p.root.hintSource = hints
+
+		for _, mismatch := range hints.mismatches {
+			p.options.warn()(mismatch)
+		}
 	}
 
+	p.root.ComputeHash()
+
+	var mismatches []error
+
+	p.root.Walk(func(node *AstNode) {
+		if node.Synthetic {
+			return
+		}
+
+		actual := len(node.explainChildren())
+		if actual != node.DeclaredChildren {
+			mismatches = append(mismatches, &ChildCountError{
+				Query:    p.sourceQuery,
+				Line:     node.LineNumber,
+				RawLine:  node.RawLine,
+				Declared: node.DeclaredChildren,
+				Actual:   actual,
+			})
+		}
+	})
+
+	if len(mismatches) == 0 {
+		return p.root, nil
+	}
+
+	if !p.options.WarnOnChildCountMismatch {
+		return nil, mismatches[0]
+	}
+
+	warn := p.options.warn()
+
+	for _, mismatch := range mismatches {
+		warn(mismatch)
+	}
+
+	return p.root, nil
+}
+
+func Parse(sourceQuery string, lines []string) (*AstNode, error) {
+	return ParseWithOptions(sourceQuery, lines, ParseOptions{})
+}
+
+func ParseWithOptions(sourceQuery string, lines []string, options ParseOptions) (*AstNode, error) {
+	p := newParser(sourceQuery, options)
+
 	for _, line := range lines {
-		if line == "" || strings.HasPrefix(line, "Explain EXPLAIN AST ") {
-			continue
+		if err := p.parseLine(line); err != nil {
+			return nil, err
+		}
+	}
+
+	return p.finish()
+}
+
+// ParseReader builds the tree from explain output read line by line from r,
+// so the whole output never has to be held in memory as strings.
+func ParseReader(sourceQuery string, r io.Reader) (*AstNode, error) {
+	return ParseReaderWithOptions(sourceQuery, r, ParseOptions{})
+}
+
+func ParseReaderWithOptions(sourceQuery string, r io.Reader, options ParseOptions) (*AstNode, error) {
+	p := newParser(sourceQuery, options)
+	reader := bufio.NewReader(r)
+
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return nil, readErr
 		}
 
-		anyMatch := applyLineHandlers(line, handleMatch)
+		if line != "" {
+			if err := p.parseLine(line); err != nil {
+				return nil, err
+			}
+		}
 
-		if !anyMatch {
-			panic("No match for line: " + line)
+		if readErr == io.EOF {
+			break
 		}
 	}
 
-	return
+	return p.finish()
+}
+
+// ParseFile parses a saved explain ast text dump.
+func ParseFile(sourceQuery string, path string) (*AstNode, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ParseReader(sourceQuery, file)
 }
@@ -1,6 +1,7 @@
 package ast
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -26,6 +27,109 @@ func TestParse(t *testing.T) {
 	assert.Equal(t, "TableIdentifier", root.Children[0].Children[0].Children[1].Children[0].Children[0].Children[0].Type)
 }
 
+func TestParseDeclaredChildren(t *testing.T) {
+	root, err := Parse("", astLines())
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, root.DeclaredChildren)
+	assert.Equal(t, 3, root.Children[0].Children[0].Children[0].DeclaredChildren)
+	assert.Equal(t, 0, root.Children[0].Children[0].Children[0].Children[0].DeclaredChildren)
+}
+
+func TestParseChildCountMismatch(t *testing.T) {
+	lines := []string{
+		"SelectWithUnionQuery (children 1)",
+		" ExpressionList (children 2)",
+		"  SelectQuery",
+	}
+
+	_, err := Parse("select 1", lines)
+
+	var countErr *ChildCountError
+	assert.ErrorAs(t, err, &countErr)
+	assert.Equal(t, 2, countErr.Line)
+	assert.Equal(t, 2, countErr.Declared)
+	assert.Equal(t, 1, countErr.Actual)
+
+	var warnings []error
+	root, err := ParseWithOptions("", lines, ParseOptions{
+		WarnOnChildCountMismatch: true,
+		Warn:                     func(err error) { warnings = append(warnings, err) },
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "SelectWithUnionQuery", root.Type)
+	assert.Len(t, warnings, 1)
+}
+
+func TestParseMeta(t *testing.T) {
+	root, err := Parse("", astLines())
+	assert.NoError(t, err)
+
+	selectList := root.Children[0].Children[0].Children[0]
+	assert.Equal(t, "(children 3)", selectList.Meta)
+
+	function := selectList.Children[2]
+	assert.Equal(t, "(alias r) (children 1)", function.Meta)
+	assert.Equal(t, "r", function.Alias)
+	assert.Equal(t, 1, function.DeclaredChildren)
+	assert.Empty(t, function.Annotations)
+
+	alias, ok := function.Annotation("alias")
+	assert.True(t, ok)
+	assert.Equal(t, "r", alias)
+}
+
+func TestParseMetaAnnotations(t *testing.T) {
+	annotations := parseMetaAnnotations("(alias `a (b)`) (uuid '1234') (children 2)")
+
+	assert.Equal(t, []MetaAnnotation{
+		{Key: "alias", Value: "`a (b)`"},
+		{Key: "uuid", Value: "'1234'"},
+		{Key: "children", Value: "2"},
+	}, annotations)
+
+	root, err := Parse("", []string{"TableIdentifier t (uuid '1234')"})
+	assert.NoError(t, err)
+
+	uuid, ok := root.Annotation("uuid")
+	assert.True(t, ok)
+	assert.Equal(t, "'1234'", uuid)
+}
+
+func TestParseLiteralAlias(t *testing.T) {
+	root, err := Parse("", []string{
+		"ExpressionList (children 2)",
+		" Literal Tuple_('a (alias b)')",
+		" Literal UInt64_1 (alias one)",
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "Tuple_('a (alias b)')", root.Children[0].Value)
+	assert.Empty(t, root.Children[0].Alias)
+	assert.Equal(t, "UInt64_1", root.Children[1].Value)
+	assert.Equal(t, "one", root.Children[1].Alias)
+}
+
+func TestParseReader(t *testing.T) {
+	expected, err := Parse("", astLines())
+	assert.NoError(t, err)
+
+	root, err := ParseReader("", strings.NewReader(strings.Join(astLines(), "\r\n")))
+	assert.NoError(t, err)
+
+	assert.Equal(t, expected, root)
+}
+
+func TestParseFile(t *testing.T) {
+	root, err := ParseFile("select * from my_table_or_view", "testdata/select_asterisk.txt")
+	assert.NoError(t, err)
+
+	assert.Equal(t, "SelectWithUnionQuery", root.Type)
+	assert.Equal(t, "Asterisk", root.Children[0].Children[0].Children[0].Children[0].Type)
+	assert.Equal(t, "my_table_or_view", root.Children[0].Children[0].Children[1].Children[0].Children[0].Children[0].Value)
+}
+
 func TestParseCreateMaterializedView(t *testing.T) {
 	query := "CREATE MATERIALIZED ViEW \n my_table_or_view to some_table AS select * from z;"
 	root, err := Parse(query, createQueryAstLines())
@@ -47,6 +151,27 @@ func TestTableIdentifiers(t *testing.T) {
 	assert.Equal(t, []string{"my_table_or_view"}, tableIdentifiers)
 }
 
+func TestCreateTableAsTable(t *testing.T) {
+	tests := []struct {
+		query, database, table string
+		ok                     bool
+	}{
+		{"create table t as other", "", "other", true},
+		{"CREATE TABLE IF NOT EXISTS db.t ON CLUSTER c AS db2.other ENGINE = Memory", "db2", "other", true},
+		{"create table t as select * from other", "", "", false},
+		{"create table t (x UInt8) engine = MergeTree order by x as select x from other", "", "", false},
+		{"create table t (x UInt8) engine = Memory comment 'copied as other'", "", "", false},
+		{"create view v as other", "", "", false},
+	}
+
+	for _, test := range tests {
+		database, table, ok := createTableAsTable(test.query)
+		assert.Equal(t, test.ok, ok, test.query)
+		assert.Equal(t, test.database, database, test.query)
+		assert.Equal(t, test.table, table, test.query)
+	}
+}
+
 func TestFunctionCalls(t *testing.T) {
 	ast, _ := NewFromExplainLines("raw query", astLines())
 
@@ -65,3 +190,52 @@ func TestTuples(t *testing.T) {
 
 	assert.Equal(t, "SelectWithUnionQuery (children 1)", line)
 }
+
+func TestParseErrorOnUnmatchedLine(t *testing.T) {
+	lines := []string{
+		"SelectWithUnionQuery (children 1)",
+		" ExpressionList (children 1)",
+		"  Function some unexpected output",
+	}
+
+	_, err := Parse("select 1", lines)
+
+	var parseErr *ParseError
+	assert.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, 3, parseErr.Line)
+	assert.Equal(t, "  Function some unexpected output", parseErr.RawLine)
+	assert.Equal(t, 2, parseErr.ExpectedIndent)
+	assert.Equal(t, "select 1", parseErr.Query)
+	assert.Len(t, parseErr.Patterns, len(allHandlers))
+}
+
+func TestParseErrorOnMissingParent(t *testing.T) {
+	lines := []string{
+		"SelectWithUnionQuery (children 1)",
+		" ExpressionList (children 1)",
+		"SelectWithUnionQuery (children 1)",
+	}
+
+	_, err := Parse("select 1", lines)
+
+	var parseErr *ParseError
+	assert.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, 3, parseErr.Line)
+	assert.Equal(t, "could not find parent node", parseErr.Reason)
+}
+
+func TestNewFromQueryReturnsParseError(t *testing.T) {
+	exec := func(query string) ([]map[string]interface{}, error) {
+		return []map[string]interface{}{
+			{"explain": "SelectWithUnionQuery (children 1)"},
+			{"explain": "   ExpressionList"},
+		}, nil
+	}
+
+	_, err := QueriesInTopologicalOrder([]string{"select 1"}, exec)
+
+	var parseErr *ParseError
+	assert.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, "select 1", parseErr.Query)
+	assert.Equal(t, "indentation increased by more than one level", parseErr.Reason)
+}
@@ -0,0 +1,532 @@
+package ast
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SchemaChange is one ALTER TABLE command taking a table from the definition in one
+// CREATE TABLE statement to the definition in another.
+type SchemaChange struct {
+	// Kind is the AlterCommand kind, e.g. ADD_COLUMN or MODIFY_SETTING.
+	Kind string
+	// Name is the column, index or setting the command acts on, if any.
+	Name string
+	// Old and New are the nodes being changed in the old and new statements, such as
+	// ColumnDeclaration or Index nodes. Old is nil for additions and New for removals.
+	Old *AstNode
+	New *AstNode
+	// SQL is the command, e.g. "ADD COLUMN c UInt8 AFTER b". Impossible changes
+	// don't have one.
+	SQL string
+	// Safety says what applying the change does to the table's data, and Reason why.
+	Safety SchemaChangeSafety
+	Reason string
+}
+
+// The order SchemaDiff returns changes in. Indices are dropped before the columns they
+// might use, and new sorting key columns are added before MODIFY ORDER BY.
+var schemaChangeOrder = []string{
+	"MODIFY_ENGINE", "MODIFY_PARTITION_BY", "MODIFY_PRIMARY_KEY", "RENAME_COLUMN", "DROP_INDEX", "DROP_COLUMN", "ADD_COLUMN", "MODIFY_COLUMN", "COMMENT_COLUMN",
+	"ADD_INDEX", "MODIFY_ORDER_BY", "MODIFY_SAMPLE_BY", "REMOVE_SAMPLE_BY", "MODIFY_TTL", "REMOVE_TTL",
+	"MODIFY_SETTING", "RESET_SETTING", "MODIFY_COMMENT",
+}
+
+// SchemaDiff returns the ALTER TABLE commands that turn the table created by from
+// into the one created by to, in the order they need to run.
+//
+// Columns are matched by name, so a column that disappears is dropped and one that
+// appears is added, even when their definitions are the same. SchemaDiffWithOptions
+// takes the columns that were renamed instead. Changes ALTER can't make, to the engine,
+// partition key or primary key, or a sorting key change other than appending new
+// columns, are returned as SchemaChangeImpossible changes without SQL. Index names,
+// settings and which clause each storage key belongs to come from the statements'
+// source queries, so both should be parsed with them.
+func SchemaDiff(from, to CreateQuery) ([]SchemaChange, error) {
+	return SchemaDiffWithOptions(from, to, SchemaDiffOptions{})
+}
+
+// SchemaDiffOptions gives SchemaDiff what can't be told from the two statements.
+type SchemaDiffOptions struct {
+	// Renames maps the old names of renamed columns to their new ones. A column that
+	// disappears while another with the same definition appears could just as well
+	// have been replaced, and renaming it would serve its data under the new name,
+	// so renames are never guessed.
+	Renames map[string]string
+}
+
+// SchemaDiffWithOptions is SchemaDiff with renamed columns given by options.
+func SchemaDiffWithOptions(from, to CreateQuery, options SchemaDiffOptions) ([]SchemaChange, error) {
+	for _, c := range []CreateQuery{from, to} {
+		if c.Storage() == nil || c.Select() != nil || c.Node.firstChildOfType("Columns") == nil {
+			return nil, fmt.Errorf("%s isn't a CREATE TABLE statement with columns", c.Name())
+		}
+
+		if err := classifyStorageChildren(c.Storage()).check(c.Storage()); err != nil {
+			return nil, fmt.Errorf("%s: %w", c.Name(), err)
+		}
+
+		switch hints := c.Node.sourceHints(); {
+		case hints == nil:
+			return nil, fmt.Errorf("%s: explain ast leaves out index names, settings and column default kinds, parse the CREATE statements with their source queries", c.Name())
+		case len(hints.mismatches) > 0:
+			return nil, fmt.Errorf("%s: %w", c.Name(), hints.mismatches[0])
+		}
+	}
+
+	d := &schemaDiffer{f: newFormatter(DefaultFormatOptions()), from: from, to: to, renames: options.Renames}
+
+	for _, step := range []func() error{d.keys, d.columns, d.indices, d.orderBy, d.sampleBy, d.ttl, d.settings, d.comment} {
+		if err := step(); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, change := range d.changes {
+		if change.Safety == "" {
+			d.changes[i].Safety, d.changes[i].Reason = classifySchemaChange(change)
+		}
+	}
+
+	rank := map[string]int{}
+	for i, kind := range schemaChangeOrder {
+		rank[kind] = i
+	}
+
+	sort.SliceStable(d.changes, func(i, j int) bool {
+		return rank[d.changes[i].Kind] < rank[d.changes[j].Kind]
+	})
+
+	return d.changes, nil
+}
+
+// AlterStatements renders changes as ALTER TABLE statements for database.table.
+// Renames get a statement of their own ahead of everything else, since ClickHouse
+// won't rename a column in the same statement as other changes to it. Impossible
+// changes are an error.
+func AlterStatements(database string, table string, changes []SchemaChange) ([]string, error) {
+	f := newFormatter(DefaultFormatOptions())
+	var renames, commands []string
+
+	for _, change := range changes {
+		switch {
+		case change.Safety == SchemaChangeImpossible:
+			return nil, fmt.Errorf("cannot alter %s: %s", table, change.Reason)
+		case change.Kind == "RENAME_COLUMN":
+			renames = append(renames, change.SQL)
+		default:
+			commands = append(commands, change.SQL)
+		}
+	}
+
+	var statements []string
+	for _, group := range [][]string{renames, commands} {
+		if len(group) > 0 {
+			statements = append(statements, f.kw("ALTER TABLE")+" "+f.qualifiedName(database, table)+"\n"+f.verticalList(group))
+		}
+	}
+
+	return statements, nil
+}
+
+type schemaDiffer struct {
+	f       *formatter
+	from    CreateQuery
+	to      CreateQuery
+	changes []SchemaChange
+	renames map[string]string
+	// added holds the names of the columns being added, which new sorting key
+	// expressions are allowed to use.
+	added map[string]bool
+}
+
+func (d *schemaDiffer) add(kind string, name string, before *AstNode, after *AstNode, sql string) {
+	d.changes = append(d.changes, SchemaChange{Kind: kind, Name: name, Old: before, New: after, SQL: sql})
+}
+
+func (d *schemaDiffer) impossible(kind string, before *AstNode, after *AstNode, reason string) {
+	d.changes = append(d.changes, SchemaChange{Kind: kind, Old: before, New: after, Safety: SchemaChangeImpossible, Reason: reason})
+}
+
+// sameNode reports whether a and b are both missing or have identical subtrees.
+func sameNode(a *AstNode, b *AstNode) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Hash == b.Hash
+}
+
+func (d *schemaDiffer) keys() error {
+	keys := []struct {
+		kind     string
+		clause   string
+		from, to *AstNode
+	}{
+		{"MODIFY_ENGINE", "engine", d.from.Engine(), d.to.Engine()},
+		{"MODIFY_PARTITION_BY", "PARTITION BY", d.from.PartitionBy(), d.to.PartitionBy()},
+		{"MODIFY_PRIMARY_KEY", "PRIMARY KEY", d.from.PrimaryKey(), d.to.PrimaryKey()},
+	}
+
+	for _, key := range keys {
+		if !sameNode(key.from, key.to) {
+			d.impossible(key.kind, key.from, key.to, "the "+key.clause+" can't be changed in place, the table has to be recreated")
+		}
+	}
+
+	return nil
+}
+
+// columnDefinitionChanged reports whether anything but the comment differs between
+// two declarations of a column.
+func columnDefinitionChanged(a *AstNode, b *AstNode) bool {
+	ca, cb := classifyColumnChildren(a), classifyColumnChildren(b)
+
+	defaultKind := func(node *AstNode) string {
+		if kind := node.Hints[hintDefaultKind]; kind != "" {
+			return kind
+		}
+		return "DEFAULT"
+	}
+
+	return !sameNode(ca.dataType, cb.dataType) || !sameNode(ca.defaultValue, cb.defaultValue) ||
+		ca.defaultValue != nil && defaultKind(a) != defaultKind(b) ||
+		a.Hints[hintNullModifier] != b.Hints[hintNullModifier] ||
+		!sameNode(ca.codec, cb.codec) || !sameNode(ca.ttl, cb.ttl)
+}
+
+func columnCommentChanged(a *AstNode, b *AstNode) bool {
+	return !sameNode(classifyColumnChildren(a).comment, classifyColumnChildren(b).comment)
+}
+
+func (d *schemaDiffer) columns() error {
+	f := d.f
+	fromColumns, toColumns := d.from.Columns(), d.to.Columns()
+	fromByName := map[string]ColumnDeclaration{}
+	toByName := map[string]ColumnDeclaration{}
+
+	for _, column := range fromColumns {
+		fromByName[column.Name()] = column
+	}
+	for _, column := range toColumns {
+		toByName[column.Name()] = column
+	}
+
+	var removed, added []ColumnDeclaration
+	for _, column := range fromColumns {
+		if _, ok := toByName[column.Name()]; !ok {
+			removed = append(removed, column)
+		}
+	}
+	for _, column := range toColumns {
+		if _, ok := fromByName[column.Name()]; !ok {
+			added = append(added, column)
+		}
+	}
+
+	// renamedFrom maps the new names of renamed columns to their old ones.
+	renamedFrom := map[string]string{}
+	for _, column := range removed {
+		newName, ok := d.renames[column.Name()]
+		if !ok {
+			d.add("DROP_COLUMN", column.Name(), column.Node, nil, f.kw("DROP COLUMN")+" "+f.identifierName(column.Name()))
+			continue
+		}
+
+		renamed, ok := toByName[newName]
+		if _, existed := fromByName[newName]; !ok || existed || renamedFrom[newName] != "" {
+			return fmt.Errorf("cannot rename column %s to %s: %s isn't a new column", column.Name(), newName, newName)
+		}
+
+		renamedFrom[newName] = column.Name()
+		d.add("RENAME_COLUMN", column.Name(), column.Node, renamed.Node,
+			f.kw("RENAME COLUMN")+" "+f.identifierName(column.Name())+" "+f.kw("TO")+" "+f.identifierName(newName))
+	}
+
+	for oldName, newName := range d.renames {
+		if _, ok := fromByName[oldName]; !ok || renamedFrom[newName] != oldName {
+			return fmt.Errorf("cannot rename column %s to %s: %s isn't a dropped column", oldName, newName, oldName)
+		}
+	}
+
+	d.added = map[string]bool{}
+
+	for i, column := range toColumns {
+		from, exists := fromByName[column.Name()]
+		if oldName, ok := renamedFrom[column.Name()]; ok {
+			// Renames run in a statement of their own first, so the column is
+			// modified under its new name.
+			from, exists = fromByName[oldName], true
+		}
+
+		if !exists {
+			declaration, err := f.columnDeclaration(column.Node)
+			if err != nil {
+				return err
+			}
+
+			switch {
+			case i == 0:
+				declaration += " " + f.kw("FIRST")
+			case i < len(toColumns)-1:
+				declaration += " " + f.kw("AFTER") + " " + f.identifierName(toColumns[i-1].Name())
+			}
+
+			d.added[column.Name()] = true
+			d.add("ADD_COLUMN", column.Name(), nil, column.Node, f.kw("ADD COLUMN")+" "+declaration)
+			continue
+		}
+
+		comment := column.Comment()
+		definitionChanged := columnDefinitionChanged(from.Node, column.Node)
+
+		if definitionChanged {
+			declaration, err := f.columnDeclaration(column.Node)
+			if err != nil {
+				return err
+			}
+			d.add("MODIFY_COLUMN", column.Name(), from.Node, column.Node, f.kw("MODIFY COLUMN")+" "+declaration)
+		}
+
+		// MODIFY COLUMN sets a comment that's given but doesn't remove one that isn't.
+		if columnCommentChanged(from.Node, column.Node) && (!definitionChanged || comment == nil) {
+			text := "''"
+			if comment != nil {
+				var err error
+				if text, err = f.expression(comment); err != nil {
+					return err
+				}
+			}
+			d.add("COMMENT_COLUMN", column.Name(), from.Node, column.Node,
+				f.kw("COMMENT COLUMN")+" "+f.identifierName(column.Name())+" "+text)
+		}
+	}
+
+	return nil
+}
+
+func indexName(node *AstNode) (string, error) {
+	name := node.Hints[hintName]
+	if name == "" {
+		name = node.Value
+	}
+
+	if name == "" {
+		return "", fmt.Errorf("cannot compare Index on line %d: index names aren't included in explain ast output, parse the CREATE statements with their source queries", node.LineNumber)
+	}
+
+	return name, nil
+}
+
+func (d *schemaDiffer) indices() error {
+	f := d.f
+	fromByName := map[string]*AstNode{}
+
+	for _, index := range d.from.Indices() {
+		name, err := indexName(index)
+		if err != nil {
+			return err
+		}
+		fromByName[name] = index
+	}
+
+	kept := map[string]bool{}
+
+	for _, index := range d.to.Indices() {
+		name, err := indexName(index)
+		if err != nil {
+			return err
+		}
+
+		from, exists := fromByName[name]
+		if exists && from.Hash == index.Hash && from.Hints[hintGranularity] == index.Hints[hintGranularity] {
+			kept[name] = true
+			continue
+		}
+
+		// Indices can't be modified, so a changed one is dropped and added again.
+		if exists {
+			kept[name] = true
+			d.add("DROP_INDEX", name, from, nil, f.kw("DROP INDEX")+" "+f.identifierName(name))
+		}
+
+		text, err := f.index(index)
+		if err != nil {
+			return err
+		}
+		d.add("ADD_INDEX", name, from, index, f.kw("ADD INDEX")+" "+text)
+	}
+
+	for _, index := range d.from.Indices() {
+		name, _ := indexName(index)
+		if !kept[name] {
+			d.add("DROP_INDEX", name, index, nil, f.kw("DROP INDEX")+" "+f.identifierName(name))
+		}
+	}
+
+	return nil
+}
+
+// keyExpressions returns the expressions of a sorting key, unwrapping a tuple.
+func keyExpressions(key *AstNode) []*AstNode {
+	if key == nil {
+		return nil
+	}
+
+	if key.Type == "Function" && key.Value == "tuple" && key.Alias == "" {
+		return childrenOf(key.firstChildOfType("ExpressionList"))
+	}
+
+	return []*AstNode{key}
+}
+
+// orderBy allows the one sorting key change ClickHouse can make in place: appending
+// expressions that only use columns added in the same ALTER.
+func (d *schemaDiffer) orderBy() error {
+	from, to := d.from.OrderBy(), d.to.OrderBy()
+	if sameNode(from, to) {
+		return nil
+	}
+
+	fromKeys, toKeys := keyExpressions(from), keyExpressions(to)
+	legal := to != nil && len(toKeys) > len(fromKeys)
+
+	for i := 0; legal && i < len(toKeys); i++ {
+		if i < len(fromKeys) {
+			legal = fromKeys[i].Hash == toKeys[i].Hash
+			continue
+		}
+
+		toKeys[i].Walk(func(node *AstNode) {
+			if node.Type == "Identifier" && !d.added[node.Value] {
+				legal = false
+			}
+		})
+	}
+
+	if !legal {
+		d.impossible("MODIFY_ORDER_BY", from, to, "the ORDER BY can only be extended with expressions using columns added in the same ALTER, the table has to be recreated")
+		return nil
+	}
+
+	key, err := d.f.storageKey(to)
+	if err != nil {
+		return err
+	}
+
+	d.add("MODIFY_ORDER_BY", "", from, to, d.f.kw("MODIFY ORDER BY")+" "+key)
+	return nil
+}
+
+func (d *schemaDiffer) sampleBy() error {
+	from, to := d.from.SampleBy(), d.to.SampleBy()
+
+	switch {
+	case sameNode(from, to):
+		return nil
+	case to == nil:
+		d.add("REMOVE_SAMPLE_BY", "", from, nil, d.f.kw("REMOVE SAMPLE BY"))
+		return nil
+	}
+
+	key, err := d.f.storageKey(to)
+	if err != nil {
+		return err
+	}
+
+	d.add("MODIFY_SAMPLE_BY", "", from, to, d.f.kw("MODIFY SAMPLE BY")+" "+key)
+	return nil
+}
+
+func (d *schemaDiffer) ttl() error {
+	from, to := d.from.storageClauses().ttl, d.to.storageClauses().ttl
+
+	same := sameNode(from, to)
+	for i := 0; same && from != nil && i < len(from.Children); i++ {
+		same = from.Children[i].Hints[hintTTLAction] == to.Children[i].Hints[hintTTLAction] &&
+			from.Children[i].Hints[hintTTLDestination] == to.Children[i].Hints[hintTTLDestination]
+	}
+
+	switch {
+	case same:
+		return nil
+	case to == nil:
+		d.add("REMOVE_TTL", "", from, nil, d.f.kw("REMOVE TTL"))
+		return nil
+	}
+
+	text, err := d.f.ttl(to)
+	if err != nil {
+		return err
+	}
+
+	d.add("MODIFY_TTL", "", from, to, d.f.kw("MODIFY TTL")+" "+text)
+	return nil
+}
+
+// storageSettings reads the settings of a storage Set node from its hint.
+func storageSettings(node *AstNode) ([]setting, error) {
+	if node == nil {
+		return nil, nil
+	}
+
+	text := node.Hints[hintSettings]
+	if text == "" {
+		return nil, fmt.Errorf("cannot compare Set node on line %d: SETTINGS values aren't included in explain ast output, parse the CREATE statements with their source queries", node.LineNumber)
+	}
+
+	return settingChanges(text), nil
+}
+
+func (d *schemaDiffer) settings() error {
+	fromNode, toNode := d.from.Settings(), d.to.Settings()
+
+	from, err := storageSettings(fromNode)
+	if err != nil {
+		return err
+	}
+
+	to, err := storageSettings(toNode)
+	if err != nil {
+		return err
+	}
+
+	fromValues := map[string]string{}
+	for _, s := range from {
+		fromValues[s.name] = s.value
+	}
+
+	present := map[string]bool{}
+	for _, s := range to {
+		present[s.name] = true
+		if value, ok := fromValues[s.name]; !ok || value != s.value {
+			d.add("MODIFY_SETTING", s.name, fromNode, toNode, d.f.kw("MODIFY SETTING")+" "+s.name+" = "+s.value)
+		}
+	}
+
+	for _, s := range from {
+		if !present[s.name] {
+			d.add("RESET_SETTING", s.name, fromNode, toNode, d.f.kw("RESET SETTING")+" "+s.name)
+		}
+	}
+
+	return nil
+}
+
+func (d *schemaDiffer) comment() error {
+	from, to := d.from.Node.firstChildOfType("Literal"), d.to.Node.firstChildOfType("Literal")
+	if sameNode(from, to) {
+		return nil
+	}
+
+	text := "''"
+	if to != nil {
+		var err error
+		if text, err = d.f.expression(to); err != nil {
+			return err
+		}
+	}
+
+	d.add("MODIFY_COMMENT", "", from, to, d.f.kw("MODIFY COMMENT")+" "+text)
+	return nil
+}
@@ -0,0 +1,329 @@
+package ast
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SchemaChangeSafety says what applying a SchemaChange does to a table's data.
+type SchemaChangeSafety string
+
+const (
+	// SchemaChangeSafe changes only metadata, or only affects data written later.
+	SchemaChangeSafe SchemaChangeSafety = "safe"
+	// SchemaChangeNeedsMutation rewrites existing data without losing any of it.
+	SchemaChangeNeedsMutation SchemaChangeSafety = "needs_mutation"
+	// SchemaChangeLossy can lose data, like dropping a column or narrowing its type.
+	SchemaChangeLossy SchemaChangeSafety = "lossy"
+	// SchemaChangeImpossible can't be made with ALTER; the table has to be recreated.
+	SchemaChangeImpossible SchemaChangeSafety = "impossible"
+)
+
+// AllowLossyAnnotation is the comment that lets CheckSchemaChanges pass lossy changes,
+// written anywhere in the new CREATE statement, e.g. "-- treehouse:allow-lossy".
+const AllowLossyAnnotation = "treehouse:allow-lossy"
+
+// AllowsLossyChanges reports whether the statement's source query has an
+// AllowLossyAnnotation comment.
+func (c CreateQuery) AllowsLossyChanges() bool {
+	return c.Node.Hints[hintAllowLossy] != ""
+}
+
+// CheckSchemaChanges returns an error listing the changes that shouldn't be applied:
+// impossible ones, and lossy ones unless to allows them with an AllowLossyAnnotation.
+func CheckSchemaChanges(to CreateQuery, changes []SchemaChange) error {
+	allowLossy := to.AllowsLossyChanges()
+	var blocked []string
+
+	for _, change := range changes {
+		if change.Safety == SchemaChangeImpossible || change.Safety == SchemaChangeLossy && !allowLossy {
+			description := change.Kind
+			if change.Name != "" {
+				description += " " + change.Name
+			}
+			blocked = append(blocked, fmt.Sprintf("%s (%s): %s", description, change.Safety, change.Reason))
+		}
+	}
+
+	if len(blocked) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("blocked schema changes to %s, lossy changes can be allowed with a -- %s comment:\n  %s",
+		to.Name(), AllowLossyAnnotation, strings.Join(blocked, "\n  "))
+}
+
+func classifySchemaChange(change SchemaChange) (SchemaChangeSafety, string) {
+	switch change.Kind {
+	case "DROP_COLUMN":
+		return SchemaChangeLossy, "dropping a column deletes its data"
+	case "MODIFY_COLUMN":
+		return classifyColumnChange(change.Old, change.New)
+	case "MODIFY_TTL":
+		return SchemaChangeNeedsMutation, "the new TTL is applied to existing data"
+	case "ADD_COLUMN", "ADD_INDEX", "MODIFY_SETTING", "RESET_SETTING":
+		return SchemaChangeSafe, "only affects data written from now on"
+	case "RENAME_COLUMN":
+		// SchemaDiff only renames columns named in SchemaDiffOptions.Renames, never
+		// a dropped column that's been replaced by another.
+		return SchemaChangeSafe, "keeps the column's data under its new name"
+	}
+
+	return SchemaChangeSafe, "only changes metadata"
+}
+
+// columnDefaultKind returns DEFAULT, MATERIALIZED, ALIAS or EPHEMERAL.
+func columnDefaultKind(column *AstNode) string {
+	if kind := column.Hints[hintDefaultKind]; kind != "" {
+		return kind
+	}
+
+	return "DEFAULT"
+}
+
+func classifyColumnChange(from *AstNode, to *AstNode) (SchemaChangeSafety, string) {
+	stored := func(column *AstNode) bool {
+		kind := columnDefaultKind(column)
+		return kind != "ALIAS" && kind != "EPHEMERAL"
+	}
+
+	fromClauses, toClauses := classifyColumnChildren(from), classifyColumnChildren(to)
+
+	switch {
+	case stored(from) && !stored(to):
+		return SchemaChangeLossy, "the column's data is deleted when it becomes " + columnDefaultKind(to)
+	case from.Hints[hintNullModifier] == "NULL" && to.Hints[hintNullModifier] != "NULL":
+		return SchemaChangeLossy, "NULL values can't be kept when the column stops being nullable"
+	case !sameNode(fromClauses.dataType, toClauses.dataType):
+		fromType, toType := typeName(fromClauses.dataType), typeName(toClauses.dataType)
+		if losslessTypeChange(fromClauses.dataType, toClauses.dataType) {
+			return SchemaChangeNeedsMutation, fmt.Sprintf("converting %s to %s rewrites the column", fromType, toType)
+		}
+		return SchemaChangeLossy, fmt.Sprintf("converting %s to %s can lose data", fromType, toType)
+	case !stored(from) && stored(to):
+		return SchemaChangeNeedsMutation, "the column's values have to be written when it's no longer " + columnDefaultKind(from)
+	case !sameNode(fromClauses.ttl, toClauses.ttl):
+		return SchemaChangeNeedsMutation, "the new column TTL is applied to existing data"
+	}
+
+	return SchemaChangeSafe, "only changes metadata"
+}
+
+func typeName(node *AstNode) string {
+	if node == nil {
+		return "an inferred type"
+	}
+
+	text, err := newFormatter(DefaultFormatOptions()).dataType(node)
+	if err != nil {
+		return node.Value
+	}
+
+	return text
+}
+
+// typeArguments returns the parameters of a DataType node, e.g. the String of Nullable(String).
+func typeArguments(node *AstNode) []*AstNode {
+	return childrenOf(node.firstChildOfType("ExpressionList"))
+}
+
+// integerArgument returns the value of an integer Literal type parameter.
+func integerArgument(arguments []*AstNode, i int) (int, bool) {
+	if i >= len(arguments) || arguments[i].Type != "Literal" {
+		return 0, false
+	}
+
+	lit, err := parseLiteral(arguments[i].Value)
+	if err != nil {
+		return 0, false
+	}
+
+	value, err := strconv.Atoi(lit.value)
+	return value, err == nil
+}
+
+// integerType returns the width and signedness of an integer type name such as UInt32.
+func integerType(name string) (bits int, signed bool, ok bool) {
+	signed = !strings.HasPrefix(name, "UInt")
+	digits := strings.TrimPrefix(strings.TrimPrefix(name, "U"), "Int")
+
+	if !strings.HasPrefix(name, "Int") && !strings.HasPrefix(name, "UInt") {
+		return 0, false, false
+	}
+
+	bits, err := strconv.Atoi(digits)
+	return bits, signed, err == nil
+}
+
+// Decimal digits needed to hold every value of each integer width.
+var integerDigits = map[int]int{8: 3, 16: 5, 32: 10, 64: 20, 128: 39, 256: 78}
+
+// decimalType returns the precision and scale of a Decimal type.
+func decimalType(node *AstNode) (precision int, scale int, ok bool) {
+	arguments := typeArguments(node)
+	precisions := map[string]int{"Decimal32": 9, "Decimal64": 18, "Decimal128": 38, "Decimal256": 76}
+
+	if precision, isSized := precisions[node.Value]; isSized {
+		scale, ok = integerArgument(arguments, 0)
+		return precision, scale, ok
+	}
+
+	if node.Value != "Decimal" {
+		return 0, 0, false
+	}
+
+	precision, ok = integerArgument(arguments, 0)
+	if len(arguments) == 1 {
+		return precision, 0, ok
+	}
+
+	scale, scaleOk := integerArgument(arguments, 1)
+	return precision, scale, ok && scaleOk
+}
+
+// dateTimePrecision returns the sub-second digits of a date or time type, with Date
+// and Date32 ranked below DateTime.
+func dateTimePrecision(node *AstNode) (int, bool) {
+	switch node.Value {
+	case "Date":
+		return -2, true
+	case "Date32":
+		return -1, true
+	case "DateTime":
+		return 0, true
+	case "DateTime64":
+		return integerArgument(typeArguments(node), 0)
+	}
+
+	return 0, false
+}
+
+// scalarType reports whether a type holds single values whose text form converts back
+// to the same value. Enums are left out since their text only converts back into the
+// same enum.
+func scalarType(node *AstNode) bool {
+	switch node.Value {
+	case "String", "FixedString", "Bool", "UUID", "IPv4", "IPv6", "Float32", "Float64":
+		return true
+	}
+
+	if _, _, ok := integerType(node.Value); ok {
+		return true
+	}
+
+	if _, _, ok := decimalType(node); ok {
+		return true
+	}
+
+	_, ok := dateTimePrecision(node)
+	return ok
+}
+
+// losslessTypeChange reports whether every value of type from can be converted to
+// type to and back without changing. Conversions the rules here don't cover count as
+// lossy.
+func losslessTypeChange(from *AstNode, to *AstNode) bool {
+	if from == nil || to == nil {
+		return false
+	}
+
+	if from.Hash == to.Hash {
+		return true
+	}
+
+	fromArguments, toArguments := typeArguments(from), typeArguments(to)
+
+	switch {
+	case from.Value == "LowCardinality" && len(fromArguments) == 1:
+		return losslessTypeChange(fromArguments[0], to)
+	case to.Value == "LowCardinality" && len(toArguments) == 1:
+		return losslessTypeChange(from, toArguments[0])
+	case from.Value == "Nullable" && to.Value == "Nullable", from.Value == "Array" && to.Value == "Array":
+		return len(fromArguments) == 1 && len(toArguments) == 1 && losslessTypeChange(fromArguments[0], toArguments[0])
+	case from.Value == "Nullable":
+		return false
+	case to.Value == "Nullable" && len(toArguments) == 1:
+		return losslessTypeChange(from, toArguments[0])
+	case to.Value == "String":
+		return scalarType(from)
+	case from.Value == "FixedString" && to.Value == "FixedString":
+		fromLength, fromOk := integerArgument(fromArguments, 0)
+		toLength, toOk := integerArgument(toArguments, 0)
+		return fromOk && toOk && toLength >= fromLength
+	case strings.HasPrefix(from.Value, "Enum") && strings.HasPrefix(to.Value, "Enum"):
+		return enumWidening(from, to)
+	}
+
+	if fromBits, fromSigned, ok := integerType(from.Value); ok {
+		if toBits, toSigned, ok := integerType(to.Value); ok {
+			switch {
+			case fromSigned == toSigned:
+				return toBits >= fromBits
+			case toSigned:
+				return toBits > fromBits
+			}
+			return false
+		}
+
+		valueBits := fromBits
+		if fromSigned {
+			valueBits--
+		}
+
+		switch to.Value {
+		case "Float32":
+			return valueBits <= 24
+		case "Float64":
+			return valueBits <= 53
+		}
+
+		if precision, scale, ok := decimalType(to); ok {
+			return precision-scale >= integerDigits[fromBits]
+		}
+
+		return false
+	}
+
+	if from.Value == "Float32" && to.Value == "Float64" {
+		return true
+	}
+
+	if fromPrecision, fromScale, ok := decimalType(from); ok {
+		toPrecision, toScale, ok := decimalType(to)
+		return ok && toScale >= fromScale && toPrecision-toScale >= fromPrecision-fromScale
+	}
+
+	if fromPrecision, ok := dateTimePrecision(from); ok {
+		toPrecision, ok := dateTimePrecision(to)
+		// DateTime's range ends before Date's and starts after Date32's, so only Date32 and
+		// DateTime64 hold every Date and only DateTime64 holds every Date32.
+		if (from.Value == "Date" || from.Value == "Date32") && to.Value == "DateTime" {
+			return false
+		}
+		return ok && toPrecision >= fromPrecision
+	}
+
+	return false
+}
+
+// enumWidening reports whether every value of the from enum is in the to enum, and
+// fits it.
+func enumWidening(from *AstNode, to *AstNode) bool {
+	if from.Value == "Enum16" && to.Value == "Enum8" {
+		return false
+	}
+
+	values := map[uint64]bool{}
+	for _, value := range typeArguments(to) {
+		values[value.Hash] = true
+	}
+
+	for _, value := range typeArguments(from) {
+		if !values[value.Hash] {
+			return false
+		}
+	}
+
+	return true
+}
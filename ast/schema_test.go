@@ -0,0 +1,345 @@
+package ast
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func schemaBeforeQuery() string {
+	return `create table t (
+  id UInt64,
+  name String,
+  amount Float64 comment 'amt',
+  index idx name type bloom_filter granularity 4
+) engine = MergeTree order by id settings index_granularity = 8192, min_bytes_for_wide_part = 0`
+}
+
+func schemaBeforeLines() []string {
+	return []string{
+		"CreateQuery  t (children 3)",
+		" Identifier t",
+		" Columns definition (children 2)",
+		"  ExpressionList (children 3)",
+		"   ColumnDeclaration id (children 1)",
+		"    DataType UInt64",
+		"   ColumnDeclaration name (children 1)",
+		"    DataType String",
+		"   ColumnDeclaration amount (children 2)",
+		"    DataType Float64",
+		"    Literal 'amt'",
+		"  ExpressionList (children 1)",
+		"   Index (children 2)",
+		"    Identifier name",
+		"    Function bloom_filter",
+		" Storage definition (children 3)",
+		"  Function MergeTree",
+		"  Identifier id",
+		"  Set",
+	}
+}
+
+func schemaAfterQuery(orderBy string) string {
+	return `create table t (
+  id UInt64,
+  label String,
+  amount Float64 comment 'total',
+  score UInt8 default 0,
+  kind LowCardinality(String),
+  index idx2 id type minmax granularity 1
+) engine = MergeTree order by ` + orderBy + ` settings index_granularity = 4096`
+}
+
+func schemaAfterLines(keys ...string) []string {
+	lines := []string{
+		"CreateQuery  t (children 3)",
+		" Identifier t",
+		" Columns definition (children 2)",
+		"  ExpressionList (children 5)",
+		"   ColumnDeclaration id (children 1)",
+		"    DataType UInt64",
+		"   ColumnDeclaration label (children 1)",
+		"    DataType String",
+		"   ColumnDeclaration amount (children 2)",
+		"    DataType Float64",
+		"    Literal 'total'",
+		"   ColumnDeclaration score (children 2)",
+		"    DataType UInt8",
+		"    Literal UInt64_0",
+		"   ColumnDeclaration kind (children 1)",
+		"    DataType LowCardinality (children 1)",
+		"     ExpressionList (children 1)",
+		"      DataType String",
+		"  ExpressionList (children 1)",
+		"   Index (children 2)",
+		"    Identifier id",
+		"    Function minmax",
+		" Storage definition (children 3)",
+		"  Function MergeTree",
+		"  Function tuple (children 1)",
+		"   ExpressionList (children 2)",
+	}
+
+	for _, key := range keys {
+		lines = append(lines, "    Identifier "+key)
+	}
+
+	return append(lines, "  Set")
+}
+
+func parseCreateQuery(t *testing.T, query string, lines []string) CreateQuery {
+	root, err := Parse(query, lines)
+	assert.NoError(t, err)
+
+	c, ok := AsCreateQuery(root)
+	assert.True(t, ok)
+
+	return c
+}
+
+func TestSchemaDiff(t *testing.T) {
+	before := parseCreateQuery(t, schemaBeforeQuery(), schemaBeforeLines())
+	after := parseCreateQuery(t, schemaAfterQuery("(id, kind)"), schemaAfterLines("id", "kind"))
+
+	changes, err := SchemaDiffWithOptions(before, after, SchemaDiffOptions{Renames: map[string]string{"name": "label"}})
+	assert.NoError(t, err)
+
+	var commands []string
+	for _, change := range changes {
+		commands = append(commands, change.SQL)
+	}
+
+	assert.Equal(t, []string{
+		"RENAME COLUMN name TO label",
+		"DROP INDEX idx",
+		"ADD COLUMN score UInt8 DEFAULT 0 AFTER amount",
+		"ADD COLUMN kind LowCardinality(String)",
+		"COMMENT COLUMN amount 'total'",
+		"ADD INDEX idx2 id TYPE minmax GRANULARITY 1",
+		"MODIFY ORDER BY (id, kind)",
+		"MODIFY SETTING index_granularity = 4096",
+		"RESET SETTING min_bytes_for_wide_part",
+	}, commands)
+
+	assert.Equal(t, "ADD_COLUMN", changes[2].Kind)
+	assert.Equal(t, "score", changes[2].Name)
+	assert.Nil(t, changes[2].Old)
+
+	for _, change := range changes {
+		assert.Equal(t, SchemaChangeSafe, change.Safety, change.SQL)
+	}
+	assert.NoError(t, CheckSchemaChanges(after, changes))
+
+	statements, err := AlterStatements("db", "t", changes)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"ALTER TABLE db.t\n    RENAME COLUMN name TO label",
+		"ALTER TABLE db.t\n    " + strings.Join(commands[1:], ",\n    "),
+	}, statements)
+
+	changes, err = SchemaDiff(before, before)
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+
+	statements, err = AlterStatements("", "t", changes)
+	assert.NoError(t, err)
+	assert.Empty(t, statements)
+
+	// Changing a column's type modifies it, keeping its comment.
+	modified := parseCreateQuery(t, strings.Replace(schemaBeforeQuery(), "amount Float64", "amount Decimal64(2)", 1),
+		append(append(append([]string(nil), schemaBeforeLines()[:9]...),
+			"    DataType Decimal64 (children 1)",
+			"     ExpressionList (children 1)",
+			"      Literal UInt64_2",
+		), schemaBeforeLines()[10:]...))
+
+	changes, err = SchemaDiff(before, modified)
+	assert.NoError(t, err)
+	assert.Len(t, changes, 1)
+	assert.Equal(t, "MODIFY COLUMN amount Decimal64(2) COMMENT 'amt'", changes[0].SQL)
+	assert.Equal(t, SchemaChangeLossy, changes[0].Safety)
+	assert.Equal(t, "converting Float64 to Decimal64(2) can lose data", changes[0].Reason)
+
+	// Dropping a column is lossy unless the new statement allows it.
+	query := "create table t (id UInt64, name String) engine = MergeTree order by id settings index_granularity = 8192, min_bytes_for_wide_part = 0"
+	lines := []string{
+		"CreateQuery  t (children 3)",
+		" Identifier t",
+		" Columns definition (children 1)",
+		"  ExpressionList (children 2)",
+		"   ColumnDeclaration id (children 1)",
+		"    DataType UInt64",
+		"   ColumnDeclaration name (children 1)",
+		"    DataType String",
+		" Storage definition (children 3)",
+		"  Function MergeTree",
+		"  Identifier id",
+		"  Set",
+	}
+	dropped := parseCreateQuery(t, query, lines)
+
+	changes, err = SchemaDiff(before, dropped)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"DROP_INDEX", "DROP_COLUMN"}, []string{changes[0].Kind, changes[1].Kind})
+	assert.Equal(t, SchemaChangeLossy, changes[1].Safety)
+	assert.ErrorContains(t, CheckSchemaChanges(dropped, changes), "DROP_COLUMN amount (lossy): dropping a column deletes its data")
+
+	allowed := parseCreateQuery(t, "-- treehouse:allow-lossy\n"+query, lines)
+	assert.True(t, allowed.AllowsLossyChanges())
+	assert.NoError(t, CheckSchemaChanges(allowed, changes))
+
+	// The annotation has to be a comment, not a string that looks like one.
+	quoted := parseCreateQuery(t, query+" comment '-- treehouse:allow-lossy'", lines)
+	assert.False(t, quoted.AllowsLossyChanges())
+	assert.Error(t, CheckSchemaChanges(quoted, changes))
+}
+
+// create table t (id UInt64, <column> Int64) engine = MergeTree order by id
+func twoColumnTable(t *testing.T, column string, columnType string) CreateQuery {
+	return parseCreateQuery(t, "create table t (id UInt64, "+column+" "+columnType+") engine = MergeTree order by id", []string{
+		"CreateQuery  t (children 3)",
+		" Identifier t",
+		" Columns definition (children 1)",
+		"  ExpressionList (children 2)",
+		"   ColumnDeclaration id (children 1)",
+		"    DataType UInt64",
+		"   ColumnDeclaration " + column + " (children 1)",
+		"    DataType " + columnType,
+		" Storage definition (children 2)",
+		"  Function MergeTree",
+		"  Identifier id",
+	})
+}
+
+func TestSchemaDiffRenames(t *testing.T) {
+	clicks := twoColumnTable(t, "clicks", "Int64")
+	revenue := twoColumnTable(t, "revenue", "Int64")
+
+	// An unrelated column of the same type replacing a dropped one isn't a rename.
+	changes, err := SchemaDiff(clicks, revenue)
+	assert.NoError(t, err)
+	assert.Len(t, changes, 2)
+	assert.Equal(t, "DROP COLUMN clicks", changes[0].SQL)
+	assert.Equal(t, "ADD COLUMN revenue Int64", changes[1].SQL)
+	assert.ErrorContains(t, CheckSchemaChanges(revenue, changes), "DROP_COLUMN clicks (lossy): dropping a column deletes its data")
+
+	changes, err = SchemaDiffWithOptions(clicks, revenue, SchemaDiffOptions{Renames: map[string]string{"clicks": "revenue"}})
+	assert.NoError(t, err)
+	assert.Len(t, changes, 1)
+	assert.Equal(t, "RENAME COLUMN clicks TO revenue", changes[0].SQL)
+	assert.NoError(t, CheckSchemaChanges(revenue, changes))
+
+	// A renamed column is modified under its new name.
+	changes, err = SchemaDiffWithOptions(clicks, twoColumnTable(t, "revenue", "String"), SchemaDiffOptions{Renames: map[string]string{"clicks": "revenue"}})
+	assert.NoError(t, err)
+	assert.Len(t, changes, 2)
+	assert.Equal(t, "RENAME COLUMN clicks TO revenue", changes[0].SQL)
+	assert.Equal(t, "MODIFY COLUMN revenue String", changes[1].SQL)
+
+	_, err = SchemaDiffWithOptions(clicks, revenue, SchemaDiffOptions{Renames: map[string]string{"clicks": "cost"}})
+	assert.ErrorContains(t, err, "cannot rename column clicks to cost: cost isn't a new column")
+
+	_, err = SchemaDiffWithOptions(clicks, revenue, SchemaDiffOptions{Renames: map[string]string{"id": "revenue"}})
+	assert.ErrorContains(t, err, "cannot rename column id to revenue: id isn't a dropped column")
+}
+
+func TestSchemaDiffImpossible(t *testing.T) {
+	before := parseCreateQuery(t, schemaBeforeQuery(), schemaBeforeLines())
+
+	reordered := parseCreateQuery(t, schemaAfterQuery("(kind, id)"), schemaAfterLines("kind", "id"))
+	changes, err := SchemaDiff(before, reordered)
+	assert.NoError(t, err)
+
+	last := changes[len(changes)-3]
+	assert.Equal(t, "MODIFY_ORDER_BY", last.Kind)
+	assert.Equal(t, SchemaChangeImpossible, last.Safety)
+	assert.Empty(t, last.SQL)
+
+	_, err = AlterStatements("", "t", changes)
+	assert.ErrorContains(t, err, "cannot alter t: the ORDER BY can only be extended")
+
+	lines := schemaAfterLines("id", "kind")
+	lines[len(lines)-6] = "  Function ReplacingMergeTree"
+	changes, err = SchemaDiff(before, parseCreateQuery(t, schemaAfterQuery("(id, kind)"), lines))
+	assert.NoError(t, err)
+	assert.Equal(t, "MODIFY_ENGINE", changes[0].Kind)
+	assert.ErrorContains(t, CheckSchemaChanges(reordered, changes), "MODIFY_ENGINE (impossible): the engine can't be changed in place")
+}
+
+func TestSchemaDiffErrors(t *testing.T) {
+	before := parseCreateQuery(t, schemaBeforeQuery(), schemaBeforeLines())
+
+	withoutHints := parseCreateQuery(t, "", schemaAfterLines("id", "kind"))
+	_, err := SchemaDiff(before, withoutHints)
+	assert.ErrorContains(t, err, "parse the CREATE statements with their source queries")
+
+	view := parseCreateQuery(t, materializedViewQuery(), materializedViewLines())
+	_, err = SchemaDiff(before, view)
+	assert.ErrorContains(t, err, "mv isn't a CREATE TABLE")
+}
+
+func TestLosslessTypeChange(t *testing.T) {
+	dataType := func(lines ...string) *AstNode {
+		root, err := Parse("", lines)
+		assert.NoError(t, err)
+		return root
+	}
+
+	wrapped := func(wrapper string, inner string) *AstNode {
+		return dataType("DataType "+wrapper+" (children 1)", " ExpressionList (children 1)", "  DataType "+inner)
+	}
+
+	parameterized := func(name string, parameters ...string) *AstNode {
+		lines := []string{"DataType " + name + " (children 1)", " ExpressionList (children " + strconv.Itoa(len(parameters)) + ")"}
+		for _, parameter := range parameters {
+			lines = append(lines, "  Literal UInt64_"+parameter)
+		}
+		return dataType(lines...)
+	}
+
+	fixtures := []struct {
+		from, to *AstNode
+		lossless bool
+	}{
+		{dataType("DataType Int32"), dataType("DataType Int64"), true},
+		{dataType("DataType Int64"), dataType("DataType Int32"), false},
+		{dataType("DataType UInt32"), dataType("DataType Int64"), true},
+		{dataType("DataType UInt32"), dataType("DataType Int32"), false},
+		{dataType("DataType Int32"), dataType("DataType UInt64"), false},
+		{dataType("DataType Int16"), dataType("DataType Float32"), true},
+		{dataType("DataType Int64"), dataType("DataType Float64"), false},
+		{dataType("DataType Float64"), dataType("DataType Float32"), false},
+		{dataType("DataType Float32"), dataType("DataType Float64"), true},
+		{dataType("DataType Int64"), dataType("DataType String"), true},
+		{dataType("DataType String"), dataType("DataType Int64"), false},
+		{parameterized("Decimal", "10", "2"), dataType("DataType String"), true},
+		{wrapped("Array", "UInt8"), dataType("DataType String"), false},
+		{wrapped("Tuple", "UInt8"), dataType("DataType String"), false},
+		{parameterized("Enum8", "1"), dataType("DataType String"), false},
+		{dataType("DataType String"), wrapped("Nullable", "String"), true},
+		{wrapped("Nullable", "String"), dataType("DataType String"), false},
+		{dataType("DataType String"), wrapped("LowCardinality", "String"), true},
+		{wrapped("Array", "UInt8"), wrapped("Array", "UInt16"), true},
+		{wrapped("Array", "UInt16"), wrapped("Array", "UInt8"), false},
+		{parameterized("Decimal", "10", "2"), parameterized("Decimal", "12", "3"), true},
+		{parameterized("Decimal", "10", "2"), parameterized("Decimal", "10", "3"), false},
+		{parameterized("Decimal32", "2"), parameterized("Decimal64", "4"), true},
+		{dataType("DataType Int32"), parameterized("Decimal", "12", "2"), true},
+		{parameterized("FixedString", "4"), parameterized("FixedString", "8"), true},
+		{parameterized("FixedString", "8"), parameterized("FixedString", "4"), false},
+		{dataType("DataType Date"), dataType("DataType Date32"), true},
+		{dataType("DataType Date"), dataType("DataType DateTime"), false},
+		{dataType("DataType Date32"), dataType("DataType DateTime"), false},
+		{dataType("DataType Date32"), parameterized("DateTime64", "0"), true},
+		{dataType("DataType DateTime"), parameterized("DateTime64", "3"), true},
+		{parameterized("DateTime64", "6"), parameterized("DateTime64", "3"), false},
+		{dataType("DataType DateTime"), dataType("DataType Date"), false},
+		{dataType("DataType UUID"), dataType("DataType IPv6"), false},
+	}
+
+	for _, fixture := range fixtures {
+		assert.Equal(t, fixture.lossless, losslessTypeChange(fixture.from, fixture.to), typeName(fixture.from)+" to "+typeName(fixture.to))
+	}
+}
@@ -0,0 +1,512 @@
+package ast
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Selector is a compiled CSS-like query over AstNode trees, e.g.
+//
+//	CreateQuery > Columns ColumnDeclaration
+//	Function[value=dictGet] > ExpressionList > Literal:first-child
+//
+// Compound selectors are a node type (or *) followed by any number of attribute
+// filters and pseudo-classes. They're combined with ">" for direct children or
+// whitespace for descendants, and alternatives are separated by commas.
+//
+// Attributes are type, value, qualifier, alias, database, table, column or the key of
+// any other meta annotation. They're tested for presence ([alias]) or with one of
+// = != ^= $= *= or ~= (regular expression). Values may be bare or quoted.
+//
+// Pseudo-classes are :root, :empty, :first-child, :last-child, :only-child,
+// :nth-child(n), :not(selector) and :has(selector). Child positions are counted among
+// the nodes in explain output, so synthetic nodes have none.
+type Selector struct {
+	source       string
+	alternatives []complexSelector
+}
+
+// complexSelector is a chain of compounds, stored left to right.
+type complexSelector struct {
+	compounds []compoundSelector
+	// combinators[i] joins compounds[i] and compounds[i+1].
+	combinators []byte
+}
+
+type compoundSelector struct {
+	nodeType string
+	filters  []func(node *AstNode) bool
+}
+
+func (s *Selector) String() string {
+	return s.source
+}
+
+func CompileSelector(source string) (*Selector, error) {
+	p := &selectorParser{input: source}
+
+	alternatives, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	if !p.done() {
+		return nil, p.errorf("unexpected %q", p.input[p.pos:])
+	}
+
+	return &Selector{source: source, alternatives: alternatives}, nil
+}
+
+func MustCompileSelector(source string) *Selector {
+	s, err := CompileSelector(source)
+	if err != nil {
+		panic(err)
+	}
+
+	return s
+}
+
+// Match reports whether node matches any alternative of the selector.
+func (s *Selector) Match(node *AstNode) bool {
+	for _, alternative := range s.alternatives {
+		if alternative.match(node) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Select returns every node under root, root included, that matches the selector, in tree order.
+func (s *Selector) Select(root *AstNode) []*AstNode {
+	var nodes []*AstNode
+
+	if root == nil {
+		return nil
+	}
+
+	root.Walk(func(node *AstNode) {
+		if s.Match(node) {
+			nodes = append(nodes, node)
+		}
+	})
+
+	return nodes
+}
+
+// Select compiles selector and returns the matching nodes of the Ast.
+func (a *Ast) Select(selector string) ([]*AstNode, error) {
+	s, err := CompileSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.Root == nil {
+		return nil, fmt.Errorf("cannot select from an empty ast")
+	}
+
+	return s.Select(a.Root), nil
+}
+
+func (c complexSelector) match(node *AstNode) bool {
+	return c.matchFrom(len(c.compounds)-1, node)
+}
+
+// matchFrom matches compounds[0..i] right to left with compounds[i] matching node.
+func (c complexSelector) matchFrom(i int, node *AstNode) bool {
+	if !c.compounds[i].match(node) {
+		return false
+	}
+
+	if i == 0 {
+		return true
+	}
+
+	if c.combinators[i-1] == '>' {
+		return node.Parent != nil && c.matchFrom(i-1, node.Parent)
+	}
+
+	for ancestor := node.Parent; ancestor != nil; ancestor = ancestor.Parent {
+		if c.matchFrom(i-1, ancestor) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c compoundSelector) match(node *AstNode) bool {
+	if c.nodeType != "" && c.nodeType != "*" && c.nodeType != node.Type {
+		return false
+	}
+
+	for _, filter := range c.filters {
+		if !filter(node) {
+			return false
+		}
+	}
+
+	return true
+}
+
+type selectorParser struct {
+	input string
+	pos   int
+}
+
+func (p *selectorParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("selector %q at offset %d: %s", p.input, p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *selectorParser) done() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *selectorParser) peek() byte {
+	if p.done() {
+		return 0
+	}
+
+	return p.input[p.pos]
+}
+
+func (p *selectorParser) skipSpace() bool {
+	start := p.pos
+	for !p.done() && (p.peek() == ' ' || p.peek() == '\t' || p.peek() == '\n') {
+		p.pos++
+	}
+
+	return p.pos > start
+}
+
+func (p *selectorParser) consume(s string) bool {
+	if strings.HasPrefix(p.input[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+
+	return false
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || c == '-' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func (p *selectorParser) parseName() string {
+	start := p.pos
+	for !p.done() && isNameByte(p.peek()) {
+		p.pos++
+	}
+
+	return p.input[start:p.pos]
+}
+
+func (p *selectorParser) parseList() ([]complexSelector, error) {
+	var alternatives []complexSelector
+
+	for {
+		alternative, err := p.parseComplex()
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, alternative)
+
+		p.skipSpace()
+		if !p.consume(",") {
+			return alternatives, nil
+		}
+	}
+}
+
+func (p *selectorParser) parseComplex() (complexSelector, error) {
+	var c complexSelector
+
+	p.skipSpace()
+
+	for {
+		compound, err := p.parseCompound()
+		if err != nil {
+			return c, err
+		}
+		c.compounds = append(c.compounds, compound)
+
+		sawSpace := p.skipSpace()
+
+		switch {
+		case p.consume(">"):
+			p.skipSpace()
+			c.combinators = append(c.combinators, '>')
+		case sawSpace && !p.done() && p.peek() != ',' && p.peek() != ')':
+			c.combinators = append(c.combinators, ' ')
+		default:
+			return c, nil
+		}
+	}
+}
+
+func (p *selectorParser) parseCompound() (compoundSelector, error) {
+	var c compoundSelector
+
+	if p.consume("*") {
+		c.nodeType = "*"
+	} else {
+		c.nodeType = p.parseName()
+	}
+
+	for {
+		switch p.peek() {
+		case '[':
+			filter, err := p.parseAttribute()
+			if err != nil {
+				return c, err
+			}
+			c.filters = append(c.filters, filter)
+		case ':':
+			filter, err := p.parsePseudo()
+			if err != nil {
+				return c, err
+			}
+			c.filters = append(c.filters, filter)
+		default:
+			if c.nodeType == "" && len(c.filters) == 0 {
+				return c, p.errorf("expected a node type, *, [ or :")
+			}
+
+			return c, nil
+		}
+	}
+}
+
+func nodeAttribute(node *AstNode, name string) (string, bool) {
+	switch name {
+	case "type":
+		return node.Type, true
+	case "value":
+		return node.Value, node.Value != ""
+	case "qualifier":
+		return node.ValueQualifier, node.ValueQualifier != ""
+	case "database":
+		return node.Path.Database, node.Path.Database != ""
+	case "table":
+		return node.Path.Table, node.Path.Table != ""
+	case "column":
+		return node.Path.Column, node.Path.Column != ""
+	}
+
+	return node.Annotation(name)
+}
+
+func (p *selectorParser) parseAttribute() (func(node *AstNode) bool, error) {
+	p.pos++
+	p.skipSpace()
+
+	name := p.parseName()
+	if name == "" {
+		return nil, p.errorf("expected an attribute name")
+	}
+
+	p.skipSpace()
+
+	if p.consume("]") {
+		return func(node *AstNode) bool {
+			_, ok := nodeAttribute(node, name)
+			return ok
+		}, nil
+	}
+
+	var op string
+	for _, candidate := range []string{"!=", "^=", "$=", "*=", "~=", "="} {
+		if p.consume(candidate) {
+			op = candidate
+			break
+		}
+	}
+	if op == "" {
+		return nil, p.errorf("expected an attribute operator")
+	}
+
+	p.skipSpace()
+	value, err := p.parseAttributeValue()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	if !p.consume("]") {
+		return nil, p.errorf("expected ]")
+	}
+
+	var compare func(actual string) bool
+
+	switch op {
+	case "=":
+		compare = func(actual string) bool { return actual == value }
+	case "!=":
+		compare = func(actual string) bool { return actual != value }
+	case "^=":
+		compare = func(actual string) bool { return strings.HasPrefix(actual, value) }
+	case "$=":
+		compare = func(actual string) bool { return strings.HasSuffix(actual, value) }
+	case "*=":
+		compare = func(actual string) bool { return strings.Contains(actual, value) }
+	case "~=":
+		r, err := regexp.Compile(value)
+		if err != nil {
+			return nil, p.errorf("invalid regular expression: %s", err)
+		}
+		compare = r.MatchString
+	}
+
+	return func(node *AstNode) bool {
+		actual, _ := nodeAttribute(node, name)
+		return compare(actual)
+	}, nil
+}
+
+func (p *selectorParser) parseAttributeValue() (string, error) {
+	quote := p.peek()
+
+	if quote != '\'' && quote != '"' {
+		start := p.pos
+		for !p.done() && p.peek() != ']' && p.peek() != ' ' {
+			p.pos++
+		}
+
+		return p.input[start:p.pos], nil
+	}
+
+	var sb strings.Builder
+	p.pos++
+
+	for !p.done() {
+		c := p.peek()
+		p.pos++
+
+		switch {
+		case c == '\\' && !p.done():
+			sb.WriteByte(p.peek())
+			p.pos++
+		case c == quote:
+			return sb.String(), nil
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	return "", p.errorf("unterminated attribute value")
+}
+
+func siblingIndex(node *AstNode) int {
+	if node.Parent == nil {
+		return -1
+	}
+
+	for i, sibling := range node.Parent.Children {
+		if sibling == node {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// explainIndex returns node's position among the children of its parent that appear in
+// explain output, or -1 for a root or synthetic node.
+func explainIndex(node *AstNode) int {
+	if node.Parent == nil || node.Synthetic {
+		return -1
+	}
+
+	for i, sibling := range node.Parent.explainChildren() {
+		if sibling == node {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (p *selectorParser) parsePseudo() (func(node *AstNode) bool, error) {
+	p.pos++
+	name := p.parseName()
+
+	switch name {
+	case "root":
+		return func(node *AstNode) bool { return node.Parent == nil }, nil
+	case "empty":
+		return func(node *AstNode) bool { return len(node.Children) == 0 }, nil
+	case "first-child":
+		return func(node *AstNode) bool { return explainIndex(node) == 0 }, nil
+	case "last-child":
+		return func(node *AstNode) bool {
+			index := explainIndex(node)
+			return index != -1 && index == len(node.Parent.explainChildren())-1
+		}, nil
+	case "only-child":
+		return func(node *AstNode) bool {
+			return explainIndex(node) != -1 && len(node.Parent.explainChildren()) == 1
+		}, nil
+	case "nth-child":
+		argument, err := p.parsePseudoArgument()
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(argument))
+		if err != nil || n < 1 {
+			return nil, p.errorf("nth-child expects a positive integer, got %q", argument)
+		}
+
+		return func(node *AstNode) bool { return explainIndex(node) == n-1 }, nil
+	case "not", "has":
+		if !p.consume("(") {
+			return nil, p.errorf("expected ( after :%s", name)
+		}
+
+		inner, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+
+		p.skipSpace()
+		if !p.consume(")") {
+			return nil, p.errorf("expected ) to close :%s", name)
+		}
+
+		s := &Selector{alternatives: inner}
+
+		if name == "not" {
+			return func(node *AstNode) bool { return !s.Match(node) }, nil
+		}
+
+		return func(node *AstNode) bool {
+			for _, child := range node.Children {
+				if len(s.Select(child)) > 0 {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+
+	return nil, p.errorf("unknown pseudo-class :%s", name)
+}
+
+func (p *selectorParser) parsePseudoArgument() (string, error) {
+	if !p.consume("(") {
+		return "", p.errorf("expected (")
+	}
+
+	end := strings.IndexByte(p.input[p.pos:], ')')
+	if end == -1 {
+		return "", p.errorf("expected )")
+	}
+
+	argument := p.input[p.pos : p.pos+end]
+	p.pos += end + 1
+
+	return argument, nil
+}
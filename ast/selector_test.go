@@ -0,0 +1,88 @@
+package ast
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func selectValues(t *testing.T, a *Ast, selector string) []string {
+	nodes, err := a.Select(selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := []string{}
+	for _, node := range nodes {
+		values = append(values, node.Type+":"+node.Value)
+	}
+
+	return values
+}
+
+func TestSelect(t *testing.T) {
+	create, _ := NewFromExplainLines("", createTableLines())
+	tuples, _ := NewFromExplainLines("", queryWithTupleLines())
+	selectAst, _ := NewFromExplainLines("", astLines())
+
+	assert.Equal(t, []string{"ColumnDeclaration:z", "ColumnDeclaration:s"},
+		selectValues(t, create, "CreateQuery > Columns ColumnDeclaration"))
+
+	assert.Equal(t, []string{"Literal:'{} and {} have {}'"},
+		selectValues(t, tuples, "Function[value=format] > ExpressionList > Literal:first-child"))
+
+	assert.Equal(t, []string{"Identifier:a", "Identifier:b"},
+		selectValues(t, tuples, "Function[value=funky] Identifier"))
+
+	assert.Equal(t, []string{"Identifier:z", "Function:z"},
+		selectValues(t, selectAst, "SelectQuery > ExpressionList > [alias]"))
+
+	assert.Equal(t, []string{"Function:z"},
+		selectValues(t, selectAst, "*[alias='r']"))
+
+	assert.Equal(t, []string{"Function:toString", "Function:funky"},
+		selectValues(t, tuples, "Function[value~='^(toString|funky)$']"))
+
+	assert.Equal(t, []string{"Function:toYYYYMM", "Identifier:z"},
+		selectValues(t, create, "Storage > :not(Function[value=MergeTree], Set)"))
+
+	assert.Equal(t, []string{"ColumnDeclaration:s"},
+		selectValues(t, create, "ColumnDeclaration:has(Function[value=CODEC])"))
+
+	assert.Equal(t, []string{"Literal:Tuple_(UInt64_5, 'maximus', 'jebediah')"},
+		selectValues(t, tuples, "Function[value=array] Literal:nth-child(2)"))
+
+	assert.Equal(t, []string{"Asterisk:", "TableIdentifier:my_table_or_view"},
+		selectValues(t, selectAst, "TableIdentifier, Asterisk:only-child, Asterisk:first-child"))
+
+	assert.Equal(t, []string{"CreateQuery:t1"},
+		selectValues(t, create, ":root[database=db]"))
+}
+
+func TestSelectSkipsSyntheticNodes(t *testing.T) {
+	view, err := NewFromExplainLines("create materialized view my_table_or_view to some_table as select * from z", createQueryAstLines())
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"Identifier:my_table_or_view"}, selectValues(t, view, "CreateQuery > :first-child"))
+	assert.Equal(t, []string{"SelectWithUnionQuery:"}, selectValues(t, view, "CreateQuery > :nth-child(2)"))
+	assert.Equal(t, []string{"SelectWithUnionQuery:"}, selectValues(t, view, "CreateQuery > :last-child"))
+	assert.Empty(t, selectValues(t, view, "MateralizedViewToTable:first-child, MateralizedViewToTable > :only-child"))
+
+	_, err = (&Ast{}).Select("CreateQuery")
+	assert.ErrorContains(t, err, "empty ast")
+}
+
+func TestCompileSelectorErrors(t *testing.T) {
+	for _, selector := range []string{
+		"",
+		"Function[value",
+		"Function[value=x",
+		"Function:unknown",
+		"Function:nth-child(zero)",
+		"Function >",
+		"Function[value~='(']",
+	} {
+		_, err := CompileSelector(selector)
+		assert.Error(t, err, selector)
+	}
+}
@@ -0,0 +1,150 @@
+package ast
+
+import (
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Node types whose explain id is "Type database table", with an empty database
+// leaving a double space, e.g. "CreateQuery  t1".
+var databaseAndTableTypes = map[string]bool{
+	"CreateQuery":   true,
+	"AlterQuery":    true,
+	"DropQuery":     true,
+	"DetachQuery":   true,
+	"TruncateQuery": true,
+}
+
+// explainValue renders the value portion of the node's explain line.
+func (n *AstNode) explainValue() string {
+	if databaseAndTableTypes[n.Type] {
+		return n.ValueQualifier + " " + n.Value
+	}
+
+	if identifierValueTypes[n.Type] || tableLevelTypes[n.Type] {
+		if len(n.Path.Parts) > 0 && n.pathMatchesValue() {
+			return n.Path.String()
+		}
+
+		if n.ValueQualifier != "" {
+			return QuoteIdentifier(n.ValueQualifier) + "." + QuoteIdentifier(n.Value)
+		}
+
+		if n.Type == "ColumnDeclaration" {
+			return n.Value
+		}
+
+		return QuoteIdentifier(n.Value)
+	}
+
+	if n.ValueQualifier != "" {
+		return n.ValueQualifier + "." + n.Value
+	}
+
+	return n.Value
+}
+
+// pathMatchesValue reports whether Path still describes Value and ValueQualifier,
+// which stops being true once either is edited directly.
+func (n *AstNode) pathMatchesValue() bool {
+	probe := AstNode{Type: n.Type}
+	setValueAndQualifier(n.Path.String(), &probe)
+
+	return probe.Value == n.Value && probe.ValueQualifier == n.ValueQualifier
+}
+
+// explainMeta renders the parenthesised annotations of the node's explain line,
+// counting the node's current children.
+func (n *AstNode) explainMeta() string {
+	var parts []string
+
+	if n.Alias != "" {
+		parts = append(parts, "(alias "+n.Alias+")")
+	}
+
+	for _, annotation := range n.Annotations {
+		if annotation.Value == "" {
+			parts = append(parts, "("+annotation.Key+")")
+		} else {
+			parts = append(parts, "("+annotation.Key+" "+annotation.Value+")")
+		}
+	}
+
+	if count := len(n.explainChildren()); count > 0 {
+		parts = append(parts, "(children "+strconv.Itoa(count)+")")
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// explainLine renders the node as a single line of explain ast output.
+func (n *AstNode) explainLine(indent int) string {
+	var sb strings.Builder
+
+	sb.WriteString(strings.Repeat(" ", indent))
+	sb.WriteString(n.Type)
+
+	if value := n.explainValue(); value != "" {
+		sb.WriteString(" ")
+		sb.WriteString(value)
+	}
+
+	if meta := n.explainMeta(); meta != "" {
+		sb.WriteString(" ")
+		sb.WriteString(meta)
+	}
+
+	return sb.String()
+}
+
+// refreshLine brings the node's Meta, DeclaredChildren and RawLine in line with its
+// current fields and children. Synthetic nodes have no explain line.
+func (n *AstNode) refreshLine() {
+	if n.Synthetic {
+		return
+	}
+
+	n.Meta = n.explainMeta()
+	n.DeclaredChildren = len(n.explainChildren())
+	n.RawLine = n.explainLine(n.Indent)
+}
+
+// WriteTo writes the subtree to w as explain ast text. See Serialize.
+func (n *AstNode) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	var err error
+
+	var write func(node *AstNode, depth int)
+	write = func(node *AstNode, depth int) {
+		if err != nil || node.Synthetic {
+			return
+		}
+
+		var count int
+		count, err = io.WriteString(w, node.explainLine(depth)+"\n")
+		written += int64(count)
+
+		for _, child := range node.Children {
+			write(child, depth+1)
+		}
+	}
+
+	write(n, 0)
+
+	return written, err
+}
+
+// Serialize renders the subtree as explain ast text in ClickHouse's format, one line
+// per node, with the node itself unindented and children counts recomputed.
+// Synthetic nodes are left out, so Parse(query, Serialize(tree)) rebuilds the tree.
+func (n *AstNode) Serialize() string {
+	var sb strings.Builder
+	n.WriteTo(&sb)
+
+	return sb.String()
+}
+
+func (n *AstNode) String() string {
+	return strings.TrimSuffix(n.Serialize(), "\n")
+}
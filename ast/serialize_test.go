@@ -0,0 +1,82 @@
+package ast
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSerializeRoundTrip(t *testing.T) {
+	fixtures := [][]string{
+		astLines(),
+		createFunctionAstLines(),
+		createQueryAstLines(),
+		queryWithTupleLines(),
+		selectWithClausesLines(),
+		createTableLines(),
+		alterTableLines(),
+	}
+
+	for _, lines := range fixtures {
+		root, err := Parse("", lines)
+		assert.NoError(t, err)
+
+		serialized := root.Serialize()
+		assert.Equal(t, strings.Join(lines, "\n")+"\n", serialized)
+
+		reparsed, err := ParseReader("", strings.NewReader(serialized))
+		assert.NoError(t, err)
+		assert.Equal(t, root.Hash, reparsed.Hash)
+	}
+}
+
+func TestSerializeQuotedIdentifiersAndLiterals(t *testing.T) {
+	lines := []string{
+		"ExpressionList (children 4)",
+		" Identifier `my db`.t.c (alias `x y`)",
+		" Literal Tuple_('a b', Array_[UInt64_1, NULL]) (alias t)",
+		" TableIdentifier db.t1 (uuid '1234')",
+		" Identifier t.1",
+	}
+
+	root, err := Parse("", lines)
+	assert.NoError(t, err)
+
+	assert.Equal(t, strings.Join(lines, "\n"), root.String())
+}
+
+func TestSerializeAfterEdits(t *testing.T) {
+	query := "create materialized view my_table_or_view to some_table as select * from z"
+	root, err := Parse(query, createQueryAstLines())
+	assert.NoError(t, err)
+
+	selectList := root.Children[2].Children[0].Children[0].Children[0]
+	assert.NoError(t, selectList.Children[1].Remove())
+	selectList.Children[0].Alias = "everything"
+	selectList.Children[0].UpdateHash()
+
+	expected := []string{
+		"CreateQuery  my_table_or_view (children 2)",
+		" Identifier my_table_or_view",
+		" SelectWithUnionQuery (children 1)",
+		"  ExpressionList (children 1)",
+		"   SelectQuery (children 2)",
+		"    ExpressionList (children 3)",
+		"     Asterisk (alias everything)",
+		"     Literal 'a literal with spaces'",
+		"     Literal Array_['an', 'array', 'literal']",
+		"    TablesInSelectQuery (children 1)",
+		"     TablesInSelectQueryElement (children 1)",
+		"      TableExpression (children 1)",
+		"       TableIdentifier z",
+	}
+	assert.Equal(t, strings.Join(expected, "\n"), root.String())
+
+	reparsed, err := Parse(query, strings.Split(root.Serialize(), "\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, root.Hash, reparsed.Hash)
+
+	subtree := root.Children[2].Children[0]
+	assert.True(t, strings.HasPrefix(subtree.Serialize(), "ExpressionList (children 1)\n SelectQuery (children 2)\n"))
+}
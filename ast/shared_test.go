@@ -5,7 +5,7 @@ func astLines() []string {
 		"SelectWithUnionQuery (children 1)",
 		" ExpressionList (children 1)",
 		"  SelectQuery (children 2)",
-		"   ExpressionList (children 1)",
+		"   ExpressionList (children 3)",
 		"    Asterisk",
 		"    Identifier z (alias n)",
 		"    Function z (alias r) (children 1)",
@@ -37,7 +37,7 @@ func createQueryAstLines() []string {
 		" SelectWithUnionQuery (children 1)",
 		"  ExpressionList (children 1)",
 		"   SelectQuery (children 2)",
-		"    ExpressionList (children 2)",
+		"    ExpressionList (children 4)",
 		"     Asterisk",
 		"     Literal ' '",
 		"     Literal 'a literal with spaces'",
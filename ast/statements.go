@@ -0,0 +1,771 @@
+package ast
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Typed views over common statement nodes. explain ast drops clause keywords, so
+// clauses that are plain expressions (WHERE vs HAVING, PARTITION BY vs ORDER BY, etc.)
+// are told apart by their position among their siblings.
+
+func (node *AstNode) firstChildOfType(nodeType string) *AstNode {
+	for _, child := range node.Children {
+		if child.Type == nodeType {
+			return child
+		}
+	}
+
+	return nil
+}
+
+func (node *AstNode) isListOf(childType string) bool {
+	return node.Type == "ExpressionList" &&
+		len(node.Children) > 0 &&
+		node.Children[0].Type == childType
+}
+
+func childrenOf(node *AstNode) []*AstNode {
+	if node == nil {
+		return nil
+	}
+
+	return node.Children
+}
+
+// SelectQuery is a typed view over a SelectQuery node.
+type SelectQuery struct {
+	Node    *AstNode
+	clauses selectClauses
+}
+
+type selectClauses struct {
+	with          *AstNode
+	columns       *AstNode
+	tables        *AstNode
+	prewhere      *AstNode
+	where         *AstNode
+	groupBy       *AstNode
+	having        *AstNode
+	window        *AstNode
+	orderBy       *AstNode
+	limitByOffset *AstNode
+	limitByLength *AstNode
+	limitBy       *AstNode
+	limitOffset   *AstNode
+	limitLength   *AstNode
+	settings      *AstNode
+}
+
+func AsSelectQuery(node *AstNode) (SelectQuery, bool) {
+	if node == nil || node.Type != "SelectQuery" {
+		return SelectQuery{}, false
+	}
+
+	children := node.explainChildren()
+
+	if hint := node.Hints[hintClauses]; hint != "" {
+		if clauses, ok := classifySelectChildrenWithHint(children, strings.Split(hint, ",")); ok {
+			return SelectQuery{Node: node, clauses: clauses}, true
+		}
+	}
+
+	return SelectQuery{Node: node, clauses: classifySelectChildren(children)}, true
+}
+
+// classifySelectChildrenWithHint assigns SelectQuery children to the clause keywords
+// found in the source query, failing if they don't line up.
+func classifySelectChildrenWithHint(children []*AstNode, keywords []string) (selectClauses, bool) {
+	var clauses selectClauses
+	rest := children
+
+	take := func(valid bool) *AstNode {
+		if len(rest) == 0 || !valid {
+			return nil
+		}
+		node := rest[0]
+		rest = rest[1:]
+		return node
+	}
+
+	takeLimit := func() (offset *AstNode, length *AstNode) {
+		count := 0
+		for count < len(rest) && count < 2 && rest[count].Type == "Literal" {
+			count++
+		}
+		if count == 0 && len(rest) > 0 {
+			count = 1
+		}
+		literals := rest[:count]
+		rest = rest[count:]
+		return splitLimit(literals)
+	}
+
+	for _, keyword := range keywords {
+		if len(rest) == 0 {
+			return clauses, false
+		}
+
+		next := rest[0]
+		var taken *AstNode
+
+		switch keyword {
+		case "WITH":
+			clauses.with = take(next.Type == "ExpressionList")
+			taken = clauses.with
+		case "SELECT":
+			clauses.columns = take(next.Type == "ExpressionList")
+			taken = clauses.columns
+		case "FROM":
+			clauses.tables = take(next.Type == "TablesInSelectQuery")
+			taken = clauses.tables
+		case "PREWHERE":
+			clauses.prewhere = take(true)
+			taken = clauses.prewhere
+		case "WHERE":
+			clauses.where = take(true)
+			taken = clauses.where
+		case "GROUP BY":
+			clauses.groupBy = take(next.Type == "ExpressionList")
+			taken = clauses.groupBy
+		case "HAVING":
+			clauses.having = take(true)
+			taken = clauses.having
+		case "WINDOW":
+			clauses.window = take(next.isListOf("WindowListElement"))
+			taken = clauses.window
+		case "ORDER BY":
+			clauses.orderBy = take(next.isListOf("OrderByElement"))
+			taken = clauses.orderBy
+		case "LIMIT BY":
+			clauses.limitByOffset, clauses.limitByLength = takeLimit()
+			clauses.limitBy = take(len(rest) > 0 && rest[0].Type == "ExpressionList")
+			taken = clauses.limitBy
+		case "LIMIT":
+			clauses.limitOffset, clauses.limitLength = takeLimit()
+			taken = clauses.limitLength
+		case "SETTINGS":
+			clauses.settings = take(next.Type == "Set")
+			taken = clauses.settings
+		}
+
+		if taken == nil {
+			return clauses, false
+		}
+	}
+
+	return clauses, len(rest) == 0
+}
+
+// classifySelectChildren assigns SelectQuery children to clauses. Children always
+// appear in the order: with, select, tables, prewhere, where, group by, having, window,
+// order by, limit by offset, limit by length, limit by, limit offset, limit length, settings.
+func classifySelectChildren(children []*AstNode) selectClauses {
+	var clauses selectClauses
+
+	rest := children
+
+	if len(rest) > 0 && rest[len(rest)-1].Type == "Set" {
+		clauses.settings = rest[len(rest)-1]
+		rest = rest[:len(rest)-1]
+	}
+
+	tablesIndex := -1
+	for i, child := range rest {
+		if child.Type == "TablesInSelectQuery" {
+			tablesIndex = i
+			break
+		}
+	}
+
+	leadingLists := 0
+	for leadingLists < len(rest) && rest[leadingLists].Type == "ExpressionList" {
+		leadingLists++
+	}
+
+	switch {
+	case tablesIndex >= 2 && leadingLists >= 2:
+		clauses.with, clauses.columns = rest[0], rest[1]
+	case tablesIndex < 0 && leadingLists >= 2 && !rest[1].isListOf("OrderByElement"):
+		clauses.with, clauses.columns = rest[0], rest[1]
+	case leadingLists >= 1:
+		clauses.columns = rest[0]
+	}
+
+	switch {
+	case tablesIndex >= 0:
+		clauses.tables = rest[tablesIndex]
+		rest = rest[tablesIndex+1:]
+	case clauses.with != nil:
+		rest = rest[2:]
+	case clauses.columns != nil:
+		rest = rest[1:]
+	}
+
+	// LIMIT [offset,] length comes last, preceded by LIMIT [offset,] length BY list.
+	trailingLiterals := func() []*AstNode {
+		i := len(rest)
+		for i > 0 && len(rest)-i < 2 && rest[i-1].Type == "Literal" {
+			i--
+		}
+		literals := rest[i:]
+		rest = rest[:i]
+		return literals
+	}
+
+	clauses.limitOffset, clauses.limitLength = splitLimit(trailingLiterals())
+
+	if len(rest) >= 2 && rest[len(rest)-1].Type == "ExpressionList" &&
+		!rest[len(rest)-1].isListOf("OrderByElement") &&
+		rest[len(rest)-2].Type == "Literal" {
+		clauses.limitBy = rest[len(rest)-1]
+		rest = rest[:len(rest)-1]
+		clauses.limitByOffset, clauses.limitByLength = splitLimit(trailingLiterals())
+	}
+
+	if len(rest) > 0 && rest[len(rest)-1].isListOf("OrderByElement") {
+		clauses.orderBy = rest[len(rest)-1]
+		rest = rest[:len(rest)-1]
+	}
+
+	if len(rest) > 0 && rest[len(rest)-1].isListOf("WindowListElement") {
+		clauses.window = rest[len(rest)-1]
+		rest = rest[:len(rest)-1]
+	}
+
+	var filters []*AstNode
+	for _, child := range rest {
+		switch {
+		case child.Type == "ExpressionList" && clauses.groupBy == nil:
+			clauses.groupBy = child
+		case clauses.groupBy != nil:
+			clauses.having = child
+		default:
+			filters = append(filters, child)
+		}
+	}
+
+	switch len(filters) {
+	case 1:
+		clauses.where = filters[0]
+	case 2:
+		clauses.prewhere, clauses.where = filters[0], filters[1]
+	}
+
+	return clauses
+}
+
+func splitLimit(literals []*AstNode) (offset *AstNode, length *AstNode) {
+	switch len(literals) {
+	case 1:
+		return nil, literals[0]
+	case 2:
+		return literals[0], literals[1]
+	}
+
+	return nil, nil
+}
+
+// With returns the expressions of the WITH clause.
+func (q SelectQuery) With() []*AstNode { return childrenOf(q.clauses.with) }
+
+// Columns returns the expressions being selected.
+func (q SelectQuery) Columns() []*AstNode { return childrenOf(q.clauses.columns) }
+
+// Tables returns the TablesInSelectQueryElement nodes of the FROM clause, including joins.
+func (q SelectQuery) Tables() []*AstNode { return childrenOf(q.clauses.tables) }
+
+// From returns the first table expression being selected from.
+func (q SelectQuery) From() (TableExpression, bool) {
+	tables := q.Tables()
+	if len(tables) == 0 {
+		return TableExpression{}, false
+	}
+
+	return AsTableExpression(tables[0].firstChildOfType("TableExpression"))
+}
+
+// Joins returns every table joined onto the FROM table, including ARRAY JOINs and comma joins.
+func (q SelectQuery) Joins() []Join {
+	var joins []Join
+
+	for i, element := range q.Tables() {
+		if i == 0 && element.firstChildOfType("ArrayJoin") == nil {
+			continue
+		}
+
+		join := Join{
+			Node:      element,
+			TableJoin: element.firstChildOfType("TableJoin"),
+			ArrayJoin: element.firstChildOfType("ArrayJoin"),
+		}
+		join.Table, _ = AsTableExpression(element.firstChildOfType("TableExpression"))
+		joins = append(joins, join)
+	}
+
+	return joins
+}
+
+func (q SelectQuery) Prewhere() *AstNode { return q.clauses.prewhere }
+func (q SelectQuery) Where() *AstNode    { return q.clauses.where }
+func (q SelectQuery) Having() *AstNode   { return q.clauses.having }
+
+func (q SelectQuery) GroupBy() []*AstNode { return childrenOf(q.clauses.groupBy) }
+
+// Window returns the WindowListElement nodes of the WINDOW clause.
+func (q SelectQuery) Window() []*AstNode { return childrenOf(q.clauses.window) }
+
+// OrderBy returns the OrderByElement nodes of the ORDER BY clause.
+func (q SelectQuery) OrderBy() []*AstNode { return childrenOf(q.clauses.orderBy) }
+
+// LimitBy returns the LIMIT BY expressions along with their offset and length literals.
+func (q SelectQuery) LimitBy() (offset *AstNode, length *AstNode, by []*AstNode) {
+	return q.clauses.limitByOffset, q.clauses.limitByLength, childrenOf(q.clauses.limitBy)
+}
+
+func (q SelectQuery) Limit() (offset *AstNode, length *AstNode) {
+	return q.clauses.limitOffset, q.clauses.limitLength
+}
+
+// Settings returns the Set node of the SETTINGS clause.
+func (q SelectQuery) Settings() *AstNode { return q.clauses.settings }
+
+// TableExpression is a typed view over a TableExpression node: a table, subquery or table function.
+type TableExpression struct {
+	Node *AstNode
+}
+
+func AsTableExpression(node *AstNode) (TableExpression, bool) {
+	if node == nil || node.Type != "TableExpression" {
+		return TableExpression{}, false
+	}
+
+	return TableExpression{Node: node}, true
+}
+
+func (t TableExpression) Table() *AstNode { return t.Node.firstChildOfType("TableIdentifier") }
+
+func (t TableExpression) Subquery() *AstNode { return t.Node.firstChildOfType("Subquery") }
+
+func (t TableExpression) TableFunction() *AstNode { return t.Node.firstChildOfType("Function") }
+
+// Source returns whichever of the table, subquery or table function is present.
+func (t TableExpression) Source() *AstNode {
+	if len(t.Node.Children) == 0 {
+		return nil
+	}
+
+	return t.Node.Children[0]
+}
+
+func (t TableExpression) Alias() string {
+	if source := t.Source(); source != nil {
+		return source.Alias
+	}
+
+	return ""
+}
+
+// Join is a TablesInSelectQueryElement joined onto the tables before it.
+type Join struct {
+	Node      *AstNode
+	Table     TableExpression
+	TableJoin *AstNode
+	ArrayJoin *AstNode
+}
+
+// Using returns the USING columns of the join, if any.
+func (j Join) Using() []*AstNode {
+	if j.TableJoin == nil || len(j.TableJoin.Children) == 0 || j.TableJoin.Children[0].Type != "ExpressionList" {
+		return nil
+	}
+
+	return j.TableJoin.Children[0].Children
+}
+
+// On returns the ON expression of the join, if any.
+func (j Join) On() *AstNode {
+	if j.TableJoin == nil || len(j.TableJoin.Children) == 0 || j.TableJoin.Children[0].Type == "ExpressionList" {
+		return nil
+	}
+
+	return j.TableJoin.Children[0]
+}
+
+// CreateQuery is a typed view over a CreateQuery node for tables, views and materialized views.
+type CreateQuery struct {
+	Node *AstNode
+}
+
+func AsCreateQuery(node *AstNode) (CreateQuery, bool) {
+	if node == nil || node.Type != "CreateQuery" {
+		return CreateQuery{}, false
+	}
+
+	return CreateQuery{Node: node}, true
+}
+
+func (c CreateQuery) Name() string     { return c.Node.Value }
+func (c CreateQuery) Database() string { return c.Node.ValueQualifier }
+
+func (c CreateQuery) columnsList(childType string) []*AstNode {
+	definition := c.Node.firstChildOfType("Columns")
+	if definition == nil {
+		return nil
+	}
+
+	for _, list := range definition.Children {
+		if list.isListOf(childType) {
+			return list.Children
+		}
+	}
+
+	return nil
+}
+
+func (c CreateQuery) Columns() []ColumnDeclaration {
+	var columns []ColumnDeclaration
+
+	for _, node := range c.columnsList("ColumnDeclaration") {
+		column, _ := AsColumnDeclaration(node)
+		columns = append(columns, column)
+	}
+
+	return columns
+}
+
+// Indices returns the Index nodes declared alongside the columns.
+func (c CreateQuery) Indices() []*AstNode { return c.columnsList("Index") }
+
+// Select returns the SelectWithUnionQuery of a view or CREATE ... AS SELECT.
+func (c CreateQuery) Select() *AstNode { return c.Node.firstChildOfType("SelectWithUnionQuery") }
+
+// To returns the target table of a materialized view.
+func (c CreateQuery) To() string {
+	if to := c.Node.firstChildOfType("MateralizedViewToTable"); to != nil {
+		return to.Value
+	}
+
+	return ""
+}
+
+func (c CreateQuery) Storage() *AstNode { return c.Node.firstChildOfType("Storage") }
+
+type storageClauses struct {
+	engine      *AstNode
+	partitionBy *AstNode
+	primaryKey  *AstNode
+	orderBy     *AstNode
+	sampleBy    *AstNode
+	ttl         *AstNode
+	settings    *AstNode
+	// unknown holds key expressions that couldn't be assigned to a clause.
+	unknown []*AstNode
+}
+
+// check returns an error if some of the storage's key expressions are unknown.
+func (s storageClauses) check(storage *AstNode) error {
+	if len(s.unknown) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("unknown storage clauses for %d key expressions of the Storage node on line %d, parse with the source query", len(s.unknown), storage.LineNumber)
+}
+
+// classifyStorageChildren assigns Storage children to clauses. They always appear in the
+// order: engine, partition by, primary key, order by, sample by, ttl, settings.
+// The key expressions are indistinguishable, so they're matched to the clauses found in
+// the source query. Without those, a lone key is the ORDER BY every MergeTree needs,
+// and any more are left unknown rather than guessed at.
+func classifyStorageChildren(storage *AstNode) storageClauses {
+	clauses, expressions := storageChildren(storage)
+
+	if hint := storage.Hints[hintClauses]; hint != "" {
+		present := map[string]bool{}
+		for _, keyword := range strings.Split(hint, ",") {
+			present[keyword] = true
+		}
+
+		slots := []struct {
+			keyword string
+			clause  **AstNode
+		}{
+			{"PARTITION BY", &clauses.partitionBy},
+			{"PRIMARY KEY", &clauses.primaryKey},
+			{"ORDER BY", &clauses.orderBy},
+			{"SAMPLE BY", &clauses.sampleBy},
+		}
+
+		var assigned []**AstNode
+		for _, slot := range slots {
+			if present[slot.keyword] {
+				assigned = append(assigned, slot.clause)
+			}
+		}
+
+		if len(assigned) == len(expressions) {
+			for i, clause := range assigned {
+				*clause = expressions[i]
+			}
+			return clauses
+		}
+	}
+
+	if len(expressions) == 1 {
+		clauses.orderBy = expressions[0]
+	} else {
+		clauses.unknown = expressions
+	}
+
+	return clauses
+}
+
+// storageChildren picks out the engine, TTL and settings of a Storage node, returning
+// the key expressions that are left in order.
+func storageChildren(storage *AstNode) (storageClauses, []*AstNode) {
+	var clauses storageClauses
+	var expressions []*AstNode
+
+	for i, child := range storage.explainChildren() {
+		switch {
+		case i == 0 && child.Type == "Function":
+			clauses.engine = child
+		case child.Type == "Set":
+			clauses.settings = child
+		case child.isListOf("TTLElement"):
+			clauses.ttl = child
+		default:
+			expressions = append(expressions, child)
+		}
+	}
+
+	return clauses, expressions
+}
+
+func (c CreateQuery) storageClauses() storageClauses {
+	storage := c.Storage()
+	if storage == nil {
+		return storageClauses{}
+	}
+
+	return classifyStorageChildren(storage)
+}
+
+// Engine returns the engine Function node, e.g. MergeTree.
+func (c CreateQuery) Engine() *AstNode { return c.storageClauses().engine }
+
+// The key accessors return nil when their clause is unknown because the statement
+// wasn't parsed with its source query.
+func (c CreateQuery) PartitionBy() *AstNode { return c.storageClauses().partitionBy }
+func (c CreateQuery) PrimaryKey() *AstNode  { return c.storageClauses().primaryKey }
+func (c CreateQuery) OrderBy() *AstNode     { return c.storageClauses().orderBy }
+func (c CreateQuery) SampleBy() *AstNode    { return c.storageClauses().sampleBy }
+
+// TTL returns the TTLElement nodes of the table TTL.
+func (c CreateQuery) TTL() []*AstNode { return childrenOf(c.storageClauses().ttl) }
+
+// Settings returns the Set node of the storage SETTINGS clause.
+func (c CreateQuery) Settings() *AstNode { return c.storageClauses().settings }
+
+// ColumnDeclaration is a typed view over a ColumnDeclaration node.
+type ColumnDeclaration struct {
+	Node *AstNode
+}
+
+func AsColumnDeclaration(node *AstNode) (ColumnDeclaration, bool) {
+	if node == nil || node.Type != "ColumnDeclaration" {
+		return ColumnDeclaration{}, false
+	}
+
+	return ColumnDeclaration{Node: node}, true
+}
+
+func (c ColumnDeclaration) Name() string { return c.Node.Value }
+
+// Type returns the DataType node of the column, or nil if the type is inferred from its default.
+func (c ColumnDeclaration) Type() *AstNode { return c.Node.firstChildOfType("DataType") }
+
+type columnClauses struct {
+	dataType     *AstNode
+	defaultValue *AstNode
+	comment      *AstNode
+	codec        *AstNode
+	ttl          *AstNode
+}
+
+func isStringLiteral(node *AstNode) bool {
+	return node.Type == "Literal" && len(node.Value) > 0 && node.Value[0] == '\''
+}
+
+// classifyColumnChildren assigns ColumnDeclaration children to clauses. They always appear
+// in the order: type, default, comment, codec, ttl. Without clause keywords from the source
+// query, a lone string literal is assumed to be a comment rather than a default.
+func classifyColumnChildren(column *AstNode) columnClauses {
+	var clauses columnClauses
+	var beforeCodec, afterCodec []*AstNode
+
+	for i, child := range column.explainChildren() {
+		switch {
+		case i == 0 && child.Type == "DataType":
+			clauses.dataType = child
+		case child.Type == "Function" && child.Value == "CODEC":
+			clauses.codec = child
+		case clauses.codec != nil:
+			afterCodec = append(afterCodec, child)
+		default:
+			beforeCodec = append(beforeCodec, child)
+		}
+	}
+
+	if hint, ok := column.Hints[hintClauses]; ok {
+		present := map[string]bool{}
+		for _, keyword := range strings.Split(hint, ",") {
+			present[keyword] = true
+		}
+
+		expressions := append(append([]*AstNode(nil), beforeCodec...), afterCodec...)
+		var assigned []**AstNode
+		for _, slot := range []struct {
+			keyword string
+			clause  **AstNode
+		}{{"DEFAULT", &clauses.defaultValue}, {"COMMENT", &clauses.comment}, {"TTL", &clauses.ttl}} {
+			if present[slot.keyword] {
+				assigned = append(assigned, slot.clause)
+			}
+		}
+
+		if len(assigned) == len(expressions) {
+			for i, clause := range assigned {
+				*clause = expressions[i]
+			}
+			return clauses
+		}
+	}
+
+	if len(afterCodec) > 0 {
+		clauses.ttl = afterCodec[0]
+	} else if len(beforeCodec) == 3 || len(beforeCodec) == 2 && !isStringLiteral(beforeCodec[1]) {
+		clauses.ttl = beforeCodec[len(beforeCodec)-1]
+		beforeCodec = beforeCodec[:len(beforeCodec)-1]
+	}
+
+	switch len(beforeCodec) {
+	case 1:
+		if isStringLiteral(beforeCodec[0]) && clauses.ttl == nil {
+			clauses.comment = beforeCodec[0]
+		} else {
+			clauses.defaultValue = beforeCodec[0]
+		}
+	case 2:
+		clauses.defaultValue, clauses.comment = beforeCodec[0], beforeCodec[1]
+	}
+
+	return clauses
+}
+
+func (c ColumnDeclaration) Default() *AstNode { return classifyColumnChildren(c.Node).defaultValue }
+func (c ColumnDeclaration) Codec() *AstNode   { return classifyColumnChildren(c.Node).codec }
+func (c ColumnDeclaration) TTL() *AstNode     { return classifyColumnChildren(c.Node).ttl }
+
+// Comment returns the comment Literal node of the column.
+func (c ColumnDeclaration) Comment() *AstNode { return classifyColumnChildren(c.Node).comment }
+
+// AlterQuery is a typed view over an AlterQuery node.
+type AlterQuery struct {
+	Node *AstNode
+}
+
+func AsAlterQuery(node *AstNode) (AlterQuery, bool) {
+	if node == nil || node.Type != "AlterQuery" {
+		return AlterQuery{}, false
+	}
+
+	return AlterQuery{Node: node}, true
+}
+
+func (a AlterQuery) Table() string    { return a.Node.Value }
+func (a AlterQuery) Database() string { return a.Node.ValueQualifier }
+
+func (a AlterQuery) Commands() []AlterCommand {
+	var commands []AlterCommand
+
+	for _, list := range a.Node.childrenOfType("ExpressionList") {
+		for _, node := range list.childrenOfType("AlterCommand") {
+			command, _ := AsAlterCommand(node)
+			commands = append(commands, command)
+		}
+	}
+
+	return commands
+}
+
+// AlterCommand is a typed view over an AlterCommand node such as ADD_COLUMN or RENAME_COLUMN.
+type AlterCommand struct {
+	Node *AstNode
+}
+
+func AsAlterCommand(node *AstNode) (AlterCommand, bool) {
+	if node == nil || node.Type != "AlterCommand" {
+		return AlterCommand{}, false
+	}
+
+	return AlterCommand{Node: node}, true
+}
+
+// Kind returns the command type, e.g. ADD_COLUMN.
+func (c AlterCommand) Kind() string { return c.Node.Value }
+
+// Column returns the column declaration of ADD_COLUMN and MODIFY_COLUMN commands.
+func (c AlterCommand) Column() (ColumnDeclaration, bool) {
+	return AsColumnDeclaration(c.Node.firstChildOfType("ColumnDeclaration"))
+}
+
+// Identifiers returns the Identifier children of the command, e.g. the from and to columns of RENAME_COLUMN.
+func (c AlterCommand) Identifiers() []*AstNode { return c.Node.childrenOfType("Identifier") }
+
+// ColumnName returns the name of the column the command acts on.
+func (c AlterCommand) ColumnName() string {
+	if column, ok := c.Column(); ok {
+		return column.Name()
+	}
+
+	if identifiers := c.Identifiers(); len(identifiers) > 0 {
+		return identifiers[0].Value
+	}
+
+	return ""
+}
+
+// RenameTo returns the new name of a RENAME_COLUMN command.
+func (c AlterCommand) RenameTo() string {
+	if identifiers := c.Identifiers(); c.Kind() == "RENAME_COLUMN" && len(identifiers) == 2 {
+		return identifiers[1].Value
+	}
+
+	return ""
+}
+
+// Comment returns the comment Literal node of a COMMENT_COLUMN command.
+func (c AlterCommand) Comment() *AstNode {
+	if c.Kind() != "COMMENT_COLUMN" {
+		return nil
+	}
+
+	return c.Node.firstChildOfType("Literal")
+}
+
+// SelectQueries returns every SelectQuery in the tree, including subqueries.
+func (a *Ast) SelectQueries() []SelectQuery {
+	var queries []SelectQuery
+
+	for _, node := range a.NodesForMatch(func(node *AstNode) bool { return node.Type == "SelectQuery" }) {
+		query, _ := AsSelectQuery(node)
+		queries = append(queries, query)
+	}
+
+	return queries
+}
+
+func (a *Ast) CreateQuery() (CreateQuery, bool) { return AsCreateQuery(a.Root) }
+
+func (a *Ast) AlterQuery() (AlterQuery, bool) { return AsAlterQuery(a.Root) }
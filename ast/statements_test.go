@@ -0,0 +1,267 @@
+package ast
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// select a, count() as c from t1 as x left join t2 using z prewhere a > 1 where b = 1
+// group by a having c > 1 order by a limit 5, 10 settings max_threads = 1
+func selectWithClausesLines() []string {
+	return []string{
+		"SelectWithUnionQuery (children 1)",
+		" ExpressionList (children 1)",
+		"  SelectQuery (children 10)",
+		"   ExpressionList (children 2)",
+		"    Identifier a",
+		"    Function count (alias c) (children 1)",
+		"     ExpressionList",
+		"   TablesInSelectQuery (children 2)",
+		"    TablesInSelectQueryElement (children 1)",
+		"     TableExpression (children 1)",
+		"      TableIdentifier t1 (alias x)",
+		"    TablesInSelectQueryElement (children 2)",
+		"     TableExpression (children 1)",
+		"      TableIdentifier t2",
+		"     TableJoin (children 1)",
+		"      ExpressionList (children 1)",
+		"       Identifier z",
+		"   Function greater (children 1)",
+		"    ExpressionList (children 2)",
+		"     Identifier a",
+		"     Literal UInt64_1",
+		"   Function equals (children 1)",
+		"    ExpressionList (children 2)",
+		"     Identifier b",
+		"     Literal UInt64_1",
+		"   ExpressionList (children 1)",
+		"    Identifier a",
+		"   Function greater (children 1)",
+		"    ExpressionList (children 2)",
+		"     Identifier c",
+		"     Literal UInt64_1",
+		"   ExpressionList (children 1)",
+		"    OrderByElement (children 1)",
+		"     Identifier a",
+		"   Literal UInt64_5",
+		"   Literal UInt64_10",
+		"   Set",
+	}
+}
+
+// create table db.t1 (z Int64, s String DEFAULT 'x' COMMENT 'a comment' CODEC(ZSTD(1)))
+// engine = MergeTree partition by toYYYYMM(d) order by z settings index_granularity = 8192
+func createTableLines() []string {
+	return []string{
+		"CreateQuery db t1 (children 4)",
+		" Identifier db",
+		" Identifier t1",
+		" Columns definition (children 1)",
+		"  ExpressionList (children 2)",
+		"   ColumnDeclaration z (children 1)",
+		"    DataType Int64",
+		"   ColumnDeclaration s (children 4)",
+		"    DataType String",
+		"    Literal 'x'",
+		"    Literal 'a comment'",
+		"    Function CODEC (children 1)",
+		"     ExpressionList (children 1)",
+		"      Function ZSTD (children 1)",
+		"       ExpressionList (children 1)",
+		"        Literal UInt64_1",
+		" Storage definition (children 4)",
+		"  Function MergeTree (children 1)",
+		"   ExpressionList",
+		"  Function toYYYYMM (children 1)",
+		"   ExpressionList (children 1)",
+		"    Identifier d",
+		"  Identifier z",
+		"  Set",
+	}
+}
+
+// alter table t1 add column b UInt8 after z, rename column c to d
+func alterTableLines() []string {
+	return []string{
+		"AlterQuery  t1 (children 2)",
+		" ExpressionList (children 2)",
+		"  AlterCommand ADD_COLUMN (children 2)",
+		"   ColumnDeclaration b (children 1)",
+		"    DataType UInt8",
+		"   Identifier z",
+		"  AlterCommand RENAME_COLUMN (children 2)",
+		"   Identifier c",
+		"   Identifier d",
+		" Identifier t1",
+	}
+}
+
+func TestSelectQueryClauses(t *testing.T) {
+	a, err := NewFromExplainLines("", selectWithClausesLines())
+	assert.NoError(t, err)
+
+	queries := a.SelectQueries()
+	assert.Len(t, queries, 1)
+	q := queries[0]
+
+	assert.Len(t, q.Columns(), 2)
+	assert.Equal(t, "c", q.Columns()[1].Alias)
+
+	from, ok := q.From()
+	assert.True(t, ok)
+	assert.Equal(t, "t1", from.Table().Value)
+	assert.Equal(t, "x", from.Alias())
+
+	joins := q.Joins()
+	assert.Len(t, joins, 1)
+	assert.Equal(t, "t2", joins[0].Table.Table().Value)
+	assert.Equal(t, "z", joins[0].Using()[0].Value)
+	assert.Nil(t, joins[0].On())
+
+	assert.Equal(t, "greater", q.Prewhere().Value)
+	assert.Equal(t, "equals", q.Where().Value)
+	assert.Equal(t, "a", q.GroupBy()[0].Value)
+	assert.Equal(t, "greater", q.Having().Value)
+	assert.Equal(t, "OrderByElement", q.OrderBy()[0].Type)
+
+	offset, length := q.Limit()
+	assert.Equal(t, "UInt64_5", offset.Value)
+	assert.Equal(t, "UInt64_10", length.Value)
+	assert.Equal(t, "Set", q.Settings().Type)
+}
+
+func TestSelectQueryLimitBy(t *testing.T) {
+	root, err := Parse("", []string{
+		"SelectQuery (children 5)",
+		" ExpressionList (children 1)",
+		"  Identifier a",
+		" TablesInSelectQuery (children 1)",
+		"  TablesInSelectQueryElement (children 1)",
+		"   TableExpression (children 1)",
+		"    TableIdentifier t",
+		" Literal UInt64_1",
+		" ExpressionList (children 1)",
+		"  Identifier a",
+		" Literal UInt64_10",
+	})
+	assert.NoError(t, err)
+
+	q, ok := AsSelectQuery(root)
+	assert.True(t, ok)
+
+	_, byLength, by := q.LimitBy()
+	assert.Equal(t, "UInt64_1", byLength.Value)
+	assert.Equal(t, "a", by[0].Value)
+
+	_, length := q.Limit()
+	assert.Equal(t, "UInt64_10", length.Value)
+	assert.Nil(t, q.Where())
+}
+
+func TestCreateQueryView(t *testing.T) {
+	a, err := NewFromExplainLines("create table db.t1 (z Int64, s String DEFAULT 'x' COMMENT 'a comment' CODEC(ZSTD(1))) "+
+		"engine = MergeTree partition by toYYYYMM(d) order by z settings index_granularity = 8192", createTableLines())
+	assert.NoError(t, err)
+
+	c, ok := a.CreateQuery()
+	assert.True(t, ok)
+
+	assert.Equal(t, "t1", c.Name())
+	assert.Equal(t, "db", c.Database())
+	assert.Equal(t, "MergeTree", c.Engine().Value)
+	assert.Equal(t, "toYYYYMM", c.PartitionBy().Value)
+	assert.Equal(t, "z", c.OrderBy().Value)
+	assert.Equal(t, "Set", c.Settings().Type)
+	assert.Nil(t, c.PrimaryKey())
+
+	columns := c.Columns()
+	assert.Len(t, columns, 2)
+	assert.Equal(t, "Int64", columns[0].Type().Value)
+	assert.Nil(t, columns[0].Default())
+
+	assert.Equal(t, "s", columns[1].Name())
+	assert.Equal(t, "'x'", columns[1].Default().Value)
+	assert.Equal(t, "'a comment'", columns[1].Comment().Value)
+	assert.Equal(t, "CODEC", columns[1].Codec().Value)
+	assert.Nil(t, columns[1].TTL())
+}
+
+// create table t (a Int64, b Int64) engine = MergeTree order by a sample by b
+func sampledTableLines() []string {
+	return []string{
+		"CreateQuery  t (children 3)",
+		" Identifier t",
+		" Columns definition (children 1)",
+		"  ExpressionList (children 2)",
+		"   ColumnDeclaration a (children 1)",
+		"    DataType Int64",
+		"   ColumnDeclaration b (children 1)",
+		"    DataType Int64",
+		" Storage definition (children 3)",
+		"  Function MergeTree (children 1)",
+		"   ExpressionList",
+		"  Identifier a",
+		"  Identifier b",
+	}
+}
+
+func TestStorageClausesWithoutSourceQuery(t *testing.T) {
+	root, err := Parse("", sampledTableLines())
+	assert.NoError(t, err)
+
+	// Two keys could be PARTITION BY and ORDER BY or ORDER BY and SAMPLE BY.
+	c, _ := AsCreateQuery(root)
+	assert.Equal(t, "MergeTree", c.Engine().Value)
+	assert.Nil(t, c.PartitionBy())
+	assert.Nil(t, c.OrderBy())
+	assert.Nil(t, c.SampleBy())
+
+	_, err = Format(root)
+	assert.ErrorContains(t, err, "explain ast doesn't say what it creates")
+
+	_, err = SchemaDiff(c, c)
+	assert.ErrorContains(t, err, "unknown storage clauses")
+
+	root, err = Parse("create table t (a Int64, b Int64) engine = MergeTree order by a sample by b", sampledTableLines())
+	assert.NoError(t, err)
+
+	c, _ = AsCreateQuery(root)
+	assert.Nil(t, c.PartitionBy())
+	assert.Equal(t, "a", c.OrderBy().Value)
+	assert.Equal(t, "b", c.SampleBy().Value)
+
+	// A lone key can only be the ORDER BY.
+	lines := sampledTableLines()
+	lines[8] = " Storage definition (children 2)"
+	root, err = Parse("", lines[:len(lines)-1])
+	assert.NoError(t, err)
+
+	c, _ = AsCreateQuery(root)
+	assert.Equal(t, "a", c.OrderBy().Value)
+}
+
+func TestAlterQueryView(t *testing.T) {
+	a, err := NewFromExplainLines("", alterTableLines())
+	assert.NoError(t, err)
+
+	alter, ok := a.AlterQuery()
+	assert.True(t, ok)
+	assert.Equal(t, "t1", alter.Table())
+
+	commands := alter.Commands()
+	assert.Len(t, commands, 2)
+
+	assert.Equal(t, "ADD_COLUMN", commands[0].Kind())
+	column, ok := commands[0].Column()
+	assert.True(t, ok)
+	assert.Equal(t, "b", column.Name())
+	assert.Equal(t, "b", commands[0].ColumnName())
+
+	assert.Equal(t, "RENAME_COLUMN", commands[1].Kind())
+	assert.Equal(t, "c", commands[1].ColumnName())
+	assert.Equal(t, "d", commands[1].RenameTo())
+
+	assert.Equal(t, []string{"c"}, a.RenameColumnFromIdentifiers())
+	assert.Equal(t, []string{"d"}, a.RenameColumnToIdentifiers())
+}